@@ -19,6 +19,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -26,7 +27,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,6 +37,7 @@ import (
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/maintenance"
 	"golang.org/x/oauth2/jws"
 )
 
@@ -60,7 +64,7 @@ const (
 	osInventoryEnabledDefault      = false
 	guestPoliciesEnabledDefault    = false
 	taskNotificationEnabledDefault = false
-	debugEnabledDefault            = false
+	logLevelDefault                = clog.LevelInfo
 
 	configDirWindows     = `C:\Program Files\Google\OSConfig`
 	configDirLinux       = "/etc/osconfig"
@@ -69,46 +73,96 @@ const (
 	restartFileWindows   = configDirWindows + `\osconfig_agent_restart_required`
 	restartFileLinux     = configDirLinux + "/osconfig_agent_restart_required"
 
+	softwareDeclarationFileWindows = configDirWindows + `\software_declaration.json`
+	softwareDeclarationFileLinux   = configDirLinux + "/software_declaration.json"
+	inventoryFileWindows           = configDirWindows + `\osconfig_inventory.json`
+	inventoryFileLinux             = configDirLinux + "/osconfig_inventory.json"
+	recipeDBDirWindows             = `C:\ProgramData\Google`
+	recipeDBDirLinux               = "/var/lib/google"
+	lockFileWindows                = configDirWindows + `\lock`
+	lockFileLinux                  = "/run/lock/osconfig_agent.lock"
+	execOutputDirWindows           = configDirWindows + `\exec_output`
+	execOutputDirLinux             = configDirLinux + "/exec_output"
+	patchHooksDirWindows           = configDirWindows + `\patch.d`
+	patchResultsDirWindows         = configDirWindows + `\patch_results`
+	patchResultsDirLinux           = configDirLinux + "/patch_results"
+	patchHooksDirLinux             = configDirLinux + "/patch.d"
+
+	// execOutputLimitDefault is in bytes.
+	execOutputLimitDefault = 100 * 1024
+	// execRebootExitCodeDefault is the exit code an exec step uses to ask
+	// for a reboot.
+	execRebootExitCodeDefault = 194
+	// patchMaxRebootsDefault is the number of reboots a patch task may make.
+	patchMaxRebootsDefault = 5
+	// patchRetriesDefault is how many times failed patching is retried,
+	// patchRetryBackoffDefault is in minutes.
+	patchRetriesDefault      = 2
+	patchRetryBackoffDefault = 5
+
 	osConfigPollIntervalDefault = 10
-	osConfigMetadataPollTimeout = 60
-	osConfigWatchConfigTimeout  = 10 * time.Minute
+	// RegisterAgent is called at least once a day.
+	registerAgentIntervalDefault = 24 * 60
+	osConfigMetadataPollTimeout  = 60
+	osConfigWatchConfigTimeout   = 10 * time.Minute
 )
 
 var (
 	endpoint = flag.String("endpoint", prodEndpoint, "osconfig endpoint override")
 	debug    = flag.Bool("debug", false, "set debug log verbosity")
 	stdout   = flag.Bool("stdout", false, "log to stdout")
+	rootDir  = flag.String("root_dir", "", "if set, agent state and managed files such as the task state, lock, recipe db and repo files are placed under this directory keeping their usual layout, e.g. <root_dir>/etc/osconfig/osconfig_task.state")
 
 	agentConfig   = &config{}
 	agentConfigMx sync.RWMutex
 	version       string
 	lEtag         = &lastEtag{Etag: "0"}
+	lMetadata     = &lastMetadata{}
+	lLocalConfig  = &lastLocalConfig{}
 
-	// Current supported capabilites for this agent.
-	// These are matched server side to what tasks this agent can
-	// perform.
-	capabilities = []string{"PATCH_GA", "GUEST_POLICY_BETA"}
+	errMetadataDisabled = errors.New("instance identity token is not available, metadata is disabled in the local config file")
 )
 
 type config struct {
-	osInventoryEnabled, guestPoliciesEnabled, taskNotificationEnabled, inventoryReportingEnabled, debugEnabled bool
-	svcEndpoint, googetRepoFilePath, zypperRepoFilePath, yumRepoFilePath, aptRepoFilePath                      string
-	numericProjectID, osConfigPollInterval                                                                     int
-	projectID, instanceZone, instanceName, instanceID                                                          string
+	osInventoryEnabled, guestPoliciesEnabled, taskNotificationEnabled, inventoryReportingEnabled, metadataDisabled bool
+	svcEndpoint, googetRepoFilePath, zypperRepoFilePath, yumRepoFilePath, aptRepoFilePath                          string
+	numericProjectID, osConfigPollInterval                                                                         int
+	inventoryInterval, guestPoliciesInterval, registerAgentInterval                                                int
+	inventorySplay, guestPoliciesSplay, registerAgentSplay                                                         int
+	execOutputLimit, execTimeout, execRebootExitCode                                                               int
+	patchMaxReboots, patchMinRebootInterval, patchRetries, patchRetryBackoff                                       int
+	projectID, instanceZone, instanceName, instanceID                                                              string
+	proxy, noProxy, caBundleFile                                                                                   string
+	clientCertFile, clientKeyFile                                                                                  string
+	endpointPlaintext                                                                                              bool
+	endpointKeepaliveTime, endpointKeepaliveTimeout                                                                int
+	rootDir, patchHooksDir                                                                                         string
+	maintenanceWindows                                                                                             []string
+	logLevel                                                                                                       clog.Level
+	// componentLogLevels are clog component overrides, see
+	// clog.SetComponentLevels.
+	componentLogLevels map[string]clog.Level
 }
 
-func (c *config) parseFeatures(features string, enabled bool) {
+func (c *config) parseFeatures(features string, enabled bool, source, key string, p *provenance) {
 	for _, f := range strings.Split(features, ",") {
 		f = strings.ToLower(strings.TrimSpace(f))
 		switch f {
 		case "tasks", "ospatch": // ospatch is the legacy flag
 			c.taskNotificationEnabled = enabled
+			p.set("taskNotificationEnabled", enabled, source, key)
 		case "guestpolicies", "ospackage": // ospackage is the legacy flag
 			c.guestPoliciesEnabled = enabled
+			p.set("guestPoliciesEnabled", enabled, source, key)
 		case "osinventory":
 			c.osInventoryEnabled = enabled
+			p.set("osInventoryEnabled", enabled, source, key)
 		case "inventoryreporting":
 			c.inventoryReportingEnabled = enabled
+			p.set("inventoryReportingEnabled", enabled, source, key)
+		case "":
+		default:
+			p.ignore(source, key, f, "unknown feature")
 		}
 	}
 }
@@ -143,6 +197,41 @@ func (e *lastEtag) get() string {
 	return e.Etag
 }
 
+type lastMetadata struct {
+	mu sync.RWMutex
+	md metadataJSON
+}
+
+func (m *lastMetadata) set(md metadataJSON) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.md = md
+}
+
+func (m *lastMetadata) get() metadataJSON {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.md
+}
+
+// lastLocalConfig is the last local config file that was read successfully.
+type lastLocalConfig struct {
+	mu sync.RWMutex
+	lc *localConfigJSON
+}
+
+func (l *lastLocalConfig) set(lc *localConfigJSON) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lc = lc
+}
+
+func (l *lastLocalConfig) get() *localConfigJSON {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lc
+}
+
 func parseBool(s string) bool {
 	enabled, err := strconv.ParseBool(s)
 	if err != nil {
@@ -171,34 +260,97 @@ type projectJSON struct {
 }
 
 type attributesJSON struct {
-	InventoryEnabledOld   string       `json:"os-inventory-enabled"`
-	InventoryEnabled      string       `json:"enable-os-inventory"`
-	PreReleaseFeaturesOld string       `json:"os-config-enabled-prerelease-features"`
-	PreReleaseFeatures    string       `json:"osconfig-enabled-prerelease-features"`
-	OSConfigEnabled       string       `json:"enable-osconfig"`
-	DisabledFeatures      string       `json:"osconfig-disabled-features"`
-	DebugEnabledOld       string       `json:"enable-os-config-debug"`
-	LogLevel              string       `json:"osconfig-log-level"`
-	OSConfigEndpointOld   string       `json:"os-config-endpoint"`
-	OSConfigEndpoint      string       `json:"osconfig-endpoint"`
-	PollIntervalOld       *json.Number `json:"os-config-poll-interval"`
-	PollInterval          *json.Number `json:"osconfig-poll-interval"`
-}
-
-func createConfigFromMetadata(md metadataJSON) *config {
+	InventoryEnabledOld   string          `json:"os-inventory-enabled"`
+	InventoryEnabled      string          `json:"enable-os-inventory"`
+	PreReleaseFeaturesOld string          `json:"os-config-enabled-prerelease-features"`
+	PreReleaseFeatures    string          `json:"osconfig-enabled-prerelease-features"`
+	OSConfigEnabled       string          `json:"enable-osconfig"`
+	DisabledFeatures      string          `json:"osconfig-disabled-features"`
+	DebugEnabledOld       string          `json:"enable-os-config-debug"`
+	LogLevel              string          `json:"osconfig-log-level"`
+	OSConfigEndpointOld   string          `json:"os-config-endpoint"`
+	OSConfigEndpoint      string          `json:"osconfig-endpoint"`
+	PollIntervalOld       *metadataNumber `json:"os-config-poll-interval"`
+	PollInterval          *metadataNumber `json:"osconfig-poll-interval"`
+
+	// Per feature intervals and splay, all in minutes.
+	InventoryInterval     *metadataNumber `json:"osconfig-inventory-interval"`
+	GuestPoliciesInterval *metadataNumber `json:"osconfig-guest-policies-interval"`
+	RegisterAgentInterval *metadataNumber `json:"osconfig-register-agent-interval"`
+	InventorySplay        *metadataNumber `json:"osconfig-inventory-splay"`
+	GuestPoliciesSplay    *metadataNumber `json:"osconfig-guest-policies-splay"`
+	RegisterAgentSplay    *metadataNumber `json:"osconfig-register-agent-splay"`
+
+	// MaintenanceWindows is a semicolon separated list of maintenance.Parse
+	// window specs.
+	MaintenanceWindows string `json:"osconfig-maintenance-windows"`
+
+	// ExecOutputLimit is in bytes and ExecTimeout in minutes.
+	ExecOutputLimit *metadataNumber `json:"osconfig-exec-output-limit"`
+	ExecTimeout     *metadataNumber `json:"osconfig-exec-timeout"`
+	// ExecRebootExitCode of 0 turns off rebooting on an exit code.
+	ExecRebootExitCode *metadataNumber `json:"osconfig-exec-reboot-exit-code"`
+
+	// PatchMinRebootInterval is in minutes.
+	PatchMaxReboots        *metadataNumber `json:"osconfig-patch-max-reboots"`
+	PatchMinRebootInterval *metadataNumber `json:"osconfig-patch-min-reboot-interval"`
+
+	// PatchRetryBackoff is in minutes.
+	PatchRetries      *metadataNumber `json:"osconfig-patch-retries"`
+	PatchRetryBackoff *metadataNumber `json:"osconfig-patch-retry-backoff"`
+
+	// ComponentLogLevels is a comma separated list of <component>:<level>,
+	// see clog.SetComponentLevels for what a component is.
+	ComponentLogLevels string `json:"osconfig-component-log-levels"`
+
+	// Outbound connection settings, see the matching agentconfig getters.
+	Proxy        string `json:"osconfig-proxy"`
+	NoProxy      string `json:"osconfig-no-proxy"`
+	CABundleFile string `json:"osconfig-ca-bundle-file"`
+
+	// EndpointKeepaliveTime and EndpointKeepaliveTimeout are in seconds.
+	EndpointKeepaliveTime    *metadataNumber `json:"osconfig-endpoint-keepalive-time"`
+	EndpointKeepaliveTimeout *metadataNumber `json:"osconfig-endpoint-keepalive-timeout"`
+}
+
+// metadataNumber is a numeric metadata value. Metadata values are strings so
+// the value is only parsed when the config is created, that way a bad value
+// is ignored rather than failing the whole metadata response.
+type metadataNumber string
+
+func (n *metadataNumber) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		// Not a string, keep the raw value (usually a JSON number).
+		s = string(b)
+	}
+	*n = metadataNumber(strings.TrimSpace(s))
+	return nil
+}
+
+func (n metadataNumber) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+func (n metadataNumber) String() string {
+	return string(n)
+}
+
+func createConfigFromMetadata(md metadataJSON, lc *localConfigJSON, p *provenance) *config {
 	old := getAgentConfig()
 	c := &config{
 		osInventoryEnabled:      osInventoryEnabledDefault,
 		guestPoliciesEnabled:    guestPoliciesEnabledDefault,
 		taskNotificationEnabled: taskNotificationEnabledDefault,
-		debugEnabled:            debugEnabledDefault,
+		logLevel:                logLevelDefault,
 		svcEndpoint:             prodEndpoint,
 		osConfigPollInterval:    osConfigPollIntervalDefault,
-
-		googetRepoFilePath: googetRepoFilePath,
-		zypperRepoFilePath: zypperRepoFilePath,
-		yumRepoFilePath:    yumRepoFilePath,
-		aptRepoFilePath:    aptRepoFilePath,
+		registerAgentInterval:   registerAgentIntervalDefault,
+		execOutputLimit:         execOutputLimitDefault,
+		execRebootExitCode:      execRebootExitCodeDefault,
+		patchMaxReboots:         patchMaxRebootsDefault,
+		patchRetries:            patchRetriesDefault,
+		patchRetryBackoff:       patchRetryBackoffDefault,
 
 		projectID:        old.projectID,
 		numericProjectID: old.numericProjectID,
@@ -206,129 +358,304 @@ func createConfigFromMetadata(md metadataJSON) *config {
 		instanceName:     old.instanceName,
 		instanceID:       old.instanceID,
 	}
+	// Flags take precedence over the local config file.
+	switch {
+	case *rootDir != "":
+		c.rootDir = *rootDir
+	case lc != nil && lc.RootDir != "":
+		c.rootDir = lc.RootDir
+	}
+	c.googetRepoFilePath = c.statePath(googetRepoFilePath, googetRepoFilePath)
+	c.zypperRepoFilePath = c.statePath(zypperRepoFilePath, zypperRepoFilePath)
+	c.yumRepoFilePath = c.statePath(yumRepoFilePath, yumRepoFilePath)
+	c.aptRepoFilePath = c.statePath(aptRepoFilePath, aptRepoFilePath)
+	c.patchHooksDir = c.statePath(patchHooksDirWindows, patchHooksDirLinux)
+	p.setDefaults(c)
+	switch {
+	case *rootDir != "":
+		p.set("rootDir", c.rootDir, SourceFlag, "-root_dir")
+	case c.rootDir != "":
+		p.set("rootDir", c.rootDir, SourceLocalConfigFile, "rootDir")
+	}
 
 	if md.Project.ProjectID != "" {
 		c.projectID = md.Project.ProjectID
+		p.set("projectId", c.projectID, SourceProjectMetadata, "project-id")
 	}
 	if md.Project.NumericProjectID != 0 {
 		c.numericProjectID = md.Project.NumericProjectID
+		p.set("numericProjectId", c.numericProjectID, SourceProjectMetadata, "numeric-project-id")
 	}
 	if md.Instance.Zone != "" {
 		c.instanceZone = md.Instance.Zone
+		p.set("zone", c.instanceZone, SourceInstanceMetadata, "zone")
 	}
 	if md.Instance.Name != "" {
 		c.instanceName = md.Instance.Name
+		p.set("instanceName", c.instanceName, SourceInstanceMetadata, "name")
 	}
 	if md.Instance.ID != nil {
 		c.instanceID = md.Instance.ID.String()
+		p.set("instanceId", c.instanceID, SourceInstanceMetadata, "id")
 	}
 
 	// Check project first then instance as instance metadata overrides project.
+	c.applyAttributes(md.Project.Attributes, SourceProjectMetadata, p)
+	c.applyAttributes(md.Instance.Attributes, SourceInstanceMetadata, p)
+
 	switch {
-	case md.Project.Attributes.InventoryEnabled != "":
-		c.osInventoryEnabled = parseBool(md.Project.Attributes.InventoryEnabled)
-	case md.Project.Attributes.InventoryEnabledOld != "":
-		c.osInventoryEnabled = parseBool(md.Project.Attributes.InventoryEnabledOld)
+	case md.Project.Attributes.DebugEnabledOld != "":
+		c.applyDebugEnabled(p.parseBoolKey(md.Project.Attributes.DebugEnabledOld, SourceProjectMetadata, "enable-os-config-debug"), SourceProjectMetadata, "enable-os-config-debug", p)
+		if md.Instance.Attributes.DebugEnabledOld != "" {
+			p.ignore(SourceInstanceMetadata, "enable-os-config-debug", md.Instance.Attributes.DebugEnabledOld, "superseded by the project value of the same key")
+		}
+	case md.Instance.Attributes.DebugEnabledOld != "":
+		c.applyDebugEnabled(p.parseBoolKey(md.Instance.Attributes.DebugEnabledOld, SourceInstanceMetadata, "enable-os-config-debug"), SourceInstanceMetadata, "enable-os-config-debug", p)
 	}
 
-	c.parseFeatures(md.Project.Attributes.PreReleaseFeaturesOld, true)
-	c.parseFeatures(md.Project.Attributes.PreReleaseFeatures, true)
-	if md.Project.Attributes.OSConfigEnabled != "" {
-		e := parseBool(md.Project.Attributes.OSConfigEnabled)
-		c.taskNotificationEnabled = e
-		c.guestPoliciesEnabled = e
-		c.osInventoryEnabled = e
+	c.applyLogLevel(md.Project.Attributes.LogLevel, SourceProjectMetadata, "osconfig-log-level", p)
+	c.applyLogLevel(md.Instance.Attributes.LogLevel, SourceInstanceMetadata, "osconfig-log-level", p)
+	c.applyComponentLogLevels(parseComponentLogLevels(md.Project.Attributes.ComponentLogLevels), SourceProjectMetadata, "osconfig-component-log-levels", p)
+	c.applyComponentLogLevels(parseComponentLogLevels(md.Instance.Attributes.ComponentLogLevels), SourceInstanceMetadata, "osconfig-component-log-levels", p)
+
+	// The local config file takes precedence over metadata.
+	c.applyLocalConfig(lc, p)
+
+	// Flags take precedence over metadata and the local config file.
+	if *debug {
+		c.applyDebugEnabled(true, SourceFlag, "-debug", p)
 	}
-	c.parseFeatures(md.Project.Attributes.DisabledFeatures, false)
 
+	setSVCEndpoint(md, lc, c, p)
+
+	return c
+}
+
+// applyAttributes applies the feature and poll interval settings from one
+// level of metadata attributes.
+func (c *config) applyAttributes(a attributesJSON, source string, p *provenance) {
 	switch {
-	case md.Instance.Attributes.InventoryEnabled != "":
-		c.osInventoryEnabled = parseBool(md.Instance.Attributes.InventoryEnabled)
-	case md.Instance.Attributes.InventoryEnabledOld != "":
-		c.osInventoryEnabled = parseBool(md.Instance.Attributes.InventoryEnabledOld)
+	case a.InventoryEnabled != "":
+		c.osInventoryEnabled = p.parseBoolKey(a.InventoryEnabled, source, "enable-os-inventory")
+		p.set("osInventoryEnabled", c.osInventoryEnabled, source, "enable-os-inventory")
+		if a.InventoryEnabledOld != "" {
+			p.ignore(source, "os-inventory-enabled", a.InventoryEnabledOld, "superseded by enable-os-inventory")
+		}
+	case a.InventoryEnabledOld != "":
+		c.osInventoryEnabled = p.parseBoolKey(a.InventoryEnabledOld, source, "os-inventory-enabled")
+		p.set("osInventoryEnabled", c.osInventoryEnabled, source, "os-inventory-enabled")
 	}
 
-	c.parseFeatures(md.Instance.Attributes.PreReleaseFeaturesOld, true)
-	c.parseFeatures(md.Instance.Attributes.PreReleaseFeatures, true)
-	if md.Instance.Attributes.OSConfigEnabled != "" {
-		e := parseBool(md.Instance.Attributes.OSConfigEnabled)
+	c.parseFeatures(a.PreReleaseFeaturesOld, true, source, "os-config-enabled-prerelease-features", p)
+	c.parseFeatures(a.PreReleaseFeatures, true, source, "osconfig-enabled-prerelease-features", p)
+	if a.OSConfigEnabled != "" {
+		e := p.parseBoolKey(a.OSConfigEnabled, source, "enable-osconfig")
 		c.taskNotificationEnabled = e
 		c.guestPoliciesEnabled = e
 		c.osInventoryEnabled = e
+		p.set("taskNotificationEnabled", e, source, "enable-osconfig")
+		p.set("guestPoliciesEnabled", e, source, "enable-osconfig")
+		p.set("osInventoryEnabled", e, source, "enable-osconfig")
 	}
-	c.parseFeatures(md.Instance.Attributes.DisabledFeatures, false)
+	c.parseFeatures(a.DisabledFeatures, false, source, "osconfig-disabled-features", p)
 
 	switch {
-	case md.Project.Attributes.PollInterval != nil:
-		if val, err := md.Project.Attributes.PollInterval.Int64(); err == nil {
-			c.osConfigPollInterval = int(val)
-		}
-	case md.Project.Attributes.PollIntervalOld != nil:
-		if val, err := md.Project.Attributes.PollIntervalOld.Int64(); err == nil {
-			c.osConfigPollInterval = int(val)
+	case a.PollInterval != nil:
+		c.applyPollInterval(a.PollInterval, source, "osconfig-poll-interval", p)
+		if a.PollIntervalOld != nil {
+			p.ignore(source, "os-config-poll-interval", a.PollIntervalOld.String(), "superseded by osconfig-poll-interval")
 		}
+	case a.PollIntervalOld != nil:
+		c.applyPollInterval(a.PollIntervalOld, source, "os-config-poll-interval", p)
 	}
 
-	switch {
-	case md.Instance.Attributes.PollInterval != nil:
-		if val, err := md.Instance.Attributes.PollInterval.Int64(); err == nil {
-			c.osConfigPollInterval = int(val)
+	if a.MaintenanceWindows != "" {
+		var windows []string
+		for _, w := range strings.Split(a.MaintenanceWindows, ";") {
+			if w = strings.TrimSpace(w); w != "" {
+				windows = append(windows, w)
+			}
 		}
-	case md.Instance.Attributes.PollIntervalOld != nil:
-		if val, err := md.Instance.Attributes.PollInterval.Int64(); err == nil {
-			c.osConfigPollInterval = int(val)
+		c.setMaintenanceWindows(windows, source, "osconfig-maintenance-windows", p)
+	}
+
+	if a.Proxy != "" {
+		c.proxy = a.Proxy
+		p.set("proxy", c.proxy, source, "osconfig-proxy")
+	}
+	if a.NoProxy != "" {
+		c.noProxy = a.NoProxy
+		p.set("noProxy", c.noProxy, source, "osconfig-no-proxy")
+	}
+	if a.CABundleFile != "" {
+		c.caBundleFile = a.CABundleFile
+		p.set("caBundleFile", c.caBundleFile, source, "osconfig-ca-bundle-file")
+	}
+
+	applyNonNegative(a.InventoryInterval, &c.inventoryInterval, "inventoryInterval", source, "osconfig-inventory-interval", p)
+	applyNonNegative(a.GuestPoliciesInterval, &c.guestPoliciesInterval, "guestPoliciesInterval", source, "osconfig-guest-policies-interval", p)
+	applyNonNegative(a.RegisterAgentInterval, &c.registerAgentInterval, "registerAgentInterval", source, "osconfig-register-agent-interval", p)
+	applyNonNegative(a.InventorySplay, &c.inventorySplay, "inventorySplay", source, "osconfig-inventory-splay", p)
+	applyNonNegative(a.GuestPoliciesSplay, &c.guestPoliciesSplay, "guestPoliciesSplay", source, "osconfig-guest-policies-splay", p)
+	applyNonNegative(a.RegisterAgentSplay, &c.registerAgentSplay, "registerAgentSplay", source, "osconfig-register-agent-splay", p)
+	applyNonNegative(a.ExecOutputLimit, &c.execOutputLimit, "execOutputLimit", source, "osconfig-exec-output-limit", p)
+	applyNonNegative(a.ExecTimeout, &c.execTimeout, "execTimeout", source, "osconfig-exec-timeout", p)
+	applyNonNegative(a.ExecRebootExitCode, &c.execRebootExitCode, "execRebootExitCode", source, "osconfig-exec-reboot-exit-code", p)
+	applyNonNegative(a.PatchMaxReboots, &c.patchMaxReboots, "patchMaxReboots", source, "osconfig-patch-max-reboots", p)
+	applyNonNegative(a.PatchMinRebootInterval, &c.patchMinRebootInterval, "patchMinRebootInterval", source, "osconfig-patch-min-reboot-interval", p)
+	applyNonNegative(a.PatchRetries, &c.patchRetries, "patchRetries", source, "osconfig-patch-retries", p)
+	applyNonNegative(a.PatchRetryBackoff, &c.patchRetryBackoff, "patchRetryBackoff", source, "osconfig-patch-retry-backoff", p)
+	applyNonNegative(a.EndpointKeepaliveTime, &c.endpointKeepaliveTime, "endpointKeepaliveTime", source, "osconfig-endpoint-keepalive-time", p)
+	applyNonNegative(a.EndpointKeepaliveTimeout, &c.endpointKeepaliveTimeout, "endpointKeepaliveTimeout", source, "osconfig-endpoint-keepalive-timeout", p)
+}
+
+// setMaintenanceWindows replaces the maintenance windows, windows from a
+// higher level replace rather than add to those from a lower one.
+// Invalid windows are kept so that MaintenanceWindows fails closed.
+func (c *config) setMaintenanceWindows(windows []string, source, key string, p *provenance) {
+	c.maintenanceWindows = windows
+	p.set("maintenanceWindows", strings.Join(windows, "; "), source, key)
+	for _, w := range windows {
+		if _, err := maintenance.Parse(w); err != nil {
+			p.ignore(source, key, w, fmt.Sprintf("%v, disruptive work is deferred until this is fixed", err))
 		}
 	}
+}
+
+// applyPollInterval sets the poll interval from n, which must be greater
+// than 0.
+func (c *config) applyPollInterval(n *metadataNumber, source, key string, p *provenance) {
+	val, ok := p.parseIntKey(n, source, key)
+	if !ok {
+		return
+	}
+	if val <= 0 {
+		p.ignore(source, key, n.String(), "must be greater than 0")
+		return
+	}
+	c.osConfigPollInterval = val
+	p.set("pollInterval", val, source, key)
+}
 
-	switch {
-	case md.Project.Attributes.DebugEnabledOld != "":
-		c.debugEnabled = parseBool(md.Project.Attributes.DebugEnabledOld)
-	case md.Instance.Attributes.DebugEnabledOld != "":
-		c.debugEnabled = parseBool(md.Instance.Attributes.DebugEnabledOld)
+// applyNonNegative sets dst from a numeric metadata value, negative values
+// are ignored.
+func applyNonNegative(n *metadataNumber, dst *int, name, source, key string, p *provenance) {
+	if n == nil {
+		return
+	}
+	val, ok := p.parseIntKey(n, source, key)
+	if !ok {
+		return
+	}
+	if val < 0 {
+		p.ignore(source, key, n.String(), "must not be negative")
+		return
 	}
+	*dst = val
+	p.set(name, val, source, key)
+}
 
-	switch strings.ToLower(md.Project.Attributes.LogLevel) {
-	case "debug":
-		c.debugEnabled = true
-	case "info":
-		c.debugEnabled = false
+func (c *config) applyLogLevel(level, source, key string, p *provenance) {
+	if level == "" {
+		return
+	}
+	l, err := clog.ParseLevel(level)
+	if err != nil {
+		p.ignore(source, key, level, "unknown log level")
+		return
 	}
+	c.logLevel = l
+	p.set("logLevel", c.logLevel.String(), source, key)
+}
 
-	switch strings.ToLower(md.Instance.Attributes.LogLevel) {
-	case "debug":
-		c.debugEnabled = true
-	case "info":
-		c.debugEnabled = false
+// applyDebugEnabled applies the legacy boolean debug setting.
+func (c *config) applyDebugEnabled(enabled bool, source, key string, p *provenance) {
+	c.logLevel = clog.LevelInfo
+	if enabled {
+		c.logLevel = clog.LevelDebug
 	}
+	p.set("logLevel", c.logLevel.String(), source, key)
+}
 
-	// Flags take precedence over metadata.
-	if *debug {
-		c.debugEnabled = true
+// parseComponentLogLevels splits a comma separated list of
+// <component>:<level> into a map, invalid entries are kept as is for
+// applyComponentLogLevels to report.
+func parseComponentLogLevels(s string) map[string]string {
+	levels := map[string]string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		// Label components contain "=" so split on the last ":".
+		i := strings.LastIndex(e, ":")
+		if i < 0 {
+			levels[e] = ""
+			continue
+		}
+		levels[strings.TrimSpace(e[:i])] = strings.TrimSpace(e[i+1:])
 	}
+	return levels
+}
 
-	setSVCEndpoint(md, c)
+// applyComponentLogLevels merges component log level overrides, a component
+// set at a higher level replaces the same component from a lower one.
+func (c *config) applyComponentLogLevels(levels map[string]string, source, key string, p *provenance) {
+	if len(levels) == 0 {
+		return
+	}
+	merged := map[string]clog.Level{}
+	for k, v := range c.componentLogLevels {
+		merged[k] = v
+	}
+	for comp, level := range levels {
+		l, err := clog.ParseLevel(level)
+		if comp == "" || err != nil {
+			p.ignore(source, key, comp+":"+level, "not of the form <component>:<debug|info|warning|error>")
+			continue
+		}
+		merged[comp] = l
+	}
+	c.componentLogLevels = merged
+	p.set("componentLogLevels", formatComponentLogLevels(merged), source, key)
+}
 
-	return c
+func formatComponentLogLevels(levels map[string]clog.Level) string {
+	var s []string
+	for k, v := range levels {
+		s = append(s, k+":"+v.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
 }
 
-func setSVCEndpoint(md metadataJSON, c *config) {
+func setSVCEndpoint(md metadataJSON, lc *localConfigJSON, c *config, p *provenance) {
+	source, key := SourceDefault, ""
 	switch {
 	case *endpoint != prodEndpoint:
 		c.svcEndpoint = *endpoint
+		source, key = SourceFlag, "-endpoint"
+	case lc != nil && lc.Endpoint != "":
+		c.svcEndpoint = lc.Endpoint
+		source, key = SourceLocalConfigFile, "endpoint"
 	case md.Instance.Attributes.OSConfigEndpoint != "":
 		c.svcEndpoint = md.Instance.Attributes.OSConfigEndpoint
+		source, key = SourceInstanceMetadata, "osconfig-endpoint"
 	case md.Instance.Attributes.OSConfigEndpointOld != "":
 		c.svcEndpoint = md.Instance.Attributes.OSConfigEndpointOld
+		source, key = SourceInstanceMetadata, "os-config-endpoint"
 	case md.Project.Attributes.OSConfigEndpoint != "":
 		c.svcEndpoint = md.Project.Attributes.OSConfigEndpoint
+		source, key = SourceProjectMetadata, "osconfig-endpoint"
 	case md.Project.Attributes.OSConfigEndpointOld != "":
 		c.svcEndpoint = md.Project.Attributes.OSConfigEndpointOld
+		source, key = SourceProjectMetadata, "os-config-endpoint"
 	}
 
 	// Example instanceZone: projects/123456/zones/us-west1-b
 	parts := strings.Split(c.instanceZone, "/")
 	zone := parts[len(parts)-1]
 	c.svcEndpoint = strings.ReplaceAll(c.svcEndpoint, "{zone}", zone)
+	p.set("endpoint", c.svcEndpoint, source, key)
 }
 
 func formatMetadataError(err error) error {
@@ -380,7 +707,7 @@ func getMetadata(suffix string) ([]byte, string, error) {
 }
 
 // WatchConfig looks for changes in metadata keys. Upon receiving successful response,
-// it create a new agent config.
+// it create a new agent config and notifies any subscribers of the change.
 func WatchConfig(ctx context.Context) error {
 	var md []byte
 	var webError error
@@ -391,20 +718,48 @@ func WatchConfig(ctx context.Context) error {
 	eTag := lEtag.get()
 	webErrorCount := 0
 	for {
-		md, eTag, webError = getMetadata(fmt.Sprintf("?recursive=true&alt=json&wait_for_change=true&last_etag=%s&timeout_sec=%d", lEtag.get(), osConfigMetadataPollTimeout))
-		if webError == nil && eTag != lEtag.get() {
-			lEtag.set(eTag)
-			var metadataConfig metadataJSON
-			if err := json.Unmarshal(md, &metadataConfig); err != nil {
-				return err
+		// The local config file is reread on every loop so changes to it are
+		// picked up even when metadata has not changed.
+		// A file that can not be read keeps the settings it last had, dropping
+		// them would for example drop its maintenance windows and let
+		// disruptive work run at any time.
+		lc, err := readLocalConfig(LocalConfigFile())
+		if err != nil {
+			clog.Errorf(ctx, "Error reading local config file %q, keeping the last config read from it: %v", LocalConfigFile(), err)
+			lc = lLocalConfig.get()
+		} else {
+			lLocalConfig.set(lc)
+		}
+
+		if lc.metadataDisabled() {
+			// Without a metadata server the local config file is our only
+			// source of config, poll it on the loop ticker.
+			webError = nil
+		} else {
+			md, eTag, webError = getMetadata(fmt.Sprintf("?recursive=true&alt=json&wait_for_change=true&last_etag=%s&timeout_sec=%d", lEtag.get(), osConfigMetadataPollTimeout))
+			if webError == nil && eTag != lEtag.get() {
+				lEtag.set(eTag)
+				var metadataConfig metadataJSON
+				if err := json.Unmarshal(md, &metadataConfig); err != nil {
+					return err
+				}
+				lMetadata.set(metadataConfig)
 			}
+		}
 
-			newAgentConfig := createConfigFromMetadata(metadataConfig)
+		if webError == nil {
+			metadataConfig := lMetadata.get()
+			if lc.metadataDisabled() {
+				metadataConfig = metadataJSON{}
+			}
+			newAgentConfig := createConfigFromMetadata(metadataConfig, lc, nil)
 
 			agentConfigMx.Lock()
 			if agentConfig.asSha256() != newAgentConfig.asSha256() {
+				oldAgentConfig := agentConfig
 				agentConfig = newAgentConfig
 				agentConfigMx.Unlock()
+				notifySubscribers(ConfigChange{Old: Config{*oldAgentConfig}, New: Config{*newAgentConfig}})
 				break
 			}
 			agentConfigMx.Unlock()
@@ -442,6 +797,131 @@ func SvcPollInterval() time.Duration {
 	return time.Duration(getAgentConfig().osConfigPollInterval) * time.Minute
 }
 
+// interval returns minutes as a duration, falling back to the poll interval
+// and then its default when unset.
+func (c *config) interval(minutes int) time.Duration {
+	switch {
+	case minutes > 0:
+	case c.osConfigPollInterval > 0:
+		minutes = c.osConfigPollInterval
+	default:
+		minutes = osConfigPollIntervalDefault
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// InventoryInterval is how often inventory is collected, it defaults to the
+// poll interval.
+func InventoryInterval() time.Duration {
+	c := getAgentConfig()
+	return c.interval(c.inventoryInterval)
+}
+
+// GuestPoliciesInterval is how often guest policies are checked, it defaults
+// to the poll interval.
+func GuestPoliciesInterval() time.Duration {
+	c := getAgentConfig()
+	return c.interval(c.guestPoliciesInterval)
+}
+
+// RegisterAgentInterval is how often RegisterAgent is called.
+func RegisterAgentInterval() time.Duration {
+	c := getAgentConfig()
+	return c.interval(c.registerAgentInterval)
+}
+
+// InventorySplay is the maximum random delay added to each inventory run.
+func InventorySplay() time.Duration {
+	return time.Duration(getAgentConfig().inventorySplay) * time.Minute
+}
+
+// GuestPoliciesSplay is the maximum random delay added to each guest policies
+// run.
+func GuestPoliciesSplay() time.Duration {
+	return time.Duration(getAgentConfig().guestPoliciesSplay) * time.Minute
+}
+
+// RegisterAgentSplay is the maximum random delay added to each RegisterAgent
+// call.
+func RegisterAgentSplay() time.Duration {
+	return time.Duration(getAgentConfig().registerAgentSplay) * time.Minute
+}
+
+// MaintenanceWindows returns the configured maintenance windows, an error is
+// returned if any window is invalid.
+func MaintenanceWindows() ([]maintenance.Window, error) {
+	var windows []maintenance.Window
+	for _, spec := range getAgentConfig().maintenanceWindows {
+		w, err := maintenance.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// CheckMaintenanceWindow returns an error if disruptive work such as
+// patching, rebooting or changing packages should not be done now. Invalid
+// maintenance window config blocks all disruptive work. Nothing is queued
+// for the next window: guest policy package changes are left for a later
+// policy run, reboots are skipped and reported as still required and patch
+// tasks are failed.
+func CheckMaintenanceWindow() error {
+	windows, err := MaintenanceWindows()
+	if err != nil {
+		return fmt.Errorf("invalid maintenance window config: %v", err)
+	}
+	return maintenance.Check(windows, time.Now())
+}
+
+// Proxy is the proxy URL used for all outbound connections, when empty the
+// standard proxy environment variables are used.
+func Proxy() string {
+	return getAgentConfig().proxy
+}
+
+// NoProxy is a comma separated list of hosts, domains, IPs and CIDRs that
+// bypass Proxy.
+func NoProxy() string {
+	return getAgentConfig().noProxy
+}
+
+// CABundleFile is a PEM file of CAs trusted for outbound connections in
+// addition to the system roots.
+func CABundleFile() string {
+	return getAgentConfig().caBundleFile
+}
+
+// ClientCertFile is a PEM certificate presented to the agentendpoint
+// service, for endpoints behind a proxy that requires client certificates.
+func ClientCertFile() string {
+	return getAgentConfig().clientCertFile
+}
+
+// ClientKeyFile is the key for ClientCertFile.
+func ClientKeyFile() string {
+	return getAgentConfig().clientKeyFile
+}
+
+// EndpointPlaintext reports whether to connect to the agentendpoint service
+// without TLS, this is only meant for local development endpoints.
+func EndpointPlaintext() bool {
+	return getAgentConfig().endpointPlaintext
+}
+
+// EndpointKeepaliveTime is how long the agentendpoint connection is idle
+// before it is pinged, 0 leaves keepalive pings off.
+func EndpointKeepaliveTime() time.Duration {
+	return time.Duration(getAgentConfig().endpointKeepaliveTime) * time.Second
+}
+
+// EndpointKeepaliveTimeout is how long to wait for a keepalive ping to be
+// answered before the connection is closed, 0 uses the gRPC default.
+func EndpointKeepaliveTimeout() time.Duration {
+	return time.Duration(getAgentConfig().endpointKeepaliveTimeout) * time.Second
+}
+
 // SerialLogPort is the serial port to log to.
 func SerialLogPort() string {
 	if runtime.GOOS == "windows" {
@@ -451,9 +931,28 @@ func SerialLogPort() string {
 	return ""
 }
 
-// Debug sets the debug log verbosity.
+// Debug reports whether the log level is debug.
 func Debug() bool {
-	return *debug || getAgentConfig().debugEnabled
+	return LogLevel() == clog.LevelDebug
+}
+
+// LogLevel is the log level for components without an override.
+func LogLevel() clog.Level {
+	return getAgentConfig().logLevel
+}
+
+// ComponentLogLevels are the per-component log level overrides.
+func ComponentLogLevels() map[string]clog.Level {
+	c := getAgentConfig()
+	return c.copyComponentLogLevels()
+}
+
+func (c *config) copyComponentLogLevels() map[string]clog.Level {
+	levels := make(map[string]clog.Level, len(c.componentLogLevels))
+	for k, v := range c.componentLogLevels {
+		levels[k] = v
+	}
+	return levels
 }
 
 // Stdout flag.
@@ -501,6 +1000,12 @@ func TaskNotificationEnabled() bool {
 	return getAgentConfig().taskNotificationEnabled
 }
 
+// MetadataDisabled indicates whether the agent is running without a metadata
+// server, using only the local config file.
+func MetadataDisabled() bool {
+	return getAgentConfig().metadataDisabled
+}
+
 // InventoryReportingEnabled indicates whether InventoryReporting should be enabled.
 func InventoryReportingEnabled() bool {
 	return getAgentConfig().inventoryReportingEnabled
@@ -565,6 +1070,10 @@ var identity idToken
 
 // IDToken is the instance id token.
 func IDToken() (string, error) {
+	if MetadataDisabled() {
+		return "", errMetadataDisabled
+	}
+
 	identity.Lock()
 	defer identity.Unlock()
 
@@ -578,6 +1087,15 @@ func IDToken() (string, error) {
 	return identity.raw, nil
 }
 
+// GuestAttributesURL is the guest attributes endpoint, ReportURL unless
+// GCE_METADATA_HOST points at another metadata server.
+func GuestAttributesURL() string {
+	if host := os.Getenv(metadataHostEnv); host != "" {
+		return "http://" + host + "/computeMetadata/v1/instance/guest-attributes"
+	}
+	return ReportURL
+}
+
 // Version is the agent version.
 func Version() string {
 	return version
@@ -588,25 +1106,119 @@ func SetVersion(v string) {
 	version = v
 }
 
-// Capabilities returns the agents capabilities.
-func Capabilities() []string {
-	return capabilities
+// statePath returns the windows or linux path for this OS under rootDir.
+func (c *config) statePath(windows, linux string) string {
+	path := linux
+	if runtime.GOOS == "windows" {
+		path = windows
+	}
+	if c.rootDir == "" {
+		return path
+	}
+	return filepath.Join(c.rootDir, strings.TrimPrefix(path, filepath.VolumeName(path)))
+}
+
+// RootDir is the directory agent state and managed files are placed under,
+// empty means they are in their usual locations.
+func RootDir() string {
+	return getAgentConfig().rootDir
 }
 
 // TaskStateFile is the location of the task state file.
 func TaskStateFile() string {
-	if runtime.GOOS == "windows" {
-		return taskStateFileWindows
-	}
+	c := getAgentConfig()
+	return c.statePath(taskStateFileWindows, taskStateFileLinux)
+}
+
+// ExecOutputDir is where the output of exec step tasks is saved.
+func ExecOutputDir() string {
+	c := getAgentConfig()
+	return c.statePath(execOutputDirWindows, execOutputDirLinux)
+}
+
+// PatchResultsDir is where the package results of patch tasks are saved.
+func PatchResultsDir() string {
+	c := getAgentConfig()
+	return c.statePath(patchResultsDirWindows, patchResultsDirLinux)
+}
+
+// PatchHooksDir holds the pre and post directories of patch hooks, see
+// agentendpoint for how hooks are run.
+func PatchHooksDir() string {
+	return getAgentConfig().patchHooksDir
+}
+
+// ExecOutputLimit is the number of bytes of exec step output kept, the start
+// and end of the output are kept and the middle is dropped.
+func ExecOutputLimit() int {
+	return getAgentConfig().execOutputLimit
+}
+
+// ExecTimeout is how long an exec step may run before it is killed, 0 means
+// no timeout.
+func ExecTimeout() time.Duration {
+	return time.Duration(getAgentConfig().execTimeout) * time.Minute
+}
+
+// ExecRebootExitCode is the exit code an exec step uses to have the agent
+// reboot the system, 0 means exec steps can not ask for a reboot.
+func ExecRebootExitCode() int {
+	return getAgentConfig().execRebootExitCode
+}
+
+// PatchMaxReboots is the number of reboots a single patch task may make, 0
+// means no limit.
+func PatchMaxReboots() int {
+	return getAgentConfig().patchMaxReboots
+}
+
+// PatchMinRebootInterval is the least time between two reboots made by the
+// agent, across tasks, 0 means no limit.
+func PatchMinRebootInterval() time.Duration {
+	return time.Duration(getAgentConfig().patchMinRebootInterval) * time.Minute
+}
 
-	return taskStateFileLinux
+// PatchRetries is how many times a patch task retries applying patches
+// after it fails, 0 means it fails at once.
+func PatchRetries() int {
+	return getAgentConfig().patchRetries
+}
+
+// PatchRetryBackoff is the wait before the first retry of a patch task, it
+// doubles for each further retry.
+func PatchRetryBackoff() time.Duration {
+	return time.Duration(getAgentConfig().patchRetryBackoff) * time.Minute
 }
 
 // RestartFile is the location of the restart required file.
 func RestartFile() string {
-	if runtime.GOOS == "windows" {
-		return restartFileWindows
-	}
+	c := getAgentConfig()
+	return c.statePath(restartFileWindows, restartFileLinux)
+}
+
+// SoftwareDeclarationFile is the location of the local guest policy file used
+// in place of the gce-software-declaration metadata key when metadata is
+// disabled.
+func SoftwareDeclarationFile() string {
+	c := getAgentConfig()
+	return c.statePath(softwareDeclarationFileWindows, softwareDeclarationFileLinux)
+}
+
+// InventoryFile is the location inventory is written to in place of guest
+// attributes when metadata is disabled.
+func InventoryFile() string {
+	c := getAgentConfig()
+	return c.statePath(inventoryFileWindows, inventoryFileLinux)
+}
+
+// RecipeDBDir is the directory holding the software recipe database.
+func RecipeDBDir() string {
+	c := getAgentConfig()
+	return c.statePath(recipeDBDirWindows, recipeDBDirLinux)
+}
 
-	return restartFileLinux
+// LockFile is the location of the lock held by a running agent.
+func LockFile() string {
+	c := getAgentConfig()
+	return c.statePath(lockFileWindows, lockFileLinux)
 }
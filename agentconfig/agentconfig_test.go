@@ -17,6 +17,7 @@ package agentconfig
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -24,7 +25,11 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/clog"
 )
 
 func TestWatchConfig(t *testing.T) {
@@ -192,7 +197,7 @@ func TestSetConfigDefaultValues(t *testing.T) {
 		{OSInventoryEnabled, osInventoryEnabledDefault},
 		{TaskNotificationEnabled, taskNotificationEnabledDefault},
 		{GuestPoliciesEnabled, guestPoliciesEnabledDefault},
-		{Debug, debugEnabledDefault},
+		{Debug, false},
 	}
 	for _, tt := range testsBool {
 		if tt.op() != tt.want {
@@ -209,6 +214,9 @@ func TestSetConfigDefaultValues(t *testing.T) {
 	if SvcEndpoint() != expectedEndpoint {
 		t.Errorf("Default endpoint: got(%s) != want(%s)", SvcEndpoint(), expectedEndpoint)
 	}
+	if ExecRebootExitCode() != execRebootExitCodeDefault {
+		t.Errorf("Default exec reboot exit code: got(%d) != want(%d)", ExecRebootExitCode(), execRebootExitCodeDefault)
+	}
 }
 
 func TestVersion(t *testing.T) {
@@ -258,3 +266,526 @@ func TestSetConfigError(t *testing.T) {
 		t.Errorf("Unexpected output %+v", err)
 	}
 }
+
+func TestLocalConfigFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "local-config-etag")
+		fmt.Fprintln(w, `{"project":{"attributes":{"enable-osconfig":"true","osconfig-log-level":"debug","osconfig-poll-interval":"3"}},"instance":{"zone":"fakezone","attributes":{"osconfig-endpoint":"{zone}-metadata.osconfig.googleapis.com","osconfig-disabled-features":"tasks"}}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"taskNotificationEnabled":true,"osInventoryEnabled":false,"logLevel":"info","pollInterval":20,"endpoint":"{zone}-local.osconfig.googleapis.com","aptRepoFilePath":"/tmp/local.list","execRebootExitCode":0}`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	testsBool := []struct {
+		desc string
+		op   func() bool
+		want bool
+	}{
+		{"taskNotification should be enabled (inst disabled, local enabled)", TaskNotificationEnabled, true},
+		{"osinventory should be disabled (proj enabled, local disabled)", OSInventoryEnabled, false},
+		{"guestpolicies should be enabled (proj enabled, local unset)", GuestPoliciesEnabled, true},
+		{"debugenabled should be false (proj debug, local info)", Debug, false},
+	}
+	for _, tt := range testsBool {
+		if tt.op() != tt.want {
+			t.Errorf("%q: got(%t) != want(%t)", tt.desc, tt.op(), tt.want)
+		}
+	}
+
+	if SvcPollInterval().Minutes() != float64(20) {
+		t.Errorf("poll interval: got(%f) != want(%d)", SvcPollInterval().Minutes(), 20)
+	}
+	if want := "fakezone-local.osconfig.googleapis.com"; SvcEndpoint() != want {
+		t.Errorf("endpoint: got(%s) != want(%s)", SvcEndpoint(), want)
+	}
+	if want := "/tmp/local.list"; AptRepoFilePath() != want {
+		t.Errorf("AptRepoFilePath: got(%s) != want(%s)", AptRepoFilePath(), want)
+	}
+	if want := yumRepoFilePath; YumRepoFilePath() != want {
+		t.Errorf("YumRepoFilePath: got(%s) != want(%s)", YumRepoFilePath(), want)
+	}
+	if ExecRebootExitCode() != 0 {
+		t.Errorf("ExecRebootExitCode: got(%d) != want(0)", ExecRebootExitCode())
+	}
+}
+
+func TestMetadataDisabled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected metadata request: %s", r.URL)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"metadataDisabled":true,"projectId":"local-project","numericProjectId":54321,"zone":"local-zone","instanceName":"local-name","instanceId":"54321","guestPoliciesEnabled":true,"osInventoryEnabled":true,"taskNotificationEnabled":true}`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	testsString := []struct {
+		desc string
+		op   func() string
+		want string
+	}{
+		{"Instance", Instance, "local-zone/instances/local-name"},
+		{"ID", ID, "54321"},
+		{"ProjectID", ProjectID, "local-project"},
+		{"SvcEndpoint", SvcEndpoint, "local-zone-osconfig.googleapis.com:443"},
+	}
+	for _, tt := range testsString {
+		if tt.op() != tt.want {
+			t.Errorf("%q: got(%q) != want(%q)", tt.desc, tt.op(), tt.want)
+		}
+	}
+
+	testsBool := []struct {
+		desc string
+		op   func() bool
+		want bool
+	}{
+		{"MetadataDisabled", MetadataDisabled, true},
+		{"GuestPoliciesEnabled", GuestPoliciesEnabled, true},
+		{"OSInventoryEnabled", OSInventoryEnabled, true},
+		{"TaskNotificationEnabled needs metadata", TaskNotificationEnabled, false},
+	}
+	for _, tt := range testsBool {
+		if tt.op() != tt.want {
+			t.Errorf("%q: got(%t) != want(%t)", tt.desc, tt.op(), tt.want)
+		}
+	}
+
+	if _, err := IDToken(); err != errMetadataDisabled {
+		t.Errorf("IDToken: got error %v, want %v", err, errMetadataDisabled)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	// request is read by the server goroutine, so it is guarded by mx.
+	var mx sync.Mutex
+	var request int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		n := request
+		mx.Unlock()
+		w.Header().Set("Etag", fmt.Sprintf("subscribe-etag-%d", n))
+		fmt.Fprintf(w, `{"instance":{"zone":"fakezone","attributes":{"osconfig-poll-interval":"%d"}}}`, n+1)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	changes, unsubscribe := Subscribe()
+	defer unsubscribe()
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+	mx.Lock()
+	request = 1
+	mx.Unlock()
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	// Both updates should have been merged into one change.
+	change := <-changes
+	if got := change.New.SvcPollInterval().Minutes(); got != 2 {
+		t.Errorf("New poll interval: got(%f) != want(%d)", got, 2)
+	}
+	if got := change.Old.SvcPollInterval(); got == change.New.SvcPollInterval() || got.Minutes() == 1 {
+		t.Errorf("Old poll interval should be from before the first update, got %s", got)
+	}
+	if change.New.SvcPollInterval() != Current().SvcPollInterval() {
+		t.Errorf("New config does not match Current()")
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected extra change: %+v", change)
+	default:
+	}
+
+	unsubscribe()
+	if _, ok := <-changes; ok {
+		t.Error("expected changes channel to be closed after unsubscribe")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "wait_for_change") {
+			t.Errorf("Explain should not wait for changes: %s", r.URL)
+		}
+		fmt.Fprintln(w, `{"project":{"attributes":{"osconfig-poll-interval":"abc","enable-osconfig":"true"}},"instance":{"zone":"fakezone","attributes":{"os-inventory-enabled":"true","enable-os-inventory":"false","osconfig-disabled-features":"tasks,bogus","osconfig-poll-interval":"0"}}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"endpoint":"{zone}-local.osconfig.googleapis.com","pollInterval":0}`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+
+	e, err := Explain()
+	if err != nil {
+		t.Fatalf("Error running Explain: %v", err)
+	}
+
+	got := map[string]Setting{}
+	for _, s := range e.Settings {
+		got[s.Name] = s
+	}
+	want := []Setting{
+		{Name: "osInventoryEnabled", Value: "false", Source: SourceInstanceMetadata, Key: "enable-os-inventory"},
+		{Name: "guestPoliciesEnabled", Value: "true", Source: SourceProjectMetadata, Key: "enable-osconfig"},
+		{Name: "taskNotificationEnabled", Value: "false", Source: SourceInstanceMetadata, Key: "osconfig-disabled-features"},
+		{Name: "pollInterval", Value: "10", Source: SourceDefault},
+		{Name: "endpoint", Value: "fakezone-local.osconfig.googleapis.com", Source: SourceLocalConfigFile, Key: "endpoint"},
+		{Name: "zone", Value: "fakezone", Source: SourceInstanceMetadata, Key: "zone"},
+	}
+	for _, w := range want {
+		if !reflect.DeepEqual(got[w.Name], w) {
+			t.Errorf("%s: got(%+v) != want(%+v)", w.Name, got[w.Name], w)
+		}
+	}
+
+	wantIgnored := []IgnoredKey{
+		{Source: SourceProjectMetadata, Key: "osconfig-poll-interval", Value: "abc", Reason: "not a valid integer"},
+		{Source: SourceInstanceMetadata, Key: "os-inventory-enabled", Value: "true", Reason: "superseded by enable-os-inventory"},
+		{Source: SourceInstanceMetadata, Key: "osconfig-disabled-features", Value: "bogus", Reason: "unknown feature"},
+		{Source: SourceInstanceMetadata, Key: "osconfig-poll-interval", Value: "0", Reason: "must be greater than 0"},
+		{Source: SourceLocalConfigFile, Key: "pollInterval", Value: "0", Reason: "must be greater than 0"},
+	}
+	if !reflect.DeepEqual(e.Ignored, wantIgnored) {
+		t.Errorf("ignored keys: got(%+v) != want(%+v)", e.Ignored, wantIgnored)
+	}
+}
+
+func TestIntervals(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "intervals-etag")
+		fmt.Fprintln(w, `{"project":{"attributes":{"osconfig-poll-interval":"3","osconfig-inventory-interval":"30"}},"instance":{"attributes":{"osconfig-inventory-interval":"60","osconfig-inventory-splay":"5","osconfig-register-agent-splay":"-1"}}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	tests := []struct {
+		desc string
+		op   func() time.Duration
+		want time.Duration
+	}{
+		{"InventoryInterval (instance overrides project)", InventoryInterval, 60 * time.Minute},
+		{"InventorySplay", InventorySplay, 5 * time.Minute},
+		{"GuestPoliciesInterval (follows poll interval)", GuestPoliciesInterval, 3 * time.Minute},
+		{"GuestPoliciesSplay", GuestPoliciesSplay, 0},
+		{"RegisterAgentInterval (default)", RegisterAgentInterval, 24 * time.Hour},
+		{"RegisterAgentSplay (negative ignored)", RegisterAgentSplay, 0},
+	}
+	for _, tt := range tests {
+		if tt.op() != tt.want {
+			t.Errorf("%q: got(%s) != want(%s)", tt.desc, tt.op(), tt.want)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "log-levels-etag")
+		fmt.Fprintln(w, `{"project":{"attributes":{"osconfig-log-level":"warning","osconfig-component-log-levels":"packages:debug,policies:error"}},"instance":{"attributes":{"osconfig-component-log-levels":"policies:info, task_type=ExecStepTask:debug, recipes:loud"}}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	if LogLevel() != clog.LevelWarning {
+		t.Errorf("LogLevel: got(%s) != want(%s)", LogLevel(), clog.LevelWarning)
+	}
+	if Debug() {
+		t.Error("Debug: got(true) != want(false)")
+	}
+	// Instance overrides project per component, invalid entries are ignored.
+	want := map[string]clog.Level{
+		"packages":               clog.LevelDebug,
+		"policies":               clog.LevelInfo,
+		"task_type=ExecStepTask": clog.LevelDebug,
+	}
+	if got := ComponentLogLevels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ComponentLogLevels: got(%v) != want(%v)", got, want)
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "maintenance-windows-etag")
+		fmt.Fprintln(w, `{"project":{"attributes":{"osconfig-maintenance-windows":"Sat 00:00-24:00"}},"instance":{"attributes":{"osconfig-maintenance-windows":"Mon-Fri 22:00-06:00 UTC; Sun 01:00-02:00"}}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	windows, err := MaintenanceWindows()
+	if err != nil {
+		t.Fatalf("Error running MaintenanceWindows: %v", err)
+	}
+	var got []string
+	for _, w := range windows {
+		got = append(got, w.String())
+	}
+	if want := []string{"Mon-Fri 22:00-06:00 UTC", "Sun 01:00-02:00"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MaintenanceWindows: got(%q) != want(%q)", got, want)
+	}
+
+	// An invalid window in the local config file defers everything.
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"maintenanceWindows":["Someday 09:00-17:00"]}`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+	if err := CheckMaintenanceWindow(); err == nil {
+		t.Error("CheckMaintenanceWindow: expected an error for an invalid window")
+	}
+}
+
+func TestLocalConfigFileInvalid(t *testing.T) {
+	var mx sync.Mutex
+	pollInterval := "3"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		w.Header().Set("Etag", "local-config-invalid-etag-"+pollInterval)
+		fmt.Fprintf(w, `{"instance":{"attributes":{"osconfig-poll-interval":"%s"}}}`+"\n", pollInterval)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"maintenanceWindows":["Sun 01:00-02:00"]}`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	// A typo in the file must not drop the windows it set.
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"maintenanceWindows":["Sun 01:00-02:00"]`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+	mx.Lock()
+	pollInterval = "4"
+	mx.Unlock()
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+	if SvcPollInterval() != 4*time.Minute {
+		t.Fatalf("poll interval: got(%s) != want(%s), config not reread", SvcPollInterval(), 4*time.Minute)
+	}
+
+	windows, err := MaintenanceWindows()
+	if err != nil {
+		t.Fatalf("Error running MaintenanceWindows: %v", err)
+	}
+	var got []string
+	for _, w := range windows {
+		got = append(got, w.String())
+	}
+	if want := []string{"Sun 01:00-02:00"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MaintenanceWindows: got(%q) != want(%q)", got, want)
+	}
+}
+
+func TestRootDir(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "root-dir-etag")
+		fmt.Fprintln(w, `{"instance":{"zone":"fakezone"}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	root := filepath.Join(td, "root")
+	if err := ioutil.WriteFile(*localConfigFile, []byte(fmt.Sprintf(`{"rootDir":%q,"yumRepoFilePath":"/tmp/local.repo"}`, root)), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	under := func(windows, linux string) string {
+		path := linux
+		if runtime.GOOS == "windows" {
+			path = windows
+		}
+		return filepath.Join(root, strings.TrimPrefix(path, filepath.VolumeName(path)))
+	}
+	testsString := []struct {
+		desc string
+		op   func() string
+		want string
+	}{
+		{"RootDir", RootDir, root},
+		{"TaskStateFile", TaskStateFile, under(taskStateFileWindows, taskStateFileLinux)},
+		{"RestartFile", RestartFile, under(restartFileWindows, restartFileLinux)},
+		{"RecipeDBDir", RecipeDBDir, under(recipeDBDirWindows, recipeDBDirLinux)},
+		{"LockFile", LockFile, under(lockFileWindows, lockFileLinux)},
+		{"PatchHooksDir", PatchHooksDir, under(patchHooksDirWindows, patchHooksDirLinux)},
+		{"PatchResultsDir", PatchResultsDir, under(patchResultsDirWindows, patchResultsDirLinux)},
+		{"AptRepoFilePath", AptRepoFilePath, under(aptRepoFilePath, aptRepoFilePath)},
+		{"YumRepoFilePath (set in local config)", YumRepoFilePath, "/tmp/local.repo"},
+		// The local config file itself is only moved by flags.
+		{"LocalConfigFile", LocalConfigFile, filepath.Join(td, "agent.json")},
+	}
+	for _, tt := range testsString {
+		if tt.op() != tt.want {
+			t.Errorf("%q: got(%q) != want(%q)", tt.desc, tt.op(), tt.want)
+		}
+	}
+}
+
+func TestEndpointConnection(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "endpoint-connection-etag")
+		fmt.Fprintln(w, `{"project":{"attributes":{"osconfig-endpoint-keepalive-time":"60","osconfig-endpoint-keepalive-timeout":"-1"}},"instance":{"attributes":{"osconfig-endpoint-keepalive-timeout":"10"}}}`)
+	}))
+	defer ts.Close()
+
+	if err := os.Setenv("GCE_METADATA_HOST", strings.Trim(ts.URL, "http://")); err != nil {
+		t.Fatalf("Error running os.Setenv: %v", err)
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	oldLocalConfigFile := *localConfigFile
+	*localConfigFile = filepath.Join(td, "agent.json")
+	defer func() { *localConfigFile = oldLocalConfigFile }()
+
+	if err := ioutil.WriteFile(*localConfigFile, []byte(`{"clientCertFile":"/etc/osconfig/client.pem","clientKeyFile":"/etc/osconfig/client.key","endpointPlaintext":true,"endpointKeepaliveTime":30}`), 0600); err != nil {
+		t.Fatalf("error writing local config: %v", err)
+	}
+
+	if err := WatchConfig(context.Background()); err != nil {
+		t.Fatalf("Error running WatchConfig: %v", err)
+	}
+
+	if want := "/etc/osconfig/client.pem"; ClientCertFile() != want {
+		t.Errorf("ClientCertFile: got(%s) != want(%s)", ClientCertFile(), want)
+	}
+	if want := "/etc/osconfig/client.key"; ClientKeyFile() != want {
+		t.Errorf("ClientKeyFile: got(%s) != want(%s)", ClientKeyFile(), want)
+	}
+	if !EndpointPlaintext() {
+		t.Errorf("EndpointPlaintext: got(false) != want(true)")
+	}
+	tests := []struct {
+		desc string
+		op   func() time.Duration
+		want time.Duration
+	}{
+		{"EndpointKeepaliveTime (local overrides metadata)", EndpointKeepaliveTime, 30 * time.Second},
+		{"EndpointKeepaliveTimeout (instance, project negative ignored)", EndpointKeepaliveTimeout, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if tt.op() != tt.want {
+			t.Errorf("%q: got(%s) != want(%s)", tt.desc, tt.op(), tt.want)
+		}
+	}
+}
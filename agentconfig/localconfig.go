@@ -0,0 +1,291 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentconfig
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	localConfigFileWindows = configDirWindows + `\agent.json`
+	localConfigFileLinux   = configDirLinux + "/agent.json"
+)
+
+var localConfigFile = flag.String("config_file", "", "path to the local agent config file, defaults to agent.json in the agent config directory under -root_dir")
+
+// localConfigJSON is the format of the local agent config file.
+//
+// Settings are applied with the following precedence:
+// flags > local config file > instance metadata > project metadata > defaults.
+// Any field left unset in the file falls through to the next level.
+type localConfigJSON struct {
+	OSInventoryEnabled        *bool  `json:"osInventoryEnabled"`
+	GuestPoliciesEnabled      *bool  `json:"guestPoliciesEnabled"`
+	TaskNotificationEnabled   *bool  `json:"taskNotificationEnabled"`
+	InventoryReportingEnabled *bool  `json:"inventoryReportingEnabled"`
+	LogLevel                  string `json:"logLevel"`
+	// ComponentLogLevels maps a component, see clog.SetComponentLevels,
+	// to its log level.
+	ComponentLogLevels map[string]string `json:"componentLogLevels"`
+	Endpoint           string            `json:"endpoint"`
+	// RootDir is the same as the -root_dir flag, which takes precedence.
+	// It does not move the local config file itself.
+	RootDir string `json:"rootDir"`
+	// PollInterval is in minutes, the same as osconfig-poll-interval.
+	PollInterval *int `json:"pollInterval"`
+	// Per feature intervals and the maximum random splay added to each
+	// run, all in minutes. Unset or 0 intervals follow PollInterval.
+	InventoryInterval     *int `json:"inventoryInterval"`
+	GuestPoliciesInterval *int `json:"guestPoliciesInterval"`
+	RegisterAgentInterval *int `json:"registerAgentInterval"`
+	InventorySplay        *int `json:"inventorySplay"`
+	GuestPoliciesSplay    *int `json:"guestPoliciesSplay"`
+	RegisterAgentSplay    *int `json:"registerAgentSplay"`
+	// ExecOutputLimit is the number of bytes of exec step output kept.
+	ExecOutputLimit *int `json:"execOutputLimit"`
+	// ExecTimeout is in minutes, 0 means exec steps have no timeout.
+	ExecTimeout *int `json:"execTimeout"`
+	// ExecRebootExitCode is the exit code an exec step uses to ask for a
+	// reboot, 0 turns this off.
+	ExecRebootExitCode *int `json:"execRebootExitCode"`
+	// PatchMaxReboots limits the reboots of a patch task and
+	// PatchMinRebootInterval, in minutes, how often the agent reboots,
+	// 0 disables either.
+	PatchMaxReboots        *int `json:"patchMaxReboots"`
+	PatchMinRebootInterval *int `json:"patchMinRebootInterval"`
+	// PatchRetries is how many times failed patching is retried, the
+	// first retry waits PatchRetryBackoff minutes, doubling after that.
+	PatchRetries      *int `json:"patchRetries"`
+	PatchRetryBackoff *int `json:"patchRetryBackoff"`
+	// PatchHooksDir replaces the patch hook directory, it can not be set
+	// from metadata as hooks run with the privileges of the agent.
+	PatchHooksDir string `json:"patchHooksDir"`
+	// MaintenanceWindows are maintenance.Parse window specs, when set
+	// they replace any windows from metadata.
+	MaintenanceWindows []string `json:"maintenanceWindows"`
+	// Proxy, NoProxy and CABundleFile apply to all outbound connections.
+	Proxy        string `json:"proxy"`
+	NoProxy      string `json:"noProxy"`
+	CABundleFile string `json:"caBundleFile"`
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key for
+	// mTLS to the agentendpoint service, EndpointPlaintext connects to it
+	// without TLS for local development. None of these can be set from
+	// metadata.
+	ClientCertFile    string `json:"clientCertFile"`
+	ClientKeyFile     string `json:"clientKeyFile"`
+	EndpointPlaintext bool   `json:"endpointPlaintext"`
+	// EndpointKeepaliveTime and EndpointKeepaliveTimeout are in seconds,
+	// the same as the matching metadata keys.
+	EndpointKeepaliveTime    *int `json:"endpointKeepaliveTime"`
+	EndpointKeepaliveTimeout *int `json:"endpointKeepaliveTimeout"`
+
+	GooGetRepoFilePath string `json:"googetRepoFilePath"`
+	ZypperRepoFilePath string `json:"zypperRepoFilePath"`
+	YumRepoFilePath    string `json:"yumRepoFilePath"`
+	AptRepoFilePath    string `json:"aptRepoFilePath"`
+
+	// MetadataDisabled runs the agent without a metadata server, instance
+	// identity then comes from the fields below. Features that require the
+	// OS Config service (task notifications and inventory reporting) are
+	// unavailable in this mode as there is no instance identity token.
+	MetadataDisabled bool   `json:"metadataDisabled"`
+	ProjectID        string `json:"projectId"`
+	NumericProjectID int    `json:"numericProjectId"`
+	Zone             string `json:"zone"`
+	InstanceName     string `json:"instanceName"`
+	InstanceID       string `json:"instanceId"`
+}
+
+func (lc *localConfigJSON) metadataDisabled() bool {
+	return lc != nil && lc.MetadataDisabled
+}
+
+// readLocalConfig reads the local agent config file, a missing file is not
+// an error and returns nil.
+func readLocalConfig(path string) (*localConfigJSON, error) {
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lc localConfigJSON
+	if err := json.Unmarshal(d, &lc); err != nil {
+		return nil, err
+	}
+	return &lc, nil
+}
+
+// applyLocalConfig overrides metadata derived settings with any values set
+// in the local config file.
+func (c *config) applyLocalConfig(lc *localConfigJSON, p *provenance) {
+	if lc == nil {
+		return
+	}
+
+	if lc.OSInventoryEnabled != nil {
+		c.osInventoryEnabled = *lc.OSInventoryEnabled
+		p.set("osInventoryEnabled", c.osInventoryEnabled, SourceLocalConfigFile, "osInventoryEnabled")
+	}
+	if lc.GuestPoliciesEnabled != nil {
+		c.guestPoliciesEnabled = *lc.GuestPoliciesEnabled
+		p.set("guestPoliciesEnabled", c.guestPoliciesEnabled, SourceLocalConfigFile, "guestPoliciesEnabled")
+	}
+	if lc.TaskNotificationEnabled != nil {
+		c.taskNotificationEnabled = *lc.TaskNotificationEnabled
+		p.set("taskNotificationEnabled", c.taskNotificationEnabled, SourceLocalConfigFile, "taskNotificationEnabled")
+	}
+	if lc.InventoryReportingEnabled != nil {
+		c.inventoryReportingEnabled = *lc.InventoryReportingEnabled
+		p.set("inventoryReportingEnabled", c.inventoryReportingEnabled, SourceLocalConfigFile, "inventoryReportingEnabled")
+	}
+
+	c.applyLogLevel(lc.LogLevel, SourceLocalConfigFile, "logLevel", p)
+	c.applyComponentLogLevels(lc.ComponentLogLevels, SourceLocalConfigFile, "componentLogLevels", p)
+
+	if lc.PollInterval != nil {
+		if *lc.PollInterval > 0 {
+			c.osConfigPollInterval = *lc.PollInterval
+			p.set("pollInterval", c.osConfigPollInterval, SourceLocalConfigFile, "pollInterval")
+		} else {
+			p.ignore(SourceLocalConfigFile, "pollInterval", fmt.Sprint(*lc.PollInterval), "must be greater than 0")
+		}
+	}
+	applyLocalNonNegative(lc.InventoryInterval, &c.inventoryInterval, "inventoryInterval", p)
+	applyLocalNonNegative(lc.GuestPoliciesInterval, &c.guestPoliciesInterval, "guestPoliciesInterval", p)
+	applyLocalNonNegative(lc.RegisterAgentInterval, &c.registerAgentInterval, "registerAgentInterval", p)
+	applyLocalNonNegative(lc.InventorySplay, &c.inventorySplay, "inventorySplay", p)
+	applyLocalNonNegative(lc.GuestPoliciesSplay, &c.guestPoliciesSplay, "guestPoliciesSplay", p)
+	applyLocalNonNegative(lc.RegisterAgentSplay, &c.registerAgentSplay, "registerAgentSplay", p)
+	applyLocalNonNegative(lc.ExecOutputLimit, &c.execOutputLimit, "execOutputLimit", p)
+	applyLocalNonNegative(lc.ExecTimeout, &c.execTimeout, "execTimeout", p)
+	applyLocalNonNegative(lc.ExecRebootExitCode, &c.execRebootExitCode, "execRebootExitCode", p)
+	applyLocalNonNegative(lc.PatchMaxReboots, &c.patchMaxReboots, "patchMaxReboots", p)
+	applyLocalNonNegative(lc.PatchMinRebootInterval, &c.patchMinRebootInterval, "patchMinRebootInterval", p)
+	applyLocalNonNegative(lc.PatchRetries, &c.patchRetries, "patchRetries", p)
+	applyLocalNonNegative(lc.PatchRetryBackoff, &c.patchRetryBackoff, "patchRetryBackoff", p)
+
+	if lc.PatchHooksDir != "" {
+		c.patchHooksDir = lc.PatchHooksDir
+		p.set("patchHooksDir", c.patchHooksDir, SourceLocalConfigFile, "patchHooksDir")
+	}
+
+	if len(lc.MaintenanceWindows) > 0 {
+		c.setMaintenanceWindows(lc.MaintenanceWindows, SourceLocalConfigFile, "maintenanceWindows", p)
+	}
+
+	if lc.Proxy != "" {
+		c.proxy = lc.Proxy
+		p.set("proxy", c.proxy, SourceLocalConfigFile, "proxy")
+	}
+	if lc.NoProxy != "" {
+		c.noProxy = lc.NoProxy
+		p.set("noProxy", c.noProxy, SourceLocalConfigFile, "noProxy")
+	}
+	if lc.CABundleFile != "" {
+		c.caBundleFile = lc.CABundleFile
+		p.set("caBundleFile", c.caBundleFile, SourceLocalConfigFile, "caBundleFile")
+	}
+	if lc.ClientCertFile != "" {
+		c.clientCertFile = lc.ClientCertFile
+		p.set("clientCertFile", c.clientCertFile, SourceLocalConfigFile, "clientCertFile")
+	}
+	if lc.ClientKeyFile != "" {
+		c.clientKeyFile = lc.ClientKeyFile
+		p.set("clientKeyFile", c.clientKeyFile, SourceLocalConfigFile, "clientKeyFile")
+	}
+	if lc.EndpointPlaintext {
+		c.endpointPlaintext = true
+		p.set("endpointPlaintext", true, SourceLocalConfigFile, "endpointPlaintext")
+	}
+	applyLocalNonNegative(lc.EndpointKeepaliveTime, &c.endpointKeepaliveTime, "endpointKeepaliveTime", p)
+	applyLocalNonNegative(lc.EndpointKeepaliveTimeout, &c.endpointKeepaliveTimeout, "endpointKeepaliveTimeout", p)
+
+	if lc.GooGetRepoFilePath != "" {
+		c.googetRepoFilePath = lc.GooGetRepoFilePath
+		p.set("googetRepoFilePath", c.googetRepoFilePath, SourceLocalConfigFile, "googetRepoFilePath")
+	}
+	if lc.ZypperRepoFilePath != "" {
+		c.zypperRepoFilePath = lc.ZypperRepoFilePath
+		p.set("zypperRepoFilePath", c.zypperRepoFilePath, SourceLocalConfigFile, "zypperRepoFilePath")
+	}
+	if lc.YumRepoFilePath != "" {
+		c.yumRepoFilePath = lc.YumRepoFilePath
+		p.set("yumRepoFilePath", c.yumRepoFilePath, SourceLocalConfigFile, "yumRepoFilePath")
+	}
+	if lc.AptRepoFilePath != "" {
+		c.aptRepoFilePath = lc.AptRepoFilePath
+		p.set("aptRepoFilePath", c.aptRepoFilePath, SourceLocalConfigFile, "aptRepoFilePath")
+	}
+
+	if lc.ProjectID != "" {
+		c.projectID = lc.ProjectID
+		p.set("projectId", c.projectID, SourceLocalConfigFile, "projectId")
+	}
+	if lc.NumericProjectID != 0 {
+		c.numericProjectID = lc.NumericProjectID
+		p.set("numericProjectId", c.numericProjectID, SourceLocalConfigFile, "numericProjectId")
+	}
+	if lc.Zone != "" {
+		c.instanceZone = lc.Zone
+		p.set("zone", c.instanceZone, SourceLocalConfigFile, "zone")
+	}
+	if lc.InstanceName != "" {
+		c.instanceName = lc.InstanceName
+		p.set("instanceName", c.instanceName, SourceLocalConfigFile, "instanceName")
+	}
+	if lc.InstanceID != "" {
+		c.instanceID = lc.InstanceID
+		p.set("instanceId", c.instanceID, SourceLocalConfigFile, "instanceId")
+	}
+
+	if lc.MetadataDisabled {
+		c.metadataDisabled = true
+		// Both of these need an instance identity token.
+		c.taskNotificationEnabled = false
+		c.inventoryReportingEnabled = false
+		p.set("metadataDisabled", true, SourceLocalConfigFile, "metadataDisabled")
+		p.set("taskNotificationEnabled", false, SourceLocalConfigFile, "metadataDisabled")
+		p.set("inventoryReportingEnabled", false, SourceLocalConfigFile, "metadataDisabled")
+	}
+}
+
+func applyLocalNonNegative(v *int, dst *int, name string, p *provenance) {
+	if v == nil {
+		return
+	}
+	if *v < 0 {
+		p.ignore(SourceLocalConfigFile, name, fmt.Sprint(*v), "must not be negative")
+		return
+	}
+	*dst = *v
+	p.set(name, *v, SourceLocalConfigFile, name)
+}
+
+// LocalConfigFile is the location of the local agent config file.
+func LocalConfigFile() string {
+	if *localConfigFile != "" {
+		return *localConfigFile
+	}
+	// Only the flag can move the local config file, not the file itself.
+	c := &config{rootDir: *rootDir}
+	return c.statePath(localConfigFileWindows, localConfigFileLinux)
+}
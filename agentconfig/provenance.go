@@ -0,0 +1,176 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Config sources in order of increasing precedence.
+const (
+	SourceDefault          = "default"
+	SourceProjectMetadata  = "project metadata"
+	SourceInstanceMetadata = "instance metadata"
+	SourceLocalConfigFile  = "local config file"
+	SourceFlag             = "flag"
+)
+
+// Setting is an effective agent setting and where its value came from.
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	// Key is the metadata key, local config file field or flag that set
+	// the value, it is empty for defaults.
+	Key string `json:"key,omitempty"`
+}
+
+// IgnoredKey is a config key that was set but did not take effect as set,
+// either because another key took precedence or its value could not be
+// parsed.
+type IgnoredKey struct {
+	Source string `json:"source"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// Explanation is the effective agent config along with the provenance of
+// each setting.
+type Explanation struct {
+	Settings []Setting    `json:"settings"`
+	Ignored  []IgnoredKey `json:"ignored"`
+}
+
+// provenance records where each setting came from while a config is
+// created, a nil *provenance records nothing.
+type provenance struct {
+	settings map[string]int
+	e        Explanation
+}
+
+func newProvenance() *provenance {
+	return &provenance{settings: map[string]int{}}
+}
+
+func (p *provenance) set(name string, value interface{}, source, key string) {
+	if p == nil {
+		return
+	}
+	s := Setting{Name: name, Value: fmt.Sprint(value), Source: source, Key: key}
+	if i, ok := p.settings[name]; ok {
+		p.e.Settings[i] = s
+		return
+	}
+	p.settings[name] = len(p.e.Settings)
+	p.e.Settings = append(p.e.Settings, s)
+}
+
+func (p *provenance) ignore(source, key, value, reason string) {
+	if p == nil {
+		return
+	}
+	p.e.Ignored = append(p.e.Ignored, IgnoredKey{Source: source, Key: key, Value: value, Reason: reason})
+}
+
+// parseBoolKey is parseBool that records unparsable values.
+func (p *provenance) parseBoolKey(s, source, key string) bool {
+	if _, err := strconv.ParseBool(s); err != nil {
+		p.ignore(source, key, s, "not a valid boolean, treated as false")
+	}
+	return parseBool(s)
+}
+
+// parseIntKey parses an integer setting, recording unparsable values.
+func (p *provenance) parseIntKey(n *metadataNumber, source, key string) (int, bool) {
+	val, err := n.Int64()
+	if err != nil {
+		p.ignore(source, key, n.String(), "not a valid integer")
+		return 0, false
+	}
+	return int(val), true
+}
+
+func (p *provenance) setDefaults(c *config) {
+	p.set("osInventoryEnabled", c.osInventoryEnabled, SourceDefault, "")
+	p.set("guestPoliciesEnabled", c.guestPoliciesEnabled, SourceDefault, "")
+	p.set("taskNotificationEnabled", c.taskNotificationEnabled, SourceDefault, "")
+	p.set("inventoryReportingEnabled", c.inventoryReportingEnabled, SourceDefault, "")
+	p.set("logLevel", c.logLevel.String(), SourceDefault, "")
+	p.set("componentLogLevels", "", SourceDefault, "")
+	p.set("endpoint", c.svcEndpoint, SourceDefault, "")
+	p.set("pollInterval", c.osConfigPollInterval, SourceDefault, "")
+	p.set("inventoryInterval", c.inventoryInterval, SourceDefault, "")
+	p.set("guestPoliciesInterval", c.guestPoliciesInterval, SourceDefault, "")
+	p.set("registerAgentInterval", c.registerAgentInterval, SourceDefault, "")
+	p.set("inventorySplay", c.inventorySplay, SourceDefault, "")
+	p.set("guestPoliciesSplay", c.guestPoliciesSplay, SourceDefault, "")
+	p.set("registerAgentSplay", c.registerAgentSplay, SourceDefault, "")
+	p.set("execOutputLimit", c.execOutputLimit, SourceDefault, "")
+	p.set("execTimeout", c.execTimeout, SourceDefault, "")
+	p.set("execRebootExitCode", c.execRebootExitCode, SourceDefault, "")
+	p.set("patchMaxReboots", c.patchMaxReboots, SourceDefault, "")
+	p.set("patchMinRebootInterval", c.patchMinRebootInterval, SourceDefault, "")
+	p.set("patchRetries", c.patchRetries, SourceDefault, "")
+	p.set("patchRetryBackoff", c.patchRetryBackoff, SourceDefault, "")
+	p.set("patchHooksDir", c.patchHooksDir, SourceDefault, "")
+	p.set("maintenanceWindows", "", SourceDefault, "")
+	p.set("proxy", c.proxy, SourceDefault, "")
+	p.set("noProxy", c.noProxy, SourceDefault, "")
+	p.set("caBundleFile", c.caBundleFile, SourceDefault, "")
+	p.set("clientCertFile", c.clientCertFile, SourceDefault, "")
+	p.set("clientKeyFile", c.clientKeyFile, SourceDefault, "")
+	p.set("endpointPlaintext", c.endpointPlaintext, SourceDefault, "")
+	p.set("endpointKeepaliveTime", c.endpointKeepaliveTime, SourceDefault, "")
+	p.set("endpointKeepaliveTimeout", c.endpointKeepaliveTimeout, SourceDefault, "")
+	p.set("googetRepoFilePath", c.googetRepoFilePath, SourceDefault, "")
+	p.set("zypperRepoFilePath", c.zypperRepoFilePath, SourceDefault, "")
+	p.set("yumRepoFilePath", c.yumRepoFilePath, SourceDefault, "")
+	p.set("aptRepoFilePath", c.aptRepoFilePath, SourceDefault, "")
+	p.set("metadataDisabled", c.metadataDisabled, SourceDefault, "")
+	p.set("rootDir", c.rootDir, SourceDefault, "")
+	p.set("projectId", c.projectID, SourceDefault, "")
+	p.set("numericProjectId", c.numericProjectID, SourceDefault, "")
+	p.set("zone", c.instanceZone, SourceDefault, "")
+	p.set("instanceName", c.instanceName, SourceDefault, "")
+	p.set("instanceId", c.instanceID, SourceDefault, "")
+}
+
+// Explain fetches metadata once, without waiting for changes, and returns the
+// config the agent would run with along with where each setting came from.
+func Explain() (*Explanation, error) {
+	p := newProvenance()
+
+	lc, err := readLocalConfig(LocalConfigFile())
+	if err != nil {
+		p.ignore(SourceLocalConfigFile, LocalConfigFile(), "", fmt.Sprintf("error reading file, ignoring it: %v", err))
+	}
+
+	var md metadataJSON
+	if !lc.metadataDisabled() {
+		d, _, err := getMetadata("?recursive=true&alt=json")
+		if err != nil {
+			return nil, formatMetadataError(err)
+		}
+		if err := json.Unmarshal(d, &md); err != nil {
+			return nil, err
+		}
+	}
+
+	createConfigFromMetadata(md, lc, p)
+	return &p.e, nil
+}
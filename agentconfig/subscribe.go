@@ -0,0 +1,178 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentconfig
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+)
+
+var (
+	subscribers   = map[chan ConfigChange]struct{}{}
+	subscribersMx sync.Mutex
+)
+
+// Config is a read only snapshot of the agent config.
+type Config struct {
+	c config
+}
+
+// Current returns a snapshot of the current agent config.
+func Current() Config {
+	return Config{getAgentConfig()}
+}
+
+// ConfigChange holds the agent config before and after WatchConfig updates
+// it.
+type ConfigChange struct {
+	Old, New Config
+}
+
+// Subscribe returns a channel that receives a ConfigChange each time
+// WatchConfig updates the agent config, and a function to unsubscribe which
+// closes the channel.
+// Only one change is ever queued per subscriber, if a subscriber falls behind
+// pending changes are merged so that New is always the latest config.
+func Subscribe() (<-chan ConfigChange, func()) {
+	ch := make(chan ConfigChange, 1)
+	subscribersMx.Lock()
+	subscribers[ch] = struct{}{}
+	subscribersMx.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			subscribersMx.Lock()
+			delete(subscribers, ch)
+			close(ch)
+			subscribersMx.Unlock()
+		})
+	}
+}
+
+func notifySubscribers(change ConfigChange) {
+	subscribersMx.Lock()
+	defer subscribersMx.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- change:
+		default:
+			// Merge with the queued change, we are the only sender so the
+			// send below can not block.
+			merged := change
+			select {
+			case pending := <-ch:
+				merged.Old = pending.Old
+			default:
+			}
+			ch <- merged
+		}
+	}
+}
+
+// OSInventoryEnabled indicates whether OSInventory should be enabled.
+func (c Config) OSInventoryEnabled() bool {
+	return c.c.osInventoryEnabled
+}
+
+// GuestPoliciesEnabled indicates whether GuestPolicies should be enabled.
+func (c Config) GuestPoliciesEnabled() bool {
+	return c.c.guestPoliciesEnabled
+}
+
+// TaskNotificationEnabled indicates whether TaskNotification should be enabled.
+func (c Config) TaskNotificationEnabled() bool {
+	return c.c.taskNotificationEnabled
+}
+
+// InventoryReportingEnabled indicates whether InventoryReporting should be enabled.
+func (c Config) InventoryReportingEnabled() bool {
+	return c.c.inventoryReportingEnabled
+}
+
+// MetadataDisabled indicates whether the agent is running without a metadata
+// server.
+func (c Config) MetadataDisabled() bool {
+	return c.c.metadataDisabled
+}
+
+// Debug reports whether the log level is debug.
+func (c Config) Debug() bool {
+	return c.c.logLevel == clog.LevelDebug
+}
+
+// LogLevel is the log level for components without an override.
+func (c Config) LogLevel() clog.Level {
+	return c.c.logLevel
+}
+
+// ComponentLogLevels are the per-component log level overrides.
+func (c Config) ComponentLogLevels() map[string]clog.Level {
+	return c.c.copyComponentLogLevels()
+}
+
+// SvcEndpoint is the OS Config service endpoint.
+func (c Config) SvcEndpoint() string {
+	return c.c.svcEndpoint
+}
+
+// SvcPollInterval returns the frequency to poll the service.
+func (c Config) SvcPollInterval() time.Duration {
+	return time.Duration(c.c.osConfigPollInterval) * time.Minute
+}
+
+// InventoryInterval is how often inventory is collected.
+func (c Config) InventoryInterval() time.Duration {
+	return c.c.interval(c.c.inventoryInterval)
+}
+
+// GuestPoliciesInterval is how often guest policies are checked.
+func (c Config) GuestPoliciesInterval() time.Duration {
+	return c.c.interval(c.c.guestPoliciesInterval)
+}
+
+// RegisterAgentInterval is how often RegisterAgent is called.
+func (c Config) RegisterAgentInterval() time.Duration {
+	return c.c.interval(c.c.registerAgentInterval)
+}
+
+// InventorySplay is the maximum random delay added to each inventory run.
+func (c Config) InventorySplay() time.Duration {
+	return time.Duration(c.c.inventorySplay) * time.Minute
+}
+
+// GuestPoliciesSplay is the maximum random delay added to each guest policies
+// run.
+func (c Config) GuestPoliciesSplay() time.Duration {
+	return time.Duration(c.c.guestPoliciesSplay) * time.Minute
+}
+
+// RegisterAgentSplay is the maximum random delay added to each RegisterAgent
+// call.
+func (c Config) RegisterAgentSplay() time.Duration {
+	return time.Duration(c.c.registerAgentSplay) * time.Minute
+}
+
+// Proxy is the proxy URL used for all outbound connections.
+func (c Config) Proxy() string {
+	return c.c.proxy
+}
+
+// NoProxy is a comma separated list of hosts that bypass Proxy.
+func (c Config) NoProxy() string {
+	return c.c.noProxy
+}
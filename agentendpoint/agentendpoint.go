@@ -30,13 +30,13 @@ import (
 	agentendpoint "cloud.google.com/go/osconfig/agentendpoint/apiv1"
 	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/external"
 	"github.com/GoogleCloudPlatform/osconfig/retryutil"
 	"github.com/GoogleCloudPlatform/osconfig/tasker"
 	"github.com/GoogleCloudPlatform/osconfig/util"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
@@ -49,43 +49,80 @@ var (
 	errServerCancel      = errors.New("task canceled by server")
 	errServiceNotEnabled = errors.New("service is not enabled for this project")
 	errResourceExhausted = errors.New("ResourceExhausted")
-	taskStateFile        = agentconfig.TaskStateFile()
-	sameStateTimeWindow  = -5 * time.Second
+	// taskStateFile overrides agentconfig.TaskStateFile when set.
+	taskStateFile       string
+	sameStateTimeWindow = -5 * time.Second
 )
 
 // Client is a an agentendpoint client.
 type Client struct {
-	raw    *agentendpoint.Client
+	raw *agentendpoint.Client
+	// conn is the shared connection raw uses, if any.
+	conn   *sharedConn
 	cancel context.CancelFunc
 	noti   chan struct{}
 	closed bool
 	mx     sync.Mutex
 }
 
-// NewClient a new agentendpoint Client.
-func NewClient(ctx context.Context) (*Client, error) {
+// clientOptions are the options shared by the agentendpoint clients, they use
+// the configured proxy, CA bundle, client certificate and keepalive.
+func clientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	creds, err := transportCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
 	opts := []option.ClientOption{
-		option.WithoutAuthentication(), // Do not use oauth.
-		option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(nil))), // Because we disabled Auth we need to specifically enable TLS.
+		option.WithoutAuthentication(),   // Do not use oauth.
+		option.WithGRPCDialOption(creds), // Because we disabled Auth we need to specifically set transport security.
+		option.WithGRPCDialOption(grpc.WithContextDialer(external.DialContext)),
 		option.WithEndpoint(agentconfig.SvcEndpoint()),
 	}
+	if ka, ok := keepaliveParams(); ok {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithKeepaliveParams(ka)))
+	}
+	return opts, nil
+}
+
+// NewClient a new agentendpoint Client on the connection shared by all
+// clients. With opts the client has its own connection and opts are added to
+// the default options, for example to connect to an
+// agentendpointtest.Server.
+func NewClient(ctx context.Context, opts ...option.ClientOption) (*Client, error) {
+	opts, sc, err := connOptions(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 	clog.Debugf(ctx, "Creating new agentendpoint client.")
 	c, err := agentendpoint.NewClient(ctx, opts...)
 	if err != nil {
+		if sc != nil {
+			conns.release(sc)
+		}
 		return nil, err
 	}
 
-	return &Client{raw: c, noti: make(chan struct{}, 1)}, nil
+	return &Client{raw: c, conn: sc, noti: make(chan struct{}, 1)}, nil
 }
 
-// Close cancels WaitForTaskNotification and closes the underlying ClientConn.
+// Close cancels WaitForTaskNotification and closes the underlying ClientConn,
+// or releases it if it is shared.
 func (c *Client) Close() error {
 	// Lock so nothing can use the client while we are closing.
 	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		// A shared connection must only be released once.
+		return nil
+	}
 	if c.cancel != nil {
 		c.cancel()
 	}
 	c.closed = true
+	if c.conn != nil {
+		// Closing raw would close the connection for every client sharing it.
+		return conns.release(c.conn)
+	}
 	return c.raw.Close()
 }
 
@@ -101,12 +138,16 @@ func (c *Client) RegisterAgent(ctx context.Context) error {
 		return err
 	}
 
-	req := &agentendpointpb.RegisterAgentRequest{AgentVersion: agentconfig.Version(), SupportedCapabilities: agentconfig.Capabilities()}
+	caps := Capabilities(ctx)
+	req := &agentendpointpb.RegisterAgentRequest{AgentVersion: agentconfig.Version(), SupportedCapabilities: caps}
 	clog.Debugf(ctx, "Calling RegisterAgent with request:\n%s", util.PrettyFmt(req))
 	req.InstanceIdToken = token
 
-	_, err = c.raw.RegisterAgent(ctx, req)
-	return err
+	if _, err := c.raw.RegisterAgent(ctx, req); err != nil {
+		return err
+	}
+	setRegisteredCapabilities(caps)
+	return nil
 }
 
 // reportInventory calls ReportInventory with the provided inventory.
@@ -116,14 +157,10 @@ func (c *Client) reportInventory(ctx context.Context, inventory *agentendpointpb
 		return nil, err
 	}
 
-	hash := sha256.New()
-	b, err := proto.Marshal(inventory)
+	checksum, err := inventoryChecksum(inventory)
 	if err != nil {
 		return nil, err
 	}
-	io.Copy(hash, bytes.NewReader(b))
-
-	checksum := hex.EncodeToString(hash.Sum(nil))
 	req := &agentendpointpb.ReportInventoryRequest{InstanceIdToken: token, InventoryChecksum: checksum}
 	if reportFull {
 		req = &agentendpointpb.ReportInventoryRequest{InstanceIdToken: token, InventoryChecksum: checksum, Inventory: inventory}
@@ -133,6 +170,16 @@ func (c *Client) reportInventory(ctx context.Context, inventory *agentendpointpb
 	return c.raw.ReportInventory(ctx, req)
 }
 
+func inventoryChecksum(inventory *agentendpointpb.Inventory) (string, error) {
+	hash := sha256.New()
+	b, err := proto.Marshal(inventory)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(hash, bytes.NewReader(b))
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func (c *Client) startNextTask(ctx context.Context) (res *agentendpointpb.StartNextTaskResponse, err error) {
 	token, err := agentconfig.IDToken()
 	if err != nil {
@@ -180,10 +227,12 @@ func (c *Client) reportTaskProgress(ctx context.Context, req *agentendpointpb.Re
 	return res, nil
 }
 
+// reportTaskComplete calls ReportTaskComplete, if that still fails after
+// retrying the request is queued in the outbox to be sent later.
 func (c *Client) reportTaskComplete(ctx context.Context, req *agentendpointpb.ReportTaskCompleteRequest) error {
 	token, err := agentconfig.IDToken()
 	if err != nil {
-		return err
+		return queueFailedReport(ctx, outboxComplete, req.GetTaskId(), req, err)
 	}
 
 	clog.Debugf(ctx, "Calling ReportTaskComplete with request:\n%s", util.PrettyFmt(req))
@@ -197,7 +246,7 @@ func (c *Client) reportTaskComplete(ctx context.Context, req *agentendpointpb.Re
 		clog.Debugf(ctx, "ReportTaskComplete response:\n%s", util.PrettyFmt(res))
 		return nil
 	}); err != nil {
-		return fmt.Errorf("error calling ReportTaskComplete: %w", err)
+		return queueFailedReport(ctx, outboxComplete, req.GetTaskId(), req, fmt.Errorf("error calling ReportTaskComplete: %w", err))
 	}
 
 	return nil
@@ -219,17 +268,8 @@ func (c *Client) runTask(ctx context.Context) {
 		}
 
 		clog.Debugf(ctx, "Received task: %s.", task.GetTaskType())
-		switch task.GetTaskType() {
-		case agentendpointpb.TaskType_APPLY_PATCHES:
-			if err := c.RunApplyPatches(ctx, task); err != nil {
-				clog.Errorf(ctx, "Error running TaskType_APPLY_PATCHES: %v", err)
-			}
-		case agentendpointpb.TaskType_EXEC_STEP_TASK:
-			if err := c.RunExecStep(ctx, task); err != nil {
-				clog.Errorf(ctx, "Error running TaskType_EXEC_STEP_TASK: %v", err)
-			}
-		default:
-			clog.Errorf(ctx, "Unknown task type: %v", task.GetTaskType())
+		if err := c.startTask(ctx, task.GetTaskType(), task); err != nil {
+			clog.Errorf(ctx, "Error running %v task: %v", task.GetTaskType(), err)
 		}
 	}
 }
@@ -288,14 +328,22 @@ func (c *Client) receiveTaskNotification(ctx context.Context) (agentendpointpb.A
 }
 
 func (c *Client) loadTaskFromState(ctx context.Context) error {
-	st, err := loadState(taskStateFile)
+	st, err := loadState(stateFile())
 	if err != nil {
 		return fmt.Errorf("loadState error: %w", err)
 	}
-	if st != nil && st.PatchTask != nil {
-		st.PatchTask.client = c
-		tasker.Enqueue(ctx, "PatchRun", func() {
-			st.PatchTask.run(ctx)
+	if st == nil {
+		return nil
+	}
+	saved, err := st.savedTask()
+	if err != nil {
+		return fmt.Errorf("error reading saved task: %w", err)
+	}
+	if saved != nil {
+		tasker.Enqueue(ctx, "ResumeTask", func() {
+			if err := c.resumeTask(ctx, saved); err != nil {
+				clog.Errorf(ctx, "Error resuming %v task: %v", saved.TaskType, err)
+			}
 		})
 	}
 
@@ -335,13 +383,18 @@ func (c *Client) waitForTask(ctx context.Context) error {
 func (c *Client) WaitForTaskNotification(ctx context.Context) {
 	c.mx.Lock()
 	defer c.mx.Unlock()
-	if c.cancel != nil {
-		// WaitForTaskNotification is already running on this client.
+	if c.cancel != nil || c.closed {
+		// WaitForTaskNotification is already running on this client, or
+		// the client is closed.
 		return
 	}
 	clog.Debugf(ctx, "Running WaitForTaskNotification")
 	ctx, c.cancel = context.WithCancel(ctx)
 
+	// Send reports left over from before a restart ahead of resuming any
+	// task.
+	c.replayOutbox(ctx)
+
 	clog.Debugf(ctx, "Checking local state file for saved task.")
 	if err := c.loadTaskFromState(ctx); err != nil {
 		clog.Errorf(ctx, err.Error())
@@ -359,6 +412,8 @@ func (c *Client) WaitForTaskNotification(ctx context.Context) {
 			default:
 			}
 
+			// Reports queued while the connection was down can be sent now.
+			c.replayOutbox(ctx)
 			if err := c.waitForTask(ctx); err != nil {
 				if errors.Is(err, errServiceNotEnabled) {
 					// Service is disabled, close this client and return.
@@ -27,45 +27,60 @@ import (
 	"github.com/GoogleCloudPlatform/osconfig/retryutil"
 	"github.com/GoogleCloudPlatform/osconfig/util"
 	"google.golang.org/api/option"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 
 	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1beta"
 )
 
 // BetaClient is a an agentendpoint client.
 type BetaClient struct {
-	raw    *agentendpoint.Client
+	raw *agentendpoint.Client
+	// conn is the shared connection raw uses, if any.
+	conn   *sharedConn
 	cancel context.CancelFunc
 	noti   chan struct{}
 	closed bool
 	mx     sync.Mutex
 }
 
-// NewBetaClient a new agentendpoint Client.
-func NewBetaClient(ctx context.Context) (*BetaClient, error) {
-	opts := []option.ClientOption{
-		option.WithoutAuthentication(), // Do not use oauth.
-		option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(nil))), // Because we disabled Auth we need to specifically enable TLS.
-		option.WithEndpoint(agentconfig.SvcEndpoint()),
+// NewBetaClient a new agentendpoint Client on the connection shared by all
+// clients. With opts the client has its own connection and opts are added to
+// the default options, for example to connect to an
+// agentendpointtest.Server.
+func NewBetaClient(ctx context.Context, opts ...option.ClientOption) (*BetaClient, error) {
+	opts, sc, err := connOptions(ctx, opts)
+	if err != nil {
+		return nil, err
 	}
 	clog.Debugf(ctx, "Creating new agentendpoint beta client.")
 	c, err := agentendpoint.NewClient(ctx, opts...)
 	if err != nil {
+		if sc != nil {
+			conns.release(sc)
+		}
 		return nil, err
 	}
 
-	return &BetaClient{raw: c, noti: make(chan struct{}, 1)}, nil
+	return &BetaClient{raw: c, conn: sc, noti: make(chan struct{}, 1)}, nil
 }
 
-// Close cancels WaitForTaskNotification and closes the underlying ClientConn.
+// Close cancels WaitForTaskNotification and closes the underlying ClientConn,
+// or releases it if it is shared.
 func (c *BetaClient) Close() error {
 	// Lock so nothing can use the client while we are closing.
 	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		// A shared connection must only be released once.
+		return nil
+	}
 	if c.cancel != nil {
 		c.cancel()
 	}
 	c.closed = true
+	if c.conn != nil {
+		// Closing raw would close the connection for every client sharing it.
+		return conns.release(c.conn)
+	}
 	return c.raw.Close()
 }
 
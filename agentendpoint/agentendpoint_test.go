@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -34,6 +35,7 @@ import (
 
 	agentendpoint "cloud.google.com/go/osconfig/agentendpoint/apiv1"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/osconfig/agentendpoint/agentendpointtest"
 	"golang.org/x/oauth2/jws"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
@@ -340,3 +342,62 @@ func TestLoadPatchTaskFromState(t *testing.T) {
 		t.Errorf("first entry in runTaskIDs does not match taskID, %q, %q", srv.runTaskIDs, taskID)
 	}
 }
+
+func TestNewClientFakeServer(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	execOutputDir = td
+	taskStateFile = filepath.Join(td, "testState")
+	goos = "linux"
+	execHeartbeatInterval = time.Millisecond
+	defer func() {
+		execOutputDir = ""
+		execHeartbeatInterval = 30 * time.Second
+	}()
+	run = func(ctx context.Context, cmd *exec.Cmd) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	srv := agentendpointtest.NewServer()
+	defer srv.Close()
+	opts, err := srv.ClientOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.RegisterAgent(ctx); err != nil {
+		t.Fatalf("RegisterAgent: %v", err)
+	}
+	if got := len(srv.Requests(agentendpointtest.RegisterAgent)); got != 1 {
+		t.Errorf("got %d RegisterAgent calls, want 1", got)
+	}
+
+	// The first heartbeat continues, the second stops the task.
+	srv.QueueDirectives(agentendpointpb.TaskDirective_CONTINUE, agentendpointpb.TaskDirective_STOP)
+	step := &agentendpointpb.ExecStep{LinuxExecStepConfig: &agentendpointpb.ExecStepConfig{Executable: &agentendpointpb.ExecStepConfig_LocalPath{LocalPath: "foo"}}}
+	task := &agentendpointpb.Task{TaskId: "foo", TaskDetails: &agentendpointpb.Task_ExecStepTask{ExecStepTask: &agentendpointpb.ExecStepTask{ExecStep: step}}}
+	if err := client.RunExecStep(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := srv.CompleteReports()
+	if len(reports) != 1 {
+		t.Fatalf("got %d ReportTaskComplete calls, want 1", len(reports))
+	}
+	if got := reports[0].GetExecStepTaskOutput().GetState(); got != agentendpointpb.ExecStepTaskOutput_CANCELLED {
+		t.Errorf("exec task state: got %s, want %s", got, agentendpointpb.ExecStepTaskOutput_CANCELLED)
+	}
+	if got := len(srv.ProgressReports()); got < 2 {
+		t.Errorf("got %d ReportTaskProgress calls, want at least 2", got)
+	}
+}
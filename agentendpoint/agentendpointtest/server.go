@@ -0,0 +1,431 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package agentendpointtest provides an in-process fake of the agentendpoint
+// service for tests.
+//
+// A Server serves the v1 and v1beta AgentEndpointService over an in-memory
+// listener. Tests queue tasks, push task notifications, script the
+// directives and errors the service returns and inspect every request the
+// agent made:
+//
+//	srv := agentendpointtest.NewServer()
+//	defer srv.Close()
+//	opts, err := srv.ClientOptions(ctx)
+//	...
+//	client, err := agentendpoint.NewClient(ctx, opts...)
+package agentendpointtest
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+	agentendpointbetapb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1beta"
+)
+
+// Method names, used to script errors and look up requests. They are the
+// same for v1 and v1beta.
+const (
+	ReceiveTaskNotification    = "ReceiveTaskNotification"
+	StartNextTask              = "StartNextTask"
+	ReportTaskProgress         = "ReportTaskProgress"
+	ReportTaskComplete         = "ReportTaskComplete"
+	RegisterAgent              = "RegisterAgent"
+	ReportInventory            = "ReportInventory"
+	LookupEffectiveGuestPolicy = "LookupEffectiveGuestPolicy"
+)
+
+const bufSize = 1024 * 1024
+
+// Call is a request made to the Server.
+type Call struct {
+	Method string
+	// Beta is set for calls to the v1beta service.
+	Beta    bool
+	Request proto.Message
+}
+
+// Server is a fake AgentEndpointService. It is safe for concurrent use.
+type Server struct {
+	lis *bufconn.Listener
+	s   *grpc.Server
+
+	mu         sync.Mutex
+	tasks      []*agentendpointpb.Task
+	betaTasks  []*agentendpointbetapb.Task
+	directives []agentendpointpb.TaskDirective
+	errs       map[string][]error
+	calls      []Call
+	policy     *agentendpointbetapb.EffectiveGuestPolicy
+	fullInv    bool
+	// streams are the open ReceiveTaskNotification streams, a notification
+	// pushed while there are none is delivered to the next one opened.
+	streams       map[*stream]bool
+	pendingNotify bool
+}
+
+type stream struct {
+	notify chan struct{}
+	end    chan error
+}
+
+// NewServer starts a Server, call Close to stop it.
+func NewServer() *Server {
+	srv := &Server{
+		lis:     bufconn.Listen(bufSize),
+		s:       grpc.NewServer(),
+		errs:    map[string][]error{},
+		streams: map[*stream]bool{},
+	}
+	agentendpointpb.RegisterAgentEndpointServiceServer(srv.s, &v1Server{srv})
+	agentendpointbetapb.RegisterAgentEndpointServiceServer(srv.s, &betaServer{srv})
+	go srv.s.Serve(srv.lis)
+	return srv
+}
+
+// Close ends any open streams and stops the Server.
+func (s *Server) Close() {
+	s.EndStreams(nil)
+	s.s.Stop()
+}
+
+// Dial returns a connection to the Server, any opts are added to the ones
+// needed to reach it.
+func (s *Server) Dial(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return s.lis.Dial()
+	}
+	opts = append([]grpc.DialOption{grpc.WithContextDialer(dialer), grpc.WithInsecure()}, opts...)
+	return grpc.DialContext(ctx, "bufnet", opts...)
+}
+
+// ClientOptions returns the options for an agentendpoint client to use the
+// Server, closing the client closes the connection.
+func (s *Server) ClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	conn, err := s.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithGRPCConn(conn)}, nil
+}
+
+// QueueTask adds a task for StartNextTask to return, tasks are returned in
+// the order they are queued. Once the queue is empty StartNextTask returns
+// no task.
+func (s *Server) QueueTask(t *agentendpointpb.Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, t)
+}
+
+// QueueBetaTask is QueueTask for the v1beta service.
+func (s *Server) QueueBetaTask(t *agentendpointbetapb.Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.betaTasks = append(s.betaTasks, t)
+}
+
+// Notify sends a task notification on every open ReceiveTaskNotification
+// stream.
+func (s *Server) Notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.streams) == 0 {
+		s.pendingNotify = true
+		return
+	}
+	for st := range s.streams {
+		select {
+		case st.notify <- struct{}{}:
+		default:
+			// A notification is already waiting to be sent.
+		}
+	}
+}
+
+// EndStreams ends every open ReceiveTaskNotification stream with err.
+func (s *Server) EndStreams(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st := range s.streams {
+		st.end <- err
+		delete(s.streams, st)
+	}
+}
+
+// QueueDirectives adds directives for ReportTaskProgress to return, in
+// order. Once the queue is empty it returns CONTINUE.
+func (s *Server) QueueDirectives(d ...agentendpointpb.TaskDirective) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.directives = append(s.directives, d...)
+}
+
+// QueueErrors adds errors for the next calls to method to return, in order,
+// use a status error to set the code. The calls are still recorded.
+func (s *Server) QueueErrors(method string, errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs[method] = append(s.errs[method], errs...)
+}
+
+// SetEffectiveGuestPolicy sets the policy LookupEffectiveGuestPolicy
+// returns.
+func (s *Server) SetEffectiveGuestPolicy(p *agentendpointbetapb.EffectiveGuestPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = p
+}
+
+// SetReportFullInventory sets ReportFullInventory in ReportInventory
+// responses.
+func (s *Server) SetReportFullInventory(full bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fullInv = full
+}
+
+// Calls returns every request made to the Server, in order.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Requests returns the requests made to method of the v1 service, in
+// order.
+func (s *Server) Requests(method string) []proto.Message {
+	var reqs []proto.Message
+	for _, c := range s.Calls() {
+		if c.Method == method && !c.Beta {
+			reqs = append(reqs, c.Request)
+		}
+	}
+	return reqs
+}
+
+// ProgressReports returns the v1 ReportTaskProgress requests, in order.
+func (s *Server) ProgressReports() []*agentendpointpb.ReportTaskProgressRequest {
+	var reqs []*agentendpointpb.ReportTaskProgressRequest
+	for _, r := range s.Requests(ReportTaskProgress) {
+		reqs = append(reqs, r.(*agentendpointpb.ReportTaskProgressRequest))
+	}
+	return reqs
+}
+
+// CompleteReports returns the v1 ReportTaskComplete requests, in order.
+func (s *Server) CompleteReports() []*agentendpointpb.ReportTaskCompleteRequest {
+	var reqs []*agentendpointpb.ReportTaskCompleteRequest
+	for _, r := range s.Requests(ReportTaskComplete) {
+		reqs = append(reqs, r.(*agentendpointpb.ReportTaskCompleteRequest))
+	}
+	return reqs
+}
+
+// InventoryReports returns the ReportInventory requests, in order.
+func (s *Server) InventoryReports() []*agentendpointpb.ReportInventoryRequest {
+	var reqs []*agentendpointpb.ReportInventoryRequest
+	for _, r := range s.Requests(ReportInventory) {
+		reqs = append(reqs, r.(*agentendpointpb.ReportInventoryRequest))
+	}
+	return reqs
+}
+
+// call records a request and returns the next scripted error for method.
+func (s *Server) call(method string, beta bool, req proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{Method: method, Beta: beta, Request: proto.Clone(req)})
+	errs := s.errs[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	s.errs[method] = errs[1:]
+	return errs[0]
+}
+
+func (s *Server) nextDirective() agentendpointpb.TaskDirective {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.directives) == 0 {
+		return agentendpointpb.TaskDirective_CONTINUE
+	}
+	d := s.directives[0]
+	s.directives = s.directives[1:]
+	return d
+}
+
+// openStream registers a ReceiveTaskNotification stream.
+func (s *Server) openStream() *stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &stream{notify: make(chan struct{}, 1), end: make(chan error, 1)}
+	if s.pendingNotify {
+		st.notify <- struct{}{}
+		s.pendingNotify = false
+	}
+	s.streams[st] = true
+	return st
+}
+
+func (s *Server) closeStream(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, st)
+}
+
+// serveStream sends notifications on a stream until it ends.
+func (s *Server) serveStream(ctx context.Context, send func() error) error {
+	st := s.openStream()
+	defer s.closeStream(st)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-st.end:
+			return err
+		case <-st.notify:
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// v1Server implements the v1 service.
+type v1Server struct {
+	*Server
+}
+
+func (s *v1Server) ReceiveTaskNotification(req *agentendpointpb.ReceiveTaskNotificationRequest, srv agentendpointpb.AgentEndpointService_ReceiveTaskNotificationServer) error {
+	if err := s.call(ReceiveTaskNotification, false, req); err != nil {
+		return err
+	}
+	return s.serveStream(srv.Context(), func() error {
+		return srv.Send(&agentendpointpb.ReceiveTaskNotificationResponse{})
+	})
+}
+
+func (s *v1Server) StartNextTask(ctx context.Context, req *agentendpointpb.StartNextTaskRequest) (*agentendpointpb.StartNextTaskResponse, error) {
+	if err := s.call(StartNextTask, false, req); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tasks) == 0 {
+		return &agentendpointpb.StartNextTaskResponse{}, nil
+	}
+	t := s.tasks[0]
+	s.tasks = s.tasks[1:]
+	return &agentendpointpb.StartNextTaskResponse{Task: t}, nil
+}
+
+func (s *v1Server) ReportTaskProgress(ctx context.Context, req *agentendpointpb.ReportTaskProgressRequest) (*agentendpointpb.ReportTaskProgressResponse, error) {
+	if err := s.call(ReportTaskProgress, false, req); err != nil {
+		return nil, err
+	}
+	return &agentendpointpb.ReportTaskProgressResponse{TaskDirective: s.nextDirective()}, nil
+}
+
+func (s *v1Server) ReportTaskComplete(ctx context.Context, req *agentendpointpb.ReportTaskCompleteRequest) (*agentendpointpb.ReportTaskCompleteResponse, error) {
+	if err := s.call(ReportTaskComplete, false, req); err != nil {
+		return nil, err
+	}
+	return &agentendpointpb.ReportTaskCompleteResponse{}, nil
+}
+
+func (s *v1Server) RegisterAgent(ctx context.Context, req *agentendpointpb.RegisterAgentRequest) (*agentendpointpb.RegisterAgentResponse, error) {
+	if err := s.call(RegisterAgent, false, req); err != nil {
+		return nil, err
+	}
+	return &agentendpointpb.RegisterAgentResponse{}, nil
+}
+
+func (s *v1Server) ReportInventory(ctx context.Context, req *agentendpointpb.ReportInventoryRequest) (*agentendpointpb.ReportInventoryResponse, error) {
+	if err := s.call(ReportInventory, false, req); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &agentendpointpb.ReportInventoryResponse{ReportFullInventory: s.fullInv}, nil
+}
+
+// betaServer implements the v1beta service, directives are shared with the
+// v1 service.
+type betaServer struct {
+	*Server
+}
+
+func (s *betaServer) ReceiveTaskNotification(req *agentendpointbetapb.ReceiveTaskNotificationRequest, srv agentendpointbetapb.AgentEndpointService_ReceiveTaskNotificationServer) error {
+	if err := s.call(ReceiveTaskNotification, true, req); err != nil {
+		return err
+	}
+	return s.serveStream(srv.Context(), func() error {
+		return srv.Send(&agentendpointbetapb.ReceiveTaskNotificationResponse{})
+	})
+}
+
+func (s *betaServer) StartNextTask(ctx context.Context, req *agentendpointbetapb.StartNextTaskRequest) (*agentendpointbetapb.StartNextTaskResponse, error) {
+	if err := s.call(StartNextTask, true, req); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.betaTasks) == 0 {
+		return &agentendpointbetapb.StartNextTaskResponse{}, nil
+	}
+	t := s.betaTasks[0]
+	s.betaTasks = s.betaTasks[1:]
+	return &agentendpointbetapb.StartNextTaskResponse{Task: t}, nil
+}
+
+func (s *betaServer) ReportTaskProgress(ctx context.Context, req *agentendpointbetapb.ReportTaskProgressRequest) (*agentendpointbetapb.ReportTaskProgressResponse, error) {
+	if err := s.call(ReportTaskProgress, true, req); err != nil {
+		return nil, err
+	}
+	return &agentendpointbetapb.ReportTaskProgressResponse{TaskDirective: agentendpointbetapb.TaskDirective(s.nextDirective())}, nil
+}
+
+func (s *betaServer) ReportTaskComplete(ctx context.Context, req *agentendpointbetapb.ReportTaskCompleteRequest) (*agentendpointbetapb.ReportTaskCompleteResponse, error) {
+	if err := s.call(ReportTaskComplete, true, req); err != nil {
+		return nil, err
+	}
+	return &agentendpointbetapb.ReportTaskCompleteResponse{}, nil
+}
+
+func (s *betaServer) LookupEffectiveGuestPolicy(ctx context.Context, req *agentendpointbetapb.LookupEffectiveGuestPolicyRequest) (*agentendpointbetapb.EffectiveGuestPolicy, error) {
+	if err := s.call(LookupEffectiveGuestPolicy, true, req); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy == nil {
+		return &agentendpointbetapb.EffectiveGuestPolicy{}, nil
+	}
+	return s.policy, nil
+}
+
+func (s *betaServer) RegisterAgent(ctx context.Context, req *agentendpointbetapb.RegisterAgentRequest) (*agentendpointbetapb.RegisterAgentResponse, error) {
+	if err := s.call(RegisterAgent, true, req); err != nil {
+		return nil, err
+	}
+	return &agentendpointbetapb.RegisterAgentResponse{}, nil
+}
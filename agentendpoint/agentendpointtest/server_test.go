@@ -0,0 +1,140 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpointtest
+
+import (
+	"context"
+	"testing"
+
+	agentendpoint "cloud.google.com/go/osconfig/agentendpoint/apiv1"
+	agentendpointbeta "cloud.google.com/go/osconfig/agentendpoint/apiv1beta"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+	agentendpointbetapb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1beta"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer()
+	defer srv.Close()
+	opts, err := srv.ClientOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := agentendpoint.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A notification pushed before the stream opens is not lost.
+	srv.Notify()
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ReceiveTaskNotification(sctx, &agentendpointpb.ReceiveTaskNotificationRequest{InstanceIdToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("stream.Recv: %v", err)
+	}
+
+	task := &agentendpointpb.Task{TaskId: "foo", TaskType: agentendpointpb.TaskType_APPLY_PATCHES}
+	srv.QueueTask(task)
+	srv.QueueErrors(StartNextTask, status.Error(codes.PermissionDenied, "not yet"))
+
+	if _, err := client.StartNextTask(ctx, &agentendpointpb.StartNextTaskRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("first StartNextTask: got %v, want code %s", err, codes.PermissionDenied)
+	}
+	res, err := client.StartNextTask(ctx, &agentendpointpb.StartNextTaskRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(task, res.GetTask(), protocmp.Transform()); diff != "" {
+		t.Errorf("StartNextTask task mismatch (-want +got):\n%s", diff)
+	}
+	if res, err := client.StartNextTask(ctx, &agentendpointpb.StartNextTaskRequest{}); err != nil || res.GetTask() != nil {
+		t.Errorf("StartNextTask with no tasks: got %v %v, want no task", res.GetTask(), err)
+	}
+
+	srv.QueueDirectives(agentendpointpb.TaskDirective_STOP)
+	for _, want := range []agentendpointpb.TaskDirective{agentendpointpb.TaskDirective_STOP, agentendpointpb.TaskDirective_CONTINUE} {
+		res, err := client.ReportTaskProgress(ctx, &agentendpointpb.ReportTaskProgressRequest{TaskId: "foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetTaskDirective() != want {
+			t.Errorf("ReportTaskProgress: got directive %s, want %s", res.GetTaskDirective(), want)
+		}
+	}
+	complete := &agentendpointpb.ReportTaskCompleteRequest{TaskId: "foo", ErrorMessage: "failed"}
+	if _, err := client.ReportTaskComplete(ctx, complete); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(srv.ProgressReports()); got != 2 {
+		t.Errorf("got %d progress reports, want 2", got)
+	}
+	if diff := cmp.Diff([]*agentendpointpb.ReportTaskCompleteRequest{complete}, srv.CompleteReports(), protocmp.Transform()); diff != "" {
+		t.Errorf("CompleteReports mismatch (-want +got):\n%s", diff)
+	}
+	if got := len(srv.Requests(StartNextTask)); got != 3 {
+		t.Errorf("got %d StartNextTask calls, want 3 including the failed one", got)
+	}
+
+	srv.EndStreams(status.Error(codes.PermissionDenied, ""))
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("stream.Recv after EndStreams: got %v, want code %s", err, codes.PermissionDenied)
+	}
+}
+
+func TestServerBeta(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer()
+	defer srv.Close()
+	opts, err := srv.ClientOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := agentendpointbeta.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	policy := &agentendpointbetapb.EffectiveGuestPolicy{
+		Packages: []*agentendpointbetapb.EffectiveGuestPolicy_SourcedPackage{{Source: "policy", Package: &agentendpointbetapb.Package{Name: "foo"}}},
+	}
+	srv.SetEffectiveGuestPolicy(policy)
+	got, err := client.LookupEffectiveGuestPolicy(ctx, &agentendpointbetapb.LookupEffectiveGuestPolicyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(policy, got, protocmp.Transform()); diff != "" {
+		t.Errorf("LookupEffectiveGuestPolicy mismatch (-want +got):\n%s", diff)
+	}
+
+	calls := srv.Calls()
+	if len(calls) != 1 || calls[0].Method != LookupEffectiveGuestPolicy || !calls[0].Beta {
+		t.Errorf("got calls %+v, want one beta LookupEffectiveGuestPolicy", calls)
+	}
+	if got := srv.Requests(LookupEffectiveGuestPolicy); len(got) != 0 {
+		t.Errorf("Requests returned beta calls: %v", got)
+	}
+}
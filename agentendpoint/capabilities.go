@@ -0,0 +1,119 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/osinfo"
+	"github.com/GoogleCloudPlatform/osconfig/packages"
+)
+
+// Capabilities are matched server side to what tasks this agent can perform.
+// Only capabilities the service defines are sent, what the agent detects on
+// the host decides which of them it has.
+const (
+	capabilityPatch       = "PATCH_GA"
+	capabilityGuestPolicy = "GUEST_POLICY_BETA"
+)
+
+// hostFeatures is what the agent detected on this host, capabilities are
+// computed from it.
+type hostFeatures struct {
+	packageManagers []string
+	osShortName     string
+}
+
+var (
+	// detectHostFeatures is replaced in tests.
+	detectHostFeatures = hostFeaturesFromSystem
+
+	registeredMx           sync.Mutex
+	registeredCapabilities []string
+)
+
+// hostFeaturesFromSystem detects the host features on each call, so a
+// package manager installed after the agent started is picked up by the
+// next capabilities check.
+func hostFeaturesFromSystem(ctx context.Context) hostFeatures {
+	f := hostFeatures{packageManagers: packages.PackageManagers()}
+	if goos == "windows" {
+		// Windows Update is always available.
+		f.packageManagers = append(f.packageManagers, "wua")
+	}
+
+	oi, err := osinfo.Get()
+	if err != nil {
+		clog.Warningf(ctx, "Error getting OS info for capabilities: %v", err)
+	} else {
+		f.osShortName = oi.ShortName
+	}
+	return f
+}
+
+// capabilities returns the sorted capabilities for the given host features.
+func (f hostFeatures) capabilities() []string {
+	caps := []string{capabilityGuestPolicy}
+
+	// Patching needs a package manager to patch with, Container-Optimized
+	// OS is updated by replacing the image instead.
+	if len(f.packageManagers) > 0 && f.osShortName != "cos" {
+		caps = append(caps, capabilityPatch)
+	}
+
+	sort.Strings(caps)
+	return caps
+}
+
+// Capabilities returns the capabilities of this agent, computed from what it
+// detects on the host.
+func Capabilities(ctx context.Context) []string {
+	return detectHostFeatures(ctx).capabilities()
+}
+
+// CapabilitiesChanged reports whether the capabilities of this agent differ
+// from those last sent with RegisterAgent, in which case the agent should
+// register again.
+func CapabilitiesChanged(ctx context.Context) bool {
+	caps := Capabilities(ctx)
+
+	registeredMx.Lock()
+	defer registeredMx.Unlock()
+	if registeredCapabilities == nil {
+		return false
+	}
+	return !equalStrings(caps, registeredCapabilities)
+}
+
+func setRegisteredCapabilities(caps []string) {
+	registeredMx.Lock()
+	defer registeredMx.Unlock()
+	registeredCapabilities = caps
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHostFeaturesCapabilities(t *testing.T) {
+	tests := []struct {
+		name string
+		f    hostFeatures
+		want []string
+	}{
+		{
+			"Debian",
+			hostFeatures{packageManagers: []string{"apt"}, osShortName: "debian"},
+			[]string{"GUEST_POLICY_BETA", "PATCH_GA"},
+		},
+		{
+			"COS",
+			hostFeatures{osShortName: "cos"},
+			[]string{"GUEST_POLICY_BETA"},
+		},
+		{
+			"NoPackageManager",
+			hostFeatures{osShortName: "rhel"},
+			[]string{"GUEST_POLICY_BETA"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, tt.f.capabilities()); diff != "" {
+				t.Errorf("capabilities() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesChanged(t *testing.T) {
+	ctx := context.Background()
+	f := hostFeatures{packageManagers: []string{"apt"}, osShortName: "debian"}
+	detectHostFeatures = func(context.Context) hostFeatures { return f }
+	// Other tests register the agent.
+	setRegisteredCapabilities(nil)
+	defer func() {
+		detectHostFeatures = hostFeaturesFromSystem
+		setRegisteredCapabilities(nil)
+	}()
+
+	if CapabilitiesChanged(ctx) {
+		t.Error("CapabilitiesChanged before registering: got(true) != want(false)")
+	}
+	setRegisteredCapabilities(Capabilities(ctx))
+	if CapabilitiesChanged(ctx) {
+		t.Error("CapabilitiesChanged with no change: got(true) != want(false)")
+	}
+	// apt was removed.
+	f.packageManagers = nil
+	if !CapabilitiesChanged(ctx) {
+		t.Error("CapabilitiesChanged after change: got(false) != want(true)")
+	}
+}
@@ -0,0 +1,296 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	gtransport "google.golang.org/api/transport/grpc"
+)
+
+var errConnsClosed = errors.New("agentendpoint connections are closed")
+
+// ConnHealth describes how calls on the connection to the agentendpoint
+// service have been going.
+type ConnHealth struct {
+	Endpoint            string
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	ConsecutiveFailures int
+	LastErrorCode       codes.Code
+	LastError           string
+}
+
+// String summarizes h for logging.
+func (h ConnHealth) String() string {
+	at := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	}
+	s := fmt.Sprintf("%s: last success %s, last failure %s", h.Endpoint, at(h.LastSuccess), at(h.LastFailure))
+	if h.ConsecutiveFailures > 0 {
+		s += fmt.Sprintf(", %d consecutive failures, last error %s: %s", h.ConsecutiveFailures, h.LastErrorCode, h.LastError)
+	}
+	return s
+}
+
+// healthTracker records the outcome of each call made on a connection.
+type healthTracker struct {
+	mx sync.Mutex
+	h  ConnHealth
+}
+
+func (t *healthTracker) get() ConnHealth {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.h
+}
+
+func (t *healthTracker) record(ctx context.Context, err error) {
+	code := status.Code(err)
+	if code == codes.Canceled {
+		// The caller gave up, that says nothing about the connection.
+		return
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	now := time.Now()
+	if err == nil {
+		if t.h.ConsecutiveFailures > 0 {
+			clog.Infof(ctx, "Calls to %s are succeeding again after %d failures.", t.h.Endpoint, t.h.ConsecutiveFailures)
+		}
+		t.h.LastSuccess = now
+		t.h.ConsecutiveFailures = 0
+		return
+	}
+	// Only log the first failure in a row, callers log their own errors.
+	if t.h.ConsecutiveFailures == 0 {
+		clog.Warningf(ctx, "Calls to %s are failing: %v", t.h.Endpoint, err)
+	}
+	t.h.LastFailure = now
+	t.h.ConsecutiveFailures++
+	t.h.LastErrorCode = code
+	t.h.LastError = err.Error()
+}
+
+func (t *healthTracker) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	t.record(ctx, err)
+	return err
+}
+
+// streamInterceptor only records whether the stream was opened, streams are
+// ended by the service as a matter of course.
+func (t *healthTracker) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	t.record(ctx, err)
+	return s, err
+}
+
+// connSettings are the settings a connection is dialed with.
+type connSettings struct {
+	endpoint                        string
+	proxy, noProxy, caBundleFile    string
+	clientCertFile, clientKeyFile   string
+	plaintext                       bool
+	keepaliveTime, keepaliveTimeout time.Duration
+}
+
+func currentConnSettings() connSettings {
+	return connSettings{
+		endpoint:         agentconfig.SvcEndpoint(),
+		proxy:            agentconfig.Proxy(),
+		noProxy:          agentconfig.NoProxy(),
+		caBundleFile:     agentconfig.CABundleFile(),
+		clientCertFile:   agentconfig.ClientCertFile(),
+		clientKeyFile:    agentconfig.ClientKeyFile(),
+		plaintext:        agentconfig.EndpointPlaintext(),
+		keepaliveTime:    agentconfig.EndpointKeepaliveTime(),
+		keepaliveTimeout: agentconfig.EndpointKeepaliveTimeout(),
+	}
+}
+
+// sharedConn is a connection and the number of clients using it.
+type sharedConn struct {
+	conn     *grpc.ClientConn
+	settings connSettings
+	refs     int
+	// stale is set once the connection is replaced, it is closed when the
+	// last client using it is closed.
+	stale bool
+}
+
+// connManager keeps one connection to the agentendpoint service that is
+// shared by all clients, rather than each inventory report, registration and
+// policy lookup making its own. The connection is replaced when the
+// configured endpoint, or any other setting it was dialed with, changes.
+type connManager struct {
+	mx     sync.Mutex
+	cur    *sharedConn
+	closed bool
+	// health is for the current connection, or the last attempt to dial
+	// one.
+	health *healthTracker
+
+	// settings and dial are replaced in tests.
+	settings func() connSettings
+	dial     func(ctx context.Context, endpoint string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+}
+
+var conns = &connManager{settings: currentConnSettings, dial: dialEndpoint}
+
+// dialEndpoint dials endpoint with the same options a client would use on
+// its own connection.
+func dialEndpoint(ctx context.Context, endpoint string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	clientOpts, err := clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clientOpts = append(clientOpts,
+		option.WithEndpoint(endpoint),
+		// The generated clients set this when they dial for themselves.
+		option.WithGRPCDialOption(grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32))),
+	)
+	for _, o := range opts {
+		clientOpts = append(clientOpts, option.WithGRPCDialOption(o))
+	}
+	return gtransport.Dial(ctx, clientOpts...)
+}
+
+// acquire returns the connection for the current settings, dialing it if
+// needed. Each acquire must be matched by a release.
+func (m *connManager) acquire(ctx context.Context) (*sharedConn, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.closed {
+		return nil, errConnsClosed
+	}
+
+	settings := m.settings()
+	endpoint := settings.endpoint
+	if m.cur != nil && m.cur.settings != settings {
+		if m.cur.settings.endpoint != endpoint {
+			clog.Infof(ctx, "OSConfig endpoint changed to %q, opening a new connection.", endpoint)
+		} else {
+			clog.Infof(ctx, "Connection settings for %s changed, opening a new connection.", endpoint)
+		}
+		m.retire(m.cur)
+		m.cur = nil
+	}
+	if m.cur == nil {
+		clog.Debugf(ctx, "Opening connection to %s.", endpoint)
+		h := &healthTracker{h: ConnHealth{Endpoint: endpoint}}
+		m.health = h
+		conn, err := m.dial(ctx, endpoint,
+			grpc.WithChainUnaryInterceptor(h.unaryInterceptor),
+			grpc.WithChainStreamInterceptor(h.streamInterceptor),
+		)
+		if err != nil {
+			h.record(ctx, err)
+			return nil, err
+		}
+		m.cur = &sharedConn{conn: conn, settings: settings}
+	}
+	m.cur.refs++
+	return m.cur, nil
+}
+
+// release is called when a client stops using sc.
+func (m *connManager) release(sc *sharedConn) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	sc.refs--
+	if sc.stale && sc.refs == 0 {
+		return sc.conn.Close()
+	}
+	return nil
+}
+
+// retire closes sc once no client is using it, m.mx must be held.
+func (m *connManager) retire(sc *sharedConn) {
+	sc.stale = true
+	if sc.refs == 0 {
+		sc.conn.Close()
+	}
+}
+
+// close stops new connections from being made and closes the current one
+// once no client is using it.
+func (m *connManager) close() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.closed = true
+	if m.cur != nil {
+		m.retire(m.cur)
+		m.cur = nil
+	}
+}
+
+func (m *connManager) connHealth() ConnHealth {
+	m.mx.Lock()
+	h := m.health
+	m.mx.Unlock()
+	if h == nil {
+		return ConnHealth{Endpoint: m.settings().endpoint}
+	}
+	return h.get()
+}
+
+// ConnectionHealth reports how calls to the agentendpoint service on the
+// shared connection have been going.
+func ConnectionHealth() ConnHealth {
+	return conns.connHealth()
+}
+
+// CloseConnections closes the shared connection to the agentendpoint service
+// once the clients using it are closed, no new clients can be created after
+// this is called.
+func CloseConnections() {
+	conns.close()
+}
+
+// connOptions returns the options for a new client. Without opts the client
+// uses the shared connection, which is returned so it can be released. With
+// opts the client dials its own connection with opts added to the default
+// options.
+func connOptions(ctx context.Context, opts []option.ClientOption) ([]option.ClientOption, *sharedConn, error) {
+	if len(opts) > 0 {
+		defaultOpts, err := clientOptions(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(defaultOpts, opts...), nil, nil
+	}
+	sc, err := conns.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []option.ClientOption{option.WithGRPCConn(sc.conn)}, sc, nil
+}
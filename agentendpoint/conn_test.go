@@ -0,0 +1,186 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentendpoint/agentendpointtest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+func TestConnManager(t *testing.T) {
+	ctx := context.Background()
+	srv := agentendpointtest.NewServer()
+	defer srv.Close()
+
+	settings := connSettings{endpoint: "first"}
+	dials := 0
+	m := &connManager{
+		settings: func() connSettings { return settings },
+		dial: func(ctx context.Context, _ string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+			dials++
+			return srv.Dial(ctx, opts...)
+		},
+	}
+
+	first, err := m.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first || dials != 1 {
+		t.Fatalf("second acquire dialed again, got %d dials", dials)
+	}
+
+	// Health follows the calls made on the connection.
+	client := agentendpointpb.NewAgentEndpointServiceClient(first.conn)
+	srv.QueueErrors(agentendpointtest.RegisterAgent, status.Error(codes.PermissionDenied, "service disabled"))
+	if _, err := client.RegisterAgent(ctx, &agentendpointpb.RegisterAgentRequest{}); err == nil {
+		t.Fatal("expected the queued RegisterAgent error")
+	}
+	h := m.connHealth()
+	if h.Endpoint != "first" || h.ConsecutiveFailures != 1 || h.LastErrorCode != codes.PermissionDenied || h.LastFailure.IsZero() {
+		t.Errorf("unexpected health after a failed call: %+v", h)
+	}
+	if _, err := client.RegisterAgent(ctx, &agentendpointpb.RegisterAgentRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h = m.connHealth()
+	if h.ConsecutiveFailures != 0 || h.LastSuccess.IsZero() || h.LastErrorCode != codes.PermissionDenied {
+		t.Errorf("unexpected health after a successful call: %+v", h)
+	}
+
+	// A changed endpoint gets a new connection, the old one is closed once
+	// the clients using it are done with it.
+	settings.endpoint = "second"
+	second, err := m.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || dials != 2 {
+		t.Fatalf("acquire after an endpoint change did not dial again, got %d dials", dials)
+	}
+	if h := m.connHealth(); h.Endpoint != "second" || h.ConsecutiveFailures != 0 {
+		t.Errorf("unexpected health for the new connection: %+v", h)
+	}
+	m.release(first)
+	if first.conn.GetState() == connectivity.Shutdown {
+		t.Error("old connection closed while still in use")
+	}
+	m.release(again)
+	if first.conn.GetState() != connectivity.Shutdown {
+		t.Error("old connection not closed after its last release")
+	}
+
+	// So does a change to any other setting the connection was dialed with.
+	settings.proxy = "http://proxy.example.com:3128"
+	third, err := m.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == second || dials != 3 {
+		t.Fatalf("acquire after a proxy change did not dial again, got %d dials", dials)
+	}
+	m.release(second)
+	if second.conn.GetState() != connectivity.Shutdown {
+		t.Error("connection not closed after a proxy change and its last release")
+	}
+
+	// After close no connections are made and the current one is closed
+	// once released.
+	m.close()
+	if _, err := m.acquire(ctx); err != errConnsClosed {
+		t.Errorf("acquire after close: got %v, want %v", err, errConnsClosed)
+	}
+	if third.conn.GetState() == connectivity.Shutdown {
+		t.Error("connection closed while still in use")
+	}
+	m.release(third)
+	if third.conn.GetState() != connectivity.Shutdown {
+		t.Error("connection not closed after close and its last release")
+	}
+}
+
+func TestConnHealthString(t *testing.T) {
+	at := time.Date(2020, 10, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		h    ConnHealth
+		want string
+	}{
+		{ConnHealth{Endpoint: "foo"}, "foo: last success never, last failure never"},
+		{ConnHealth{Endpoint: "foo", LastSuccess: at}, "foo: last success 2020-10-01T08:00:00Z, last failure never"},
+		{
+			ConnHealth{Endpoint: "foo", LastFailure: at, ConsecutiveFailures: 2, LastErrorCode: codes.Unavailable, LastError: "down"},
+			"foo: last success never, last failure 2020-10-01T08:00:00Z, 2 consecutive failures, last error Unavailable: down",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.h.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestClientCloseTwice(t *testing.T) {
+	ctx := context.Background()
+	srv := agentendpointtest.NewServer()
+	defer srv.Close()
+
+	oldConns := conns
+	defer func() { conns = oldConns }()
+	conns = &connManager{
+		settings: func() connSettings { return connSettings{endpoint: "test"} },
+		dial: func(ctx context.Context, _ string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+			return srv.Dial(ctx, opts...)
+		},
+	}
+
+	first, err := NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// Closing a client again must not release the shared connection again.
+	for i := 0; i < 2; i++ {
+		if err := first.Close(); err != nil {
+			t.Fatalf("Close %d: %v", i+1, err)
+		}
+	}
+	if refs := second.conn.refs; refs != 1 {
+		t.Errorf("shared connection refs after closing one client twice: got %d, want 1", refs)
+	}
+	// Retiring the connection must leave it open for the client still
+	// using it.
+	conns.close()
+	if err := second.RegisterAgent(ctx); err != nil {
+		t.Errorf("RegisterAgent on the client still using the connection: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSpecCommandInlineScriptUser(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	goos = "linux"
+
+	// Only root can give a file away, anyone else can only test with
+	// themselves.
+	name := "nobody"
+	if os.Geteuid() != 0 {
+		u, err := user.Current()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name = u.Username
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		t.Skipf("user %q not found: %v", name, err)
+	}
+
+	path := filepath.Join(td, "step"+execSpecSuffix)
+	if err := ioutil.WriteFile(path, []byte(`{"interpreter": "sh", "script": "echo hi", "user": "`+name+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, script, err := specCommand(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script)
+
+	fi, err := os.Stat(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Uid)); got != u.Uid {
+		t.Errorf("inline script owner: got(%s) != want(%s)", got, u.Uid)
+	}
+
+	// The user can run the script.
+	cmd := exec.Command(c.path, c.args...)
+	if err := setUser(cmd, c.user); err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running inline script as %q: %v, out: %s", name, err, out)
+	}
+	if string(out) != "hi\n" {
+		t.Errorf("inline script output: got(%q) != want(%q)", out, "hi\n")
+	}
+
+	// An unknown user is an error, not a script only the agent can read.
+	if err := ioutil.WriteFile(path, []byte(`{"interpreter": "sh", "script": "echo hi", "user": "no-such-osconfig-user"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := specCommand(path); err == nil {
+		t.Error("expected error for an unknown user")
+	}
+}
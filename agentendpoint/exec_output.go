@@ -0,0 +1,177 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+)
+
+// taskFileMaxAge is how long saved exec output and patch results are kept.
+const taskFileMaxAge = 30 * 24 * time.Hour
+
+// execOutputDir overrides agentconfig.ExecOutputDir when set.
+var execOutputDir string
+
+func outputDir() string {
+	if execOutputDir != "" {
+		return execOutputDir
+	}
+	return agentconfig.ExecOutputDir()
+}
+
+// outputBuffer keeps the start and end of everything written to it, up to
+// limit bytes in total, and drops the middle.
+type outputBuffer struct {
+	mx      sync.Mutex
+	limit   int
+	head    []byte
+	tail    []byte
+	dropped int64
+}
+
+func newOutputBuffer(limit int) *outputBuffer {
+	return &outputBuffer{limit: limit}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	n := len(p)
+	headLimit := b.limit / 2
+	if len(b.head) < headLimit {
+		i := headLimit - len(b.head)
+		if i > len(p) {
+			i = len(p)
+		}
+		b.head = append(b.head, p[:i]...)
+		p = p[i:]
+	}
+
+	tailLimit := b.limit - headLimit
+	b.tail = append(b.tail, p...)
+	if over := len(b.tail) - tailLimit; over > 0 {
+		b.dropped += int64(over)
+		b.tail = append(b.tail[:0], b.tail[over:]...)
+	}
+	return n, nil
+}
+
+// Bytes returns the kept output with a marker where output was dropped.
+func (b *outputBuffer) Bytes() []byte {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	var buf bytes.Buffer
+	buf.Write(b.head)
+	if b.dropped > 0 {
+		fmt.Fprintf(&buf, "\n[... %d bytes of output truncated ...]\n", b.dropped)
+	}
+	buf.Write(b.tail)
+	return buf.Bytes()
+}
+
+// last returns at most the last n bytes of Bytes.
+func (b *outputBuffer) last(n int) []byte {
+	out := b.Bytes()
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// lineLogger logs each complete line written to it at debug level so long
+// running commands can be followed in the agent log.
+type lineLogger struct {
+	ctx context.Context
+	buf []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		clog.Debugf(l.ctx, "Command output: %s", l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any trailing partial line.
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		clog.Debugf(l.ctx, "Command output: %s", l.buf)
+		l.buf = nil
+	}
+}
+
+// taskFileName is a file name for the task, task IDs come from the service
+// so make sure one can not escape the directory it is used in.
+func taskFileName(taskID, ext string) string {
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(taskID)
+	if name == "" || name == "." || name == ".." {
+		name = "unknown"
+	}
+	return name + ext
+}
+
+// execOutputFile is where the output of the task is saved.
+func execOutputFile(taskID string) string {
+	return filepath.Join(outputDir(), taskFileName(taskID, ".log"))
+}
+
+// saveTaskFile writes a file to dir, which only holds per task files, and
+// removes files there older than taskFileMaxAge.
+func saveTaskFile(ctx context.Context, dir, path string, data []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	if fis, err := ioutil.ReadDir(dir); err == nil {
+		for _, fi := range fis {
+			if time.Since(fi.ModTime()) > taskFileMaxAge {
+				if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+					clog.Warningf(ctx, "Error removing old task file: %v", err)
+				}
+			}
+		}
+	}
+
+	return writeFile(path, data)
+}
+
+// saveExecOutput saves the output of a task and removes output older than
+// taskFileMaxAge. Saving it locally is all that is done with the output:
+// neither ExecStepTaskProgress nor ExecStepTaskOutput has a field for it, so
+// it can not be sent to the service until the API adds one. Only the tail of
+// the output of a canceled or timed out step reaches the service, as part of
+// the error message.
+func saveExecOutput(ctx context.Context, taskID string, out []byte) error {
+	return saveTaskFile(ctx, outputDir(), execOutputFile(taskID), out)
+}
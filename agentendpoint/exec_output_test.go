@@ -0,0 +1,75 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   string
+	}{
+		{"UnderLimit", 10, []string{"abc", "def"}, "abcdef"},
+		{"AtLimit", 6, []string{"abc", "def"}, "abcdef"},
+		{"OverLimit", 6, []string{"abcd", "efgh", "ij"}, "abc\n[... 4 bytes of output truncated ...]\nhij"},
+		{"OneLargeWrite", 4, []string{"abcdefgh"}, "ab\n[... 4 bytes of output truncated ...]\ngh"},
+		{"NoLimit", 0, []string{"abc"}, "\n[... 3 bytes of output truncated ...]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newOutputBuffer(tt.limit)
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("Write(%q): got (%d, %v), want (%d, nil)", w, n, err, len(w))
+				}
+			}
+			if got := string(b.Bytes()); got != tt.want {
+				t.Errorf("Bytes(): got(%q) != want(%q)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveExecOutput(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	execOutputDir = td
+	defer func() { execOutputDir = "" }()
+
+	if err := saveExecOutput(context.Background(), "../foo", []byte("output")); err != nil {
+		t.Fatalf("saveExecOutput: unexpected error: %v", err)
+	}
+	if want := filepath.Join(td, ".._foo.log"); execOutputFile("../foo") != want {
+		t.Errorf("execOutputFile: got(%q) != want(%q)", execOutputFile("../foo"), want)
+	}
+	got, err := ioutil.ReadFile(execOutputFile("../foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "output" {
+		t.Errorf("saved output: got(%q) != want(%q)", got, "output")
+	}
+}
@@ -0,0 +1,276 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+// execSpecSuffix marks an exec step executable as an execSpec. The spec is
+// delivered like any other executable, as a local path or a GCS object.
+const execSpecSuffix = ".osconfig-exec.json"
+
+// Interpreters an execSpec can use on top of those in ExecStepConfig.
+const (
+	interpreterSh         = "sh"
+	interpreterBash       = "bash"
+	interpreterPython3    = "python3"
+	interpreterPowerShell = "powershell"
+	interpreterCmd        = "cmd"
+	// interpreterShebang runs the script with the interpreter named on its
+	// first "#!" line, this also works on Windows.
+	interpreterShebang = "shebang"
+)
+
+// lookPath is replaced in tests.
+var lookPath = exec.LookPath
+
+// execSpec is the local extension format for exec steps, it allows what
+// ExecStepConfig can not express.
+type execSpec struct {
+	// Interpreter is one of the interpreter constants, empty runs Path
+	// directly.
+	Interpreter string `json:"interpreter"`
+	// Script is inline script content, it is used instead of Path.
+	Script string `json:"script"`
+	// Path is the script or executable to run.
+	Path string `json:"path"`
+	// Args are passed after the script.
+	Args []string `json:"args"`
+	// Env is added to the agent environment.
+	Env map[string]string `json:"env"`
+	// Dir is the working directory.
+	Dir string `json:"dir"`
+	// User to run as, only supported on Linux.
+	User string `json:"user"`
+	// Timeout is how long the step may run as a duration such as "90s" or
+	// "2h", it replaces the agent's exec timeout for this step.
+	Timeout string `json:"timeout"`
+
+	// Reboot is set for a step that reboots the system itself, the step is
+	// then reported as complete once the system is back up rather than as
+	// interrupted.
+	Reboot bool `json:"reboot"`
+
+	// timeout is Timeout parsed.
+	timeout time.Duration
+}
+
+// execCommand is a fully resolved command to run.
+type execCommand struct {
+	path string
+	args []string
+	env  []string
+	dir  string
+	user string
+	// timeout replaces execTimeout when set.
+	timeout time.Duration
+	// reboot is set if the command is expected to reboot the system.
+	reboot bool
+}
+
+// configCommand is the command for an ExecStepConfig.
+func configCommand(interpreter agentendpointpb.ExecStepConfig_Interpreter, localPath string) (*execCommand, error) {
+	switch interpreter {
+	case agentendpointpb.ExecStepConfig_INTERPRETER_UNSPECIFIED:
+		if goos == "windows" {
+			return nil, errWinNoInt
+		}
+		return &execCommand{path: localPath}, nil
+	case agentendpointpb.ExecStepConfig_SHELL:
+		if goos == "windows" {
+			return &execCommand{path: winCmd, args: []string{"/c", localPath}}, nil
+		}
+		return &execCommand{path: sh, args: []string{localPath}}, nil
+	case agentendpointpb.ExecStepConfig_POWERSHELL:
+		if goos == "windows" {
+			return &execCommand{path: winPowershell, args: append(winPowershellArgs, "-File", localPath)}, nil
+		}
+		return nil, errLinuxPowerShell
+	default:
+		return nil, fmt.Errorf("invalid interpreter %q", interpreter)
+	}
+}
+
+func readExecSpec(path string) (*execSpec, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s execSpec
+	if err := json.Unmarshal(d, &s); err != nil {
+		return nil, fmt.Errorf("error parsing exec spec %s: %v", path, err)
+	}
+	if (s.Script == "") == (s.Path == "") {
+		return nil, errors.New("exec spec must set exactly one of script or path")
+	}
+	if s.Timeout != "" {
+		if s.timeout, err = time.ParseDuration(s.Timeout); err != nil || s.timeout <= 0 {
+			return nil, fmt.Errorf("exec spec timeout %q is not a positive duration", s.Timeout)
+		}
+	}
+	return &s, nil
+}
+
+// specCommand reads the execSpec at path and returns its command, script is
+// set to an inline script written to disk that the caller removes.
+func specCommand(path string) (c *execCommand, script string, err error) {
+	spec, err := readExecSpec(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if spec.Script == "" {
+		c, err = spec.command(spec.Path)
+		return c, "", err
+	}
+	if script, err = spec.writeScript(); err != nil {
+		return nil, "", fmt.Errorf("error writing inline script: %v", err)
+	}
+	c, err = spec.command(script)
+	return c, script, err
+}
+
+// scriptExt is the file extension an inline script needs to be run by its
+// interpreter.
+func scriptExt(interpreter string) string {
+	switch interpreter {
+	case interpreterPowerShell:
+		return ".ps1"
+	case interpreterCmd:
+		return ".cmd"
+	case interpreterPython3:
+		return ".py"
+	}
+	return ""
+}
+
+// writeScript writes inline script content to a temporary file, the caller
+// removes it. The file is only readable by its owner, which is the user the
+// step runs as if one is set.
+func (s *execSpec) writeScript() (string, error) {
+	f, err := ioutil.TempFile("", "osconfig_exec_*"+scriptExt(s.Interpreter))
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(s.Script); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0700); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if s.User != "" {
+		if err := chownToUser(f.Name(), s.User); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
+
+// command is the command for the spec with script as the script or
+// executable to run.
+func (s *execSpec) command(script string) (*execCommand, error) {
+	c := &execCommand{dir: s.Dir, user: s.User, timeout: s.timeout, reboot: s.Reboot}
+	var args []string
+	switch s.Interpreter {
+	case "":
+		if goos == "windows" {
+			return nil, errWinNoInt
+		}
+		c.path = script
+	case interpreterSh:
+		if goos == "windows" {
+			return nil, fmt.Errorf("interpreter %q cannot be used on a Windows system", s.Interpreter)
+		}
+		c.path, args = sh, []string{script}
+	case interpreterCmd:
+		if goos != "windows" {
+			return nil, fmt.Errorf("interpreter %q cannot be used on non-Windows system", s.Interpreter)
+		}
+		c.path, args = winCmd, []string{"/c", script}
+	case interpreterPowerShell:
+		if goos != "windows" {
+			return nil, errLinuxPowerShell
+		}
+		c.path, args = winPowershell, append(winPowershellArgs, "-File", script)
+	case interpreterBash, interpreterPython3:
+		p, err := lookPath(s.Interpreter)
+		if err != nil {
+			return nil, fmt.Errorf("interpreter %q not found: %v", s.Interpreter, err)
+		}
+		c.path, args = p, []string{script}
+	case interpreterShebang:
+		interp, err := readShebang(script)
+		if err != nil {
+			return nil, err
+		}
+		c.path, args = interp[0], append(interp[1:], script)
+	default:
+		return nil, fmt.Errorf("invalid interpreter %q", s.Interpreter)
+	}
+	c.args = append(args, s.Args...)
+
+	keys := make([]string, 0, len(s.Env))
+	for k := range s.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c.env = append(c.env, k+"="+s.Env[k])
+	}
+	return c, nil
+}
+
+// readShebang returns the interpreter and arguments from the "#!" line of a
+// script.
+func readShebang(script string) ([]string, error) {
+	f, err := os.Open(script)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("error reading %s: %v", script, err)
+	}
+	if !bytes.HasPrefix(line, []byte("#!")) {
+		return nil, fmt.Errorf("script %s has no #! line", script)
+	}
+	fields := strings.Fields(string(line[2:]))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("script %s has an empty #! line", script)
+	}
+	return fields, nil
+}
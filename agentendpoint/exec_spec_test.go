@@ -0,0 +1,132 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExecSpecCommand(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	script := filepath.Join(td, "script")
+	if err := ioutil.WriteFile(script, []byte("#!/usr/bin/env python3 -u\nprint('hi')\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	lookPath = func(file string) (string, error) { return "/usr/bin/" + file, nil }
+	defer func() { lookPath = exec.LookPath }()
+
+	tests := []struct {
+		name    string
+		goos    string
+		spec    execSpec
+		want    *execCommand
+		wantErr bool
+	}{
+		{"None", "linux", execSpec{Args: []string{"a"}}, &execCommand{path: script, args: []string{"a"}}, false},
+		{"Sh", "linux", execSpec{Interpreter: "sh"}, &execCommand{path: sh, args: []string{script}}, false},
+		{"Python3", "linux", execSpec{Interpreter: "python3", Args: []string{"a", "b"}}, &execCommand{path: "/usr/bin/python3", args: []string{script, "a", "b"}}, false},
+		{"Bash", "linux", execSpec{Interpreter: "bash", Env: map[string]string{"B": "2", "A": "1"}, Dir: "/tmp", User: "nobody"}, &execCommand{path: "/usr/bin/bash", args: []string{script}, env: []string{"A=1", "B=2"}, dir: "/tmp", user: "nobody"}, false},
+		{"Shebang", "windows", execSpec{Interpreter: "shebang", Args: []string{"a"}}, &execCommand{path: "/usr/bin/env", args: []string{"python3", "-u", script, "a"}}, false},
+		{"Cmd", "windows", execSpec{Interpreter: "cmd"}, &execCommand{path: winCmd, args: []string{"/c", script}}, false},
+		{"CmdOnLinux", "linux", execSpec{Interpreter: "cmd"}, nil, true},
+		{"PowerShellOnLinux", "linux", execSpec{Interpreter: "powershell"}, nil, true},
+		{"NoneOnWindows", "windows", execSpec{}, nil, true},
+		{"Unknown", "linux", execSpec{Interpreter: "perl"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goos = tt.goos
+			got, err := tt.spec.command(script)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("command: got err %v, wantErr %t", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(execCommand{})); diff != "" {
+				t.Errorf("command mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSpecCommandInlineScript(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	goos = "linux"
+
+	path := filepath.Join(td, "step"+execSpecSuffix)
+	if err := ioutil.WriteFile(path, []byte(`{"interpreter": "sh", "script": "echo hi", "args": ["a"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, script, err := specCommand(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script)
+
+	got, err := ioutil.ReadFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "echo hi" {
+		t.Errorf("inline script: got(%q) != want(%q)", got, "echo hi")
+	}
+	if diff := cmp.Diff(&execCommand{path: sh, args: []string{script, "a"}}, c, cmp.AllowUnexported(execCommand{})); diff != "" {
+		t.Errorf("command mismatch (-want +got):\n%s", diff)
+	}
+
+	// Exactly one of script and path must be set.
+	if err := ioutil.WriteFile(path, []byte(`{"script": "echo hi", "path": "/bin/true"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := specCommand(path); err == nil {
+		t.Error("expected error for an exec spec with both script and path")
+	}
+
+	// A timeout is carried on the command.
+	if err := ioutil.WriteFile(path, []byte(`{"path": "/bin/true", "timeout": "90s"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, _, err = specCommand(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.timeout != 90*time.Second {
+		t.Errorf("command timeout: got(%s) != want(%s)", c.timeout, 90*time.Second)
+	}
+	if c.reboot {
+		t.Error("command should not expect a reboot")
+	}
+	for _, timeout := range []string{"soon", "-1m", "0s"} {
+		if err := ioutil.WriteFile(path, []byte(`{"path": "/bin/true", "timeout": "`+timeout+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := specCommand(path); err == nil {
+			t.Errorf("expected error for exec spec timeout %q", timeout)
+		}
+	}
+}
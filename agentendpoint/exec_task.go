@@ -16,18 +16,23 @@ package agentendpoint
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/GoogleCloudPlatform/osconfig/clog"
 	"github.com/GoogleCloudPlatform/osconfig/external"
+	"google.golang.org/protobuf/encoding/protojson"
 
 	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
 )
@@ -55,12 +60,48 @@ func init() {
 	winCmd = filepath.Join(winRoot, `System32\cmd.exe`)
 }
 
-var run = func(cmd *exec.Cmd) ([]byte, error) {
-	return cmd.CombinedOutput()
+var (
+	// execTimeout, execHeartbeatInterval, execOutputLimit,
+	// execRebootExitCode and systemBootTime are replaced in tests.
+	execTimeout           = agentconfig.ExecTimeout
+	execHeartbeatInterval = 30 * time.Second
+	execOutputLimit       = agentconfig.ExecOutputLimit
+	// execRebootExitCode is the exit code an exec step uses to have the
+	// agent reboot the system, the task is then reported as complete after
+	// the reboot. 0 turns this off.
+	execRebootExitCode = agentconfig.ExecRebootExitCode
+	systemBootTime     = bootTime
+
+	// execOutputTail is how much of the output of a canceled or timed out
+	// exec step is included in the error message.
+	execOutputTail = 1024
+)
+
+// run runs cmd, killing its process group if ctx is done first.
+var run = func(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-waitErr:
+		return err
+	case <-ctx.Done():
+		if err := killProcessGroup(cmd); err != nil {
+			clog.Errorf(ctx, "Error killing process group: %v", err)
+		}
+		<-waitErr
+		return ctx.Err()
+	}
 }
 
 func getGCSObject(ctx context.Context, bkt, obj string, gen int64) (string, error) {
-	cl, err := storage.NewClient(ctx)
+	cl, err := external.NewGCSClient(ctx)
 	if err != nil {
 		return "", fmt.Errorf("error creating gcs client: %v", err)
 	}
@@ -80,15 +121,31 @@ func getGCSObject(ctx context.Context, bkt, obj string, gen int64) (string, erro
 	return localPath, nil
 }
 
-func executeCommand(ctx context.Context, path string, args []string) (int32, error) {
-	clog.Debugf(ctx, "Running command %s with args %s", path, args)
+// executeCommand runs the command writing its combined stdout and stderr to
+// out.
+func executeCommand(ctx context.Context, c *execCommand, out io.Writer) (int32, error) {
+	clog.Debugf(ctx, "Running command %s with args %s", c.path, c.args)
 
-	cmd := exec.Command(path, args...)
-	out, err := run(cmd)
+	cmd := exec.Command(c.path, c.args...)
+	cmd.Dir = c.dir
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+	if c.user != "" {
+		if err := setUser(cmd, c.user); err != nil {
+			return -1, err
+		}
+	}
+	ll := &lineLogger{ctx: ctx}
+	// Using the same writer for both keeps the output in order.
+	cmd.Stdout = io.MultiWriter(out, ll)
+	cmd.Stderr = cmd.Stdout
+	err := run(ctx, cmd)
+	ll.flush()
 	var exitCode int32
 	if cmd.ProcessState != nil {
 		exitCode = int32(cmd.ProcessState.ExitCode())
-		clog.Infof(ctx, "Command exit code: %d, out:\n%s", exitCode, out)
+		clog.Infof(ctx, "Command exit code: %d", exitCode)
 	}
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
@@ -99,26 +156,64 @@ func executeCommand(ctx context.Context, path string, args []string) (int32, err
 	return exitCode, nil
 }
 
+type execStep string
+
+const (
+	execRunning   = "Running"
+	execRebooting = "Rebooting"
+	// execRebootExpected is saved before running a step that reboots the
+	// system itself.
+	execRebootExpected = "RebootExpected"
+)
+
+// bootTimeSlack is how far apart two boot times read in the same boot can
+// be, the boot time is worked out from the uptime so it moves with clock
+// adjustments.
+const bootTimeSlack = time.Minute
+
 type execTask struct {
-	client *Client
+	task *Task
 
 	TaskID    string
 	Task      *execStepTask
 	StartedAt time.Time `json:",omitempty"`
+	ExecStep  execStep  `json:",omitempty"`
+	// BootTime is when the system booted, it is saved with
+	// execRebootExpected to tell a reboot from an agent restart.
+	BootTime time.Time `json:",omitempty"`
+}
+
+func (e *execTask) setStep(step execStep) error {
+	e.ExecStep = step
+	if err := e.task.SaveState(e); err != nil {
+		return fmt.Errorf("error saving state: %v", err)
+	}
+	return nil
 }
 
 type execStepTask struct {
 	*agentendpointpb.ExecStepTask
 }
 
+// MarshalJSON marshals an execStepTask using protojson.
+func (e *execStepTask) MarshalJSON() ([]byte, error) {
+	m := &protojson.MarshalOptions{AllowPartial: true, EmitUnpopulated: false}
+	return m.Marshal(e)
+}
+
+// UnmarshalJSON unmarshals an execStepTask using protojson.
+func (e *execStepTask) UnmarshalJSON(b []byte) error {
+	e.ExecStepTask = &agentendpointpb.ExecStepTask{}
+	un := &protojson.UnmarshalOptions{AllowPartial: true, DiscardUnknown: true}
+	return un.Unmarshal(b, e.ExecStepTask)
+}
+
 func (e *execTask) reportCompletedState(ctx context.Context, errMsg string, output *agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput) error {
 	req := &agentendpointpb.ReportTaskCompleteRequest{
-		TaskId:       e.TaskID,
-		TaskType:     agentendpointpb.TaskType_EXEC_STEP_TASK,
 		ErrorMessage: errMsg,
 		Output:       output,
 	}
-	if err := e.client.reportTaskComplete(ctx, req); err != nil {
+	if err := e.task.ReportComplete(ctx, req); err != nil {
 		return fmt.Errorf("error reporting completed state: %v", err)
 	}
 	return nil
@@ -127,14 +222,21 @@ func (e *execTask) reportCompletedState(ctx context.Context, errMsg string, outp
 func (e *execTask) run(ctx context.Context) error {
 	clog.Infof(ctx, "Beginning exec task")
 	e.StartedAt = time.Now()
+	// Saving state before anything runs means a restart of the agent, or
+	// the system, can always be reported.
+	if err := e.setStep(execRunning); err != nil {
+		msg := fmt.Sprintf("Error saving agent step: %v", err)
+		clog.Errorf(ctx, msg)
+		return e.reportCompletedState(ctx, msg, &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+			ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{State: agentendpointpb.ExecStepTaskOutput_COMPLETED, ExitCode: -1},
+		})
+	}
 	req := &agentendpointpb.ReportTaskProgressRequest{
-		TaskId:   e.TaskID,
-		TaskType: agentendpointpb.TaskType_EXEC_STEP_TASK,
 		Progress: &agentendpointpb.ReportTaskProgressRequest_ExecStepTaskProgress{
 			ExecStepTaskProgress: &agentendpointpb.ExecStepTaskProgress{State: agentendpointpb.ExecStepTaskProgress_STARTED},
 		},
 	}
-	res, err := e.client.reportTaskProgress(ctx, req)
+	res, err := e.task.ReportProgress(ctx, req)
 	if err != nil {
 		return fmt.Errorf("error reporting state %s: %v", agentendpointpb.ExecStepTaskProgress_STARTED, err)
 	}
@@ -171,29 +273,92 @@ func (e *execTask) run(ctx context.Context) error {
 		}()
 	}
 
-	exitCode := int32(-1)
-	switch stepConfig.GetInterpreter() {
-	case agentendpointpb.ExecStepConfig_INTERPRETER_UNSPECIFIED:
-		if goos == "windows" {
-			err = errWinNoInt
-		} else {
-			exitCode, err = executeCommand(ctx, localPath, nil)
+	var c *execCommand
+	if strings.HasSuffix(localPath, execSpecSuffix) {
+		var script string
+		c, script, err = specCommand(localPath)
+		if script != "" {
+			defer func() {
+				if err := os.Remove(script); err != nil {
+					clog.Errorf(ctx, "error removing inline script %s", err)
+				}
+			}()
 		}
-	case agentendpointpb.ExecStepConfig_SHELL:
-		if goos == "windows" {
-			exitCode, err = executeCommand(ctx, winCmd, []string{"/c", localPath})
-		} else {
-			exitCode, err = executeCommand(ctx, sh, []string{localPath})
+	} else {
+		c, err = configCommand(stepConfig.GetInterpreter(), localPath)
+	}
+
+	// A step that reboots the system itself is complete once the system is
+	// back up, which Resume can only tell from an agent restart if the
+	// boot time is saved first.
+	if err == nil && c.reboot {
+		if e.BootTime, err = systemBootTime(); err == nil {
+			err = e.setStep(execRebootExpected)
 		}
-	case agentendpointpb.ExecStepConfig_POWERSHELL:
-		if goos == "windows" {
-			exitCode, err = executeCommand(ctx, winPowershell, append(winPowershellArgs, "-File", localPath))
-		} else {
-			err = errLinuxPowerShell
+		if err != nil {
+			msg := fmt.Sprintf("Error saving agent step: %v", err)
+			clog.Errorf(ctx, msg)
+			return e.reportCompletedState(ctx, msg, &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+				ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{State: agentendpointpb.ExecStepTaskOutput_COMPLETED, ExitCode: -1},
+			})
 		}
-	default:
-		err = fmt.Errorf("invalid interpreter %q", stepConfig.GetInterpreter())
 	}
+
+	// The task has no timeout of its own, an exec spec can set one for the
+	// step.
+	timeout := execTimeout()
+	if c != nil && c.timeout > 0 {
+		timeout = c.timeout
+	}
+	cmdCtx, cancel := context.WithCancel(ctx)
+	if timeout > 0 {
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	var stopped int32
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		e.heartbeat(cmdCtx, func() {
+			atomic.StoreInt32(&stopped, 1)
+			cancel()
+		})
+	}()
+
+	out := newOutputBuffer(execOutputLimit())
+	exitCode := int32(-1)
+	if err == nil {
+		exitCode, err = executeCommand(cmdCtx, c, out)
+	}
+	// Make sure no progress is reported after completion.
+	cancel()
+	<-heartbeatDone
+
+	if sErr := saveExecOutput(ctx, e.TaskID, out.Bytes()); sErr != nil {
+		clog.Errorf(ctx, "Error saving exec task output: %v", sErr)
+	} else {
+		clog.Infof(ctx, "Exec task output saved to %s", execOutputFile(e.TaskID))
+	}
+
+	// The first of STOP and the timeout wins.
+	var endState agentendpointpb.ExecStepTaskOutput_State
+	var msg string
+	switch {
+	case atomic.LoadInt32(&stopped) == 1:
+		endState, msg = agentendpointpb.ExecStepTaskOutput_CANCELLED, errServerCancel.Error()
+	case cmdCtx.Err() == context.DeadlineExceeded:
+		endState, msg = agentendpointpb.ExecStepTaskOutput_TIMED_OUT, fmt.Sprintf("Exec task timed out after %s", timeout)
+	}
+	if endState != agentendpointpb.ExecStepTaskOutput_STATE_UNSPECIFIED {
+		clog.Errorf(ctx, msg)
+		return e.reportCompletedState(ctx, fmt.Sprintf("%s, partial output:\n%s", msg, out.last(execOutputTail)), &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+			ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{
+				State:    endState,
+				ExitCode: exitCode,
+			},
+		})
+	}
+
 	if err != nil {
 		msg := fmt.Sprintf("Error running exec task: %v", err)
 		clog.Errorf(ctx, msg)
@@ -205,6 +370,19 @@ func (e *execTask) run(ctx context.Context) error {
 		})
 	}
 
+	if rc := execRebootExitCode(); rc != 0 && exitCode == int32(rc) {
+		if err := e.reboot(ctx); err != nil {
+			msg := fmt.Sprintf("Error rebooting after exec task: %v", err)
+			clog.Errorf(ctx, msg)
+			return e.reportCompletedState(ctx, msg, &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+				ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{
+					State:    agentendpointpb.ExecStepTaskOutput_COMPLETED,
+					ExitCode: exitCode,
+				},
+			})
+		}
+	}
+
 	return e.reportCompletedState(ctx, "", &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
 		ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{
 			State:    agentendpointpb.ExecStepTaskOutput_COMPLETED,
@@ -213,14 +391,119 @@ func (e *execTask) run(ctx context.Context) error {
 	})
 }
 
-// RunExecStep runs an exec step task.
-func (c *Client) RunExecStep(ctx context.Context, task *agentendpointpb.Task) error {
-	ctx = clog.WithLabels(ctx, task.GetServiceLabels())
+// reboot reboots the system for an exec step that exited with
+// execRebootExitCode, it only returns if the reboot is deferred or fails.
+func (e *execTask) reboot(ctx context.Context) error {
+	clog.Infof(ctx, "Exec step exited with %d, rebooting.", execRebootExitCode())
+	if err := agentconfig.CheckMaintenanceWindow(); err != nil {
+		// The exit code is reported as is so the caller can tell the
+		// reboot did not happen.
+		clog.Warningf(ctx, "Skipping reboot: %v", err)
+		return nil
+	}
+	if err := checkRebootInterval(); err != nil {
+		return err
+	}
+	if err := e.setStep(execRebooting); err != nil {
+		return err
+	}
+	if err := recordReboot(time.Now()); err != nil {
+		return fmt.Errorf("error saving reboot state: %v", err)
+	}
+	if err := rebootSystem(); err != nil {
+		return fmt.Errorf("failed to reboot system: %v", err)
+	}
+	waitForReboot(ctx)
+	return nil
+}
+
+// heartbeat reports progress every execHeartbeatInterval until ctx is done,
+// calling stop if the service asks for the task to be stopped.
+func (e *execTask) heartbeat(ctx context.Context, stop func()) {
+	ticker := time.NewTicker(execHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		req := &agentendpointpb.ReportTaskProgressRequest{
+			Progress: &agentendpointpb.ReportTaskProgressRequest_ExecStepTaskProgress{
+				ExecStepTaskProgress: &agentendpointpb.ExecStepTaskProgress{State: agentendpointpb.ExecStepTaskProgress_STARTED},
+			},
+		}
+		res, err := e.task.ReportProgress(ctx, req)
+		if err != nil {
+			if ctx.Err() == nil {
+				clog.Warningf(ctx, "Error reporting exec task progress: %v", err)
+			}
+			continue
+		}
+		if res.GetTaskDirective() == agentendpointpb.TaskDirective_STOP {
+			clog.Infof(ctx, "Service requested the exec task be stopped.")
+			stop()
+			return
+		}
+	}
+}
+
+// execTaskHandler is the TaskHandler for TaskType_EXEC_STEP_TASK.
+type execTaskHandler struct{}
+
+func (execTaskHandler) Start(ctx context.Context, t *Task) error {
 	e := &execTask{
-		TaskID: task.GetTaskId(),
-		client: c,
-		Task:   &execStepTask{task.GetExecStepTask()},
+		TaskID: t.ID(),
+		task:   t,
+		Task:   &execStepTask{t.Proto().GetExecStepTask()},
 	}
 
 	return e.run(ctx)
 }
+
+// Resume completes a task the agent was restarted during. An exec step that
+// asked for a reboot, or was expected to reboot the system itself, is
+// complete once the system is back up, any other step was interrupted and is
+// not run again as it may not be safe to.
+func (execTaskHandler) Resume(ctx context.Context, t *Task, state []byte) error {
+	e := &execTask{task: t}
+	if err := json.Unmarshal(state, e); err != nil {
+		clog.Errorf(ctx, "Error reading saved exec task: %v", err)
+	}
+	e.TaskID = t.ID()
+
+	if e.ExecStep == execRebooting || (e.ExecStep == execRebootExpected && rebootedSince(ctx, e.BootTime)) {
+		clog.Infof(ctx, "Exec task complete after reboot")
+		return e.reportCompletedState(ctx, "", &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+			ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{State: agentendpointpb.ExecStepTaskOutput_COMPLETED},
+		})
+	}
+
+	msg := "Exec task interrupted by agent restart"
+	if !e.StartedAt.IsZero() {
+		msg = fmt.Sprintf("%s, the task started at %s", msg, e.StartedAt.Format(time.RFC3339))
+	}
+	clog.Errorf(ctx, msg)
+	return e.reportCompletedState(ctx, msg, &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+		ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{State: agentendpointpb.ExecStepTaskOutput_COMPLETED, ExitCode: -1},
+	})
+}
+
+// rebootedSince reports whether the system has booted again since bt. If the
+// boot time can not be read the step is taken to have rebooted the system,
+// as it was expected to.
+func rebootedSince(ctx context.Context, bt time.Time) bool {
+	now, err := systemBootTime()
+	if err != nil {
+		clog.Warningf(ctx, "Error reading system boot time: %v", err)
+		return true
+	}
+	d := now.Sub(bt)
+	return d > bootTimeSlack || d < -bootTimeSlack
+}
+
+// RunExecStep runs an exec step task.
+func (c *Client) RunExecStep(ctx context.Context, task *agentendpointpb.Task) error {
+	return c.startTask(ctx, agentendpointpb.TaskType_EXEC_STEP_TASK, task)
+}
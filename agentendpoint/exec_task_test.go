@@ -16,9 +16,17 @@ package agentendpoint
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -29,6 +37,13 @@ import (
 
 type agentEndpointServiceExecTestServer struct {
 	lastReportTaskCompleteRequest *agentendpointpb.ReportTaskCompleteRequest
+	// progressDirective is returned from ReportTaskProgress once the first
+	// progressContinues calls have been answered with CONTINUE.
+	progressDirective agentendpointpb.TaskDirective
+	progressContinues int
+
+	mx            sync.Mutex
+	progressCalls int
 }
 
 func (*agentEndpointServiceExecTestServer) ReceiveTaskNotification(req *agentendpointpb.ReceiveTaskNotificationRequest, srv agentendpointpb.AgentEndpointService_ReceiveTaskNotificationServer) error {
@@ -39,8 +54,14 @@ func (*agentEndpointServiceExecTestServer) StartNextTask(ctx context.Context, re
 	return nil, status.Errorf(codes.Unimplemented, "method StartNextTask not implemented")
 }
 
-func (*agentEndpointServiceExecTestServer) ReportTaskProgress(ctx context.Context, req *agentendpointpb.ReportTaskProgressRequest) (*agentendpointpb.ReportTaskProgressResponse, error) {
-	return &agentendpointpb.ReportTaskProgressResponse{}, nil
+func (s *agentEndpointServiceExecTestServer) ReportTaskProgress(ctx context.Context, req *agentendpointpb.ReportTaskProgressRequest) (*agentendpointpb.ReportTaskProgressResponse, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.progressCalls++
+	if s.progressCalls <= s.progressContinues {
+		return &agentendpointpb.ReportTaskProgressResponse{TaskDirective: agentendpointpb.TaskDirective_CONTINUE}, nil
+	}
+	return &agentendpointpb.ReportTaskProgressResponse{TaskDirective: s.progressDirective}, nil
 }
 
 func (s *agentEndpointServiceExecTestServer) ReportTaskComplete(ctx context.Context, req *agentendpointpb.ReportTaskCompleteRequest) (*agentendpointpb.ReportTaskCompleteResponse, error) {
@@ -80,6 +101,15 @@ func TestRunExecStep(t *testing.T) {
 	}
 	defer tc.close()
 
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	execOutputDir = td
+	defer func() { execOutputDir = "" }()
+	taskStateFile = filepath.Join(td, "testState")
+
 	tests := []struct {
 		name       string
 		goos       string
@@ -100,10 +130,10 @@ func TestRunExecStep(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			var gotPath string
 			var gotArgs []string
-			run = func(cmd *exec.Cmd) ([]byte, error) {
+			run = func(ctx context.Context, cmd *exec.Cmd) error {
 				gotPath = cmd.Path
 				gotArgs = cmd.Args
-				return nil, nil
+				return nil
 			}
 			goos = tt.goos
 
@@ -125,3 +155,193 @@ func TestRunExecStep(t *testing.T) {
 		})
 	}
 }
+
+func TestRunExecStepTimeoutAndCancel(t *testing.T) {
+	ctx := context.Background()
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	execOutputDir = td
+	taskStateFile = filepath.Join(td, "testState")
+	goos = "linux"
+	execOutputLimit = func() int { return 1024 }
+	defer func() {
+		execOutputDir = ""
+		execOutputLimit = agentconfig.ExecOutputLimit
+		execTimeout = agentconfig.ExecTimeout
+		execHeartbeatInterval = 30 * time.Second
+	}()
+
+	// run writes some output then blocks until the step is canceled.
+	run = func(ctx context.Context, cmd *exec.Cmd) error {
+		fmt.Fprint(cmd.Stdout, "partial")
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// spec is an exec spec to run instead of a plain executable.
+		spec      string
+		directive agentendpointpb.TaskDirective
+		wantState agentendpointpb.ExecStepTaskOutput_State
+		wantMsg   string
+	}{
+		{"Timeout", 10 * time.Millisecond, "", agentendpointpb.TaskDirective_CONTINUE, agentendpointpb.ExecStepTaskOutput_TIMED_OUT, "Exec task timed out after 10ms, partial output:\npartial"},
+		{"SpecTimeout", time.Hour, `{"path": "foo", "timeout": "10ms"}`, agentendpointpb.TaskDirective_CONTINUE, agentendpointpb.ExecStepTaskOutput_TIMED_OUT, "Exec task timed out after 10ms, partial output:\npartial"},
+		{"Stop", 0, "", agentendpointpb.TaskDirective_STOP, agentendpointpb.ExecStepTaskOutput_CANCELLED, errServerCancel.Error() + ", partial output:\npartial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The step is reported as started before the heartbeat gets the
+			// directive.
+			srv := &agentEndpointServiceExecTestServer{progressDirective: tt.directive, progressContinues: 1}
+			tc, err := newTestClient(ctx, srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tc.close()
+			execTimeout = func() time.Duration { return tt.timeout }
+			execHeartbeatInterval = time.Millisecond
+
+			localPath := "foo"
+			if tt.spec != "" {
+				localPath = filepath.Join(td, tt.name+execSpecSuffix)
+				if err := ioutil.WriteFile(localPath, []byte(tt.spec), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			step := &agentendpointpb.ExecStep{LinuxExecStepConfig: &agentendpointpb.ExecStepConfig{Executable: &agentendpointpb.ExecStepConfig_LocalPath{LocalPath: localPath}}}
+			if err := tc.client.RunExecStep(ctx, &agentendpointpb.Task{TaskDetails: &agentendpointpb.Task_ExecStepTask{ExecStepTask: &agentendpointpb.ExecStepTask{ExecStep: step}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			want := &agentendpointpb.ReportTaskCompleteRequest{
+				TaskType:     agentendpointpb.TaskType_EXEC_STEP_TASK,
+				ErrorMessage: tt.wantMsg,
+				Output: &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+					ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{State: tt.wantState, ExitCode: -1},
+				},
+				InstanceIdToken: testIDToken,
+			}
+			if diff := cmp.Diff(want, srv.lastReportTaskCompleteRequest, protocmp.Transform()); diff != "" {
+				t.Errorf("ReportTaskCompleteRequest mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExecTaskResume(t *testing.T) {
+	ctx := context.Background()
+	srv := &agentEndpointServiceExecTestServer{}
+	tc, err := newTestClient(ctx, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.close()
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	execOutputDir = td
+	defer func() { execOutputDir = "" }()
+	taskStateFile = filepath.Join(td, "testState")
+	goos = "linux"
+
+	// The task is saved as running before the step runs.
+	var saved *savedTask
+	run = func(ctx context.Context, cmd *exec.Cmd) error {
+		st, err := loadState(taskStateFile)
+		if err != nil {
+			return err
+		}
+		saved = st.Task
+		return nil
+	}
+	step := &agentendpointpb.ExecStep{LinuxExecStepConfig: &agentendpointpb.ExecStepConfig{Executable: &agentendpointpb.ExecStepConfig_LocalPath{LocalPath: "foo"}}}
+	if err := tc.client.RunExecStep(ctx, &agentendpointpb.Task{TaskId: "foo", TaskDetails: &agentendpointpb.Task_ExecStepTask{ExecStepTask: &agentendpointpb.ExecStepTask{ExecStep: step}}}); err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || saved.TaskID != "foo" || saved.TaskType != agentendpointpb.TaskType_EXEC_STEP_TASK {
+		t.Fatalf("unexpected saved task: %+v", saved)
+	}
+
+	var e execTask
+	if err := json.Unmarshal(saved.State, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ExecStep != execRunning {
+		t.Errorf("saved ExecStep: got(%q) != want(%q)", e.ExecStep, execRunning)
+	}
+	if diff := cmp.Diff(step, e.Task.GetExecStep(), protocmp.Transform()); diff != "" {
+		t.Errorf("saved ExecStep mismatch (-want +got):\n%s", diff)
+	}
+
+	// A step that reboots the system itself is saved with the boot time
+	// before it runs.
+	boot := time.Date(2020, 10, 1, 8, 0, 0, 0, time.UTC)
+	systemBootTime = func() (time.Time, error) { return boot, nil }
+	defer func() { systemBootTime = bootTime }()
+	specPath := filepath.Join(td, "reboot"+execSpecSuffix)
+	if err := ioutil.WriteFile(specPath, []byte(`{"path": "foo", "reboot": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved = nil
+	step = &agentendpointpb.ExecStep{LinuxExecStepConfig: &agentendpointpb.ExecStepConfig{Executable: &agentendpointpb.ExecStepConfig_LocalPath{LocalPath: specPath}}}
+	if err := tc.client.RunExecStep(ctx, &agentendpointpb.Task{TaskId: "foo", TaskDetails: &agentendpointpb.Task_ExecStepTask{ExecStepTask: &agentendpointpb.ExecStepTask{ExecStep: step}}}); err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil {
+		t.Fatal("exec task not saved")
+	}
+	e = execTask{}
+	if err := json.Unmarshal(saved.State, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ExecStep != execRebootExpected || !e.BootTime.Equal(boot) {
+		t.Errorf("saved ExecStep and BootTime: got(%q, %s) != want(%q, %s)", e.ExecStep, e.BootTime, execRebootExpected, boot)
+	}
+
+	tests := []struct {
+		name         string
+		step         execStep
+		bootTime     time.Time
+		wantMsg      string
+		wantExitCode int32
+	}{
+		{"Interrupted", execRunning, time.Time{}, "Exec task interrupted by agent restart", -1},
+		{"Rebooted", execRebooting, time.Time{}, "", 0},
+		{"RebootedByStep", execRebootExpected, boot.Add(-time.Hour), "", 0},
+		{"RebootExpectedAgentRestart", execRebootExpected, boot.Add(time.Second), "Exec task interrupted by agent restart", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := json.Marshal(&execTask{TaskID: "foo", ExecStep: tt.step, BootTime: tt.bootTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.client.resumeTask(ctx, &savedTask{TaskID: "foo", TaskType: agentendpointpb.TaskType_EXEC_STEP_TASK, State: state}); err != nil {
+				t.Fatal(err)
+			}
+
+			want := &agentendpointpb.ReportTaskCompleteRequest{
+				TaskId:       "foo",
+				TaskType:     agentendpointpb.TaskType_EXEC_STEP_TASK,
+				ErrorMessage: tt.wantMsg,
+				Output: &agentendpointpb.ReportTaskCompleteRequest_ExecStepTaskOutput{
+					ExecStepTaskOutput: &agentendpointpb.ExecStepTaskOutput{State: agentendpointpb.ExecStepTaskOutput_COMPLETED, ExitCode: tt.wantExitCode},
+				},
+				InstanceIdToken: testIDToken,
+			}
+			if diff := cmp.Diff(want, srv.lastReportTaskCompleteRequest, protocmp.Transform()); diff != "" {
+				t.Errorf("ReportTaskCompleteRequest mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
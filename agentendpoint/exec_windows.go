@@ -0,0 +1,49 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group so it can be killed
+// along with anything it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	// taskkill /T kills the process tree rooted at the pid.
+	taskkill := filepath.Join(winRoot, `System32\taskkill.exe`)
+	if out, err := exec.Command(taskkill, "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).CombinedOutput(); err != nil {
+		return fmt.Errorf("error running taskkill: %v, out: %s", err, out)
+	}
+	return nil
+}
+
+func setUser(cmd *exec.Cmd, name string) error {
+	return fmt.Errorf("running exec steps as another user (%q) is not supported on Windows", name)
+}
+
+func chownToUser(path, name string) error {
+	return fmt.Errorf("running exec steps as another user (%q) is not supported on Windows", name)
+}
@@ -2,7 +2,10 @@ package agentendpoint
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
@@ -18,14 +21,19 @@ import (
 )
 
 const (
-	inventoryURL = agentconfig.ReportURL + "/guestInventory"
-	maxRetries   = 5
+	inventoryNamespace = "/guestInventory"
+	maxRetries         = 5
 )
 
 // ReportInventory reports inventory to agent endpoint and writes it to guest attributes.
 func (c *Client) ReportInventory(ctx context.Context) {
 	state := inventory.Get(ctx)
-	write(ctx, state, inventoryURL)
+	if agentconfig.MetadataDisabled() {
+		// There are no guest attributes without a metadata server.
+		writeLocal(ctx, state, agentconfig.InventoryFile())
+		return
+	}
+	write(ctx, state, agentconfig.GuestAttributesURL()+inventoryNamespace)
 
 	// Only enable reporting feature if prerelease feature flag is set.
 	if agentconfig.InventoryReportingEnabled() {
@@ -56,6 +64,23 @@ func write(ctx context.Context, state *inventory.InstanceInventory, url string)
 	}
 }
 
+func writeLocal(ctx context.Context, state *inventory.InstanceInventory, path string) {
+	clog.Debugf(ctx, "Writing instance inventory to %s.", path)
+
+	d, err := json.Marshal(state)
+	if err != nil {
+		clog.Errorf(ctx, "Error marshalling inventory: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		clog.Errorf(ctx, "Error writing inventory file: %v", err)
+		return
+	}
+	if err := writeFile(path, d); err != nil {
+		clog.Errorf(ctx, "Error writing inventory file: %v", err)
+	}
+}
+
 func (c *Client) report(ctx context.Context, state *inventory.InstanceInventory) {
 	clog.Debugf(ctx, "Reporting instance inventory to agent endpoint.")
 	inventory := formatInventory(ctx, state)
@@ -66,6 +91,8 @@ func (c *Client) report(ctx context.Context, state *inventory.InstanceInventory)
 		res, err := c.reportInventory(ctx, inventory, reportFull)
 		if err != nil {
 			clog.Errorf(ctx, "Error reporting inventory: %v", err)
+			c.queueInventoryChecksum(ctx, inventory)
+			return
 		}
 
 		if !res.GetReportFullInventory() {
@@ -80,6 +107,29 @@ func (c *Client) report(ctx context.Context, state *inventory.InstanceInventory)
 			break
 		}
 	}
+
+	// A queued checksum is older than the one just sent.
+	if err := removeQueuedReport(outboxInventory, outboxInventoryKey); err != nil {
+		clog.Errorf(ctx, "Error removing inventory checksum from the outbox: %v", err)
+	}
+	// The service is reachable, send anything else that is queued, this
+	// doesn't depend on task notifications being enabled.
+	c.replayOutbox(ctx)
+}
+
+// queueInventoryChecksum queues the checksum of inventory in the outbox, if
+// the service asks for the full inventory when it is sent the inventory is
+// reported again.
+func (c *Client) queueInventoryChecksum(ctx context.Context, inventory *agentendpointpb.Inventory) {
+	checksum, err := inventoryChecksum(inventory)
+	if err != nil {
+		clog.Errorf(ctx, "Error computing inventory checksum: %v", err)
+		return
+	}
+	req := &agentendpointpb.ReportInventoryRequest{InventoryChecksum: checksum}
+	if err := queueReport(outboxInventory, outboxInventoryKey, req); err != nil {
+		clog.Errorf(ctx, "Error saving inventory checksum to the outbox: %v", err)
+	}
 }
 
 func formatInventory(ctx context.Context, state *inventory.InstanceInventory) *agentendpointpb.Inventory {
@@ -0,0 +1,311 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/retryutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+// Reports that still fail once their API call is out of retries are saved to
+// the outbox and replayed when the agent starts, each time it reconnects to
+// the service and after each inventory report, so a network outage at the end of a task doesn't leave the
+// task running on the service side until it times out.
+const (
+	outboxComplete  = "ReportTaskComplete"
+	outboxProgress  = "ReportTaskProgress"
+	outboxInventory = "ReportInventory"
+
+	// outboxInventoryKey is the key for the inventory checksum, only the
+	// latest one is worth sending.
+	outboxInventoryKey = "inventory"
+	// outboxMaxAge is how long a report is kept before it is given up on.
+	outboxMaxAge = 7 * 24 * time.Hour
+	// outboxCallTimeout bounds each replayed call.
+	outboxCallTimeout = time.Minute
+)
+
+// outboxMx guards the outbox file, reports are queued from task and
+// inventory goroutines.
+var outboxMx sync.Mutex
+
+// outboxReplayMx keeps replays from overlapping, so a report isn't sent twice.
+var outboxReplayMx sync.Mutex
+
+type outboxEntry struct {
+	Kind string
+	// Key is the task ID, or outboxInventoryKey. There is at most one entry
+	// for each Kind and Key.
+	Key string
+	// Request is the request as protojson, without the identity token.
+	Request     json.RawMessage
+	Queued      time.Time
+	Attempts    int       `json:",omitempty"`
+	NextAttempt time.Time `json:",omitempty"`
+}
+
+type outbox struct {
+	Entries []*outboxEntry `json:",omitempty"`
+}
+
+// outboxFile is next to the task state file.
+func outboxFile() string {
+	return filepath.Join(filepath.Dir(stateFile()), "osconfig_outbox.state")
+}
+
+func loadOutbox() (*outbox, error) {
+	var o outbox
+	d, err := ioutil.ReadFile(outboxFile())
+	if os.IsNotExist(err) {
+		return &o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (o *outbox) save() error {
+	d, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outboxFile()), 0755); err != nil {
+		return err
+	}
+	return writeFile(outboxFile(), d)
+}
+
+// queueReport adds req to the outbox in place of any report of the same kind
+// for key. A task's completion also replaces its queued progress, which is
+// no longer of any use.
+func queueReport(kind, key string, req proto.Message) error {
+	req = proto.Clone(req)
+	m := req.ProtoReflect()
+	if fd := m.Descriptor().Fields().ByName("instance_id_token"); fd != nil {
+		// Tokens expire, a fresh one is fetched when the report is sent.
+		m.Clear(fd)
+	}
+	d, err := protojson.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	outboxMx.Lock()
+	defer outboxMx.Unlock()
+	o, err := loadOutbox()
+	if err != nil {
+		return err
+	}
+	var entries []*outboxEntry
+	for _, e := range o.Entries {
+		if e.Key == key && (e.Kind == kind || kind == outboxComplete && e.Kind == outboxProgress) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	o.Entries = append(entries, &outboxEntry{Kind: kind, Key: key, Request: d, Queued: time.Now()})
+	return o.save()
+}
+
+// queueFailedReport queues a report whose call failed with err. It returns
+// nil once the report is queued, and err if it can't be.
+func queueFailedReport(ctx context.Context, kind, key string, req proto.Message, err error) error {
+	if qErr := queueReport(kind, key, req); qErr != nil {
+		clog.Errorf(ctx, "Error saving %s for %s to the outbox: %v", kind, key, qErr)
+		return err
+	}
+	clog.Warningf(ctx, "%v, %s for %s will be sent again later.", err, kind, key)
+	return nil
+}
+
+// replayOutbox sends the queued reports that are due. Reports that are sent,
+// that the service rejects or that are older than outboxMaxAge are removed,
+// the rest are tried again with backoff. outboxMx is not held while reports
+// are sent, so reports can be queued in the meantime.
+func (c *Client) replayOutbox(ctx context.Context) {
+	outboxReplayMx.Lock()
+	defer outboxReplayMx.Unlock()
+
+	outboxMx.Lock()
+	o, err := loadOutbox()
+	outboxMx.Unlock()
+	if err != nil {
+		clog.Errorf(ctx, "Error loading outbox: %v", err)
+		return
+	}
+	if len(o.Entries) == 0 {
+		return
+	}
+	token, err := agentconfig.IDToken()
+	if err != nil {
+		clog.Warningf(ctx, "Not sending queued reports, error fetching Instance IDToken: %v", err)
+		return
+	}
+
+	now := time.Now()
+	var done, failed []*outboxEntry
+	for _, e := range o.Entries {
+		if now.Sub(e.Queued) > outboxMaxAge {
+			clog.Warningf(ctx, "Dropping %s for %s queued at %s, it is too old to send.", e.Kind, e.Key, e.Queued.Format(time.RFC3339))
+			done = append(done, e)
+			continue
+		}
+		if now.Before(e.NextAttempt) {
+			continue
+		}
+
+		err := c.sendQueuedReport(ctx, e, token)
+		if err == nil {
+			clog.Infof(ctx, "Sent %s for %s queued at %s.", e.Kind, e.Key, e.Queued.Format(time.RFC3339))
+			done = append(done, e)
+			continue
+		}
+		switch status.Code(err) {
+		case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.FailedPrecondition:
+			// Retrying won't help, most likely the service already has the
+			// report or has given up on the task.
+			clog.Warningf(ctx, "Dropping %s for %s, the service rejected it: %v", e.Kind, e.Key, err)
+			done = append(done, e)
+			continue
+		}
+		e.Attempts++
+		e.NextAttempt = now.Add(retryutil.RetrySleep(e.Attempts, 5))
+		clog.Warningf(ctx, "Error sending %s for %s, attempt %d, retrying after %s: %v", e.Kind, e.Key, e.Attempts, e.NextAttempt.Format(time.RFC3339), err)
+		failed = append(failed, e)
+	}
+
+	if len(done) == 0 && len(failed) == 0 {
+		return
+	}
+	if err := updateOutbox(done, failed); err != nil {
+		clog.Errorf(ctx, "Error saving outbox: %v", err)
+	}
+}
+
+// updateOutbox removes the done entries and saves the failed ones with their
+// new attempt counts. Entries replaced while they were being sent are left as
+// they are.
+func updateOutbox(done, failed []*outboxEntry) error {
+	outboxMx.Lock()
+	defer outboxMx.Unlock()
+	o, err := loadOutbox()
+	if err != nil {
+		return err
+	}
+	var entries []*outboxEntry
+Entries:
+	for _, e := range o.Entries {
+		for _, d := range done {
+			if sameOutboxEntry(e, d) {
+				continue Entries
+			}
+		}
+		for _, f := range failed {
+			if sameOutboxEntry(e, f) {
+				e = f
+			}
+		}
+		entries = append(entries, e)
+	}
+	o.Entries = entries
+	return o.save()
+}
+
+func sameOutboxEntry(a, b *outboxEntry) bool {
+	return a.Kind == b.Kind && a.Key == b.Key && a.Queued.Equal(b.Queued)
+}
+
+// removeQueuedReport removes the queued report of kind for key, used once a
+// newer report has been sent in its place.
+func removeQueuedReport(kind, key string) error {
+	outboxMx.Lock()
+	defer outboxMx.Unlock()
+	o, err := loadOutbox()
+	if err != nil {
+		return err
+	}
+	var entries []*outboxEntry
+	for _, e := range o.Entries {
+		if e.Kind == kind && e.Key == key {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == len(o.Entries) {
+		return nil
+	}
+	o.Entries = entries
+	return o.save()
+}
+
+func (c *Client) sendQueuedReport(ctx context.Context, e *outboxEntry, token string) error {
+	cctx, cancel := context.WithTimeout(ctx, outboxCallTimeout)
+	defer cancel()
+
+	switch e.Kind {
+	case outboxComplete:
+		req := &agentendpointpb.ReportTaskCompleteRequest{}
+		if err := protojson.Unmarshal(e.Request, req); err != nil {
+			return status.Errorf(codes.InvalidArgument, "error parsing queued report: %v", err)
+		}
+		req.InstanceIdToken = token
+		_, err := c.raw.ReportTaskComplete(cctx, req)
+		return err
+	case outboxProgress:
+		req := &agentendpointpb.ReportTaskProgressRequest{}
+		if err := protojson.Unmarshal(e.Request, req); err != nil {
+			return status.Errorf(codes.InvalidArgument, "error parsing queued report: %v", err)
+		}
+		req.InstanceIdToken = token
+		// The task has moved on, any directive is for a state it has left.
+		_, err := c.raw.ReportTaskProgress(cctx, req)
+		return err
+	case outboxInventory:
+		req := &agentendpointpb.ReportInventoryRequest{}
+		if err := protojson.Unmarshal(e.Request, req); err != nil {
+			return status.Errorf(codes.InvalidArgument, "error parsing queued report: %v", err)
+		}
+		req.InstanceIdToken = token
+		res, err := c.raw.ReportInventory(cctx, req)
+		if err != nil {
+			return err
+		}
+		if res.GetReportFullInventory() {
+			// Only the checksum is queued, collect and report the inventory again.
+			go c.ReportInventory(ctx)
+		}
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "unknown report kind %q", e.Kind)
+}
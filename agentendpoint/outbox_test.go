@@ -0,0 +1,214 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentendpoint/agentendpointtest"
+	"github.com/GoogleCloudPlatform/osconfig/inventory"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+func outboxEntries(t *testing.T) []*outboxEntry {
+	t.Helper()
+	o, err := loadOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.Entries
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+
+	srv := agentendpointtest.NewServer()
+	defer srv.Close()
+	opts, err := srv.ClientOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Queued progress is replaced by the task's completion, and tokens are
+	// not saved.
+	if err := queueReport(outboxProgress, "foo", &agentendpointpb.ReportTaskProgressRequest{TaskId: "foo", InstanceIdToken: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.QueueErrors(agentendpointtest.ReportTaskComplete, status.Error(codes.PermissionDenied, "down"))
+	complete := &agentendpointpb.ReportTaskCompleteRequest{TaskId: "foo", ErrorMessage: "failed"}
+	if err := client.reportTaskComplete(ctx, complete); err != nil {
+		t.Fatalf("reportTaskComplete should queue the report, got: %v", err)
+	}
+	entries := outboxEntries(t)
+	if len(entries) != 1 || entries[0].Kind != outboxComplete || entries[0].Key != "foo" {
+		t.Fatalf("unexpected outbox entries: %+v", entries)
+	}
+	d, err := ioutil.ReadFile(outboxFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(d), testIDToken) || strings.Contains(string(d), "secret") {
+		t.Errorf("outbox contains an identity token: %s", d)
+	}
+
+	// A failed replay is retried with backoff.
+	srv.QueueErrors(agentendpointtest.ReportTaskComplete, status.Error(codes.PermissionDenied, "still down"))
+	client.replayOutbox(ctx)
+	entries = outboxEntries(t)
+	if len(entries) != 1 || entries[0].Attempts != 1 || !entries[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("unexpected outbox entries after a failed replay: %+v", entries)
+	}
+	calls := len(srv.CompleteReports())
+	client.replayOutbox(ctx)
+	if got := len(srv.CompleteReports()); got != calls {
+		t.Errorf("replayOutbox sent a report before it was due")
+	}
+
+	entries[0].NextAttempt = time.Time{}
+	if err := (&outbox{Entries: entries}).save(); err != nil {
+		t.Fatal(err)
+	}
+	client.replayOutbox(ctx)
+	if entries := outboxEntries(t); len(entries) != 0 {
+		t.Errorf("outbox not empty after a successful replay: %+v", entries)
+	}
+	reports := srv.CompleteReports()
+	want := &agentendpointpb.ReportTaskCompleteRequest{TaskId: "foo", ErrorMessage: "failed", InstanceIdToken: testIDToken}
+	if diff := cmp.Diff(want, reports[len(reports)-1], protocmp.Transform()); diff != "" {
+		t.Errorf("replayed ReportTaskComplete mismatch (-want +got):\n%s", diff)
+	}
+
+	// Reports the service rejects are dropped.
+	if err := queueReport(outboxComplete, "bar", &agentendpointpb.ReportTaskCompleteRequest{TaskId: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.QueueErrors(agentendpointtest.ReportTaskComplete, status.Error(codes.FailedPrecondition, "task already complete"))
+	client.replayOutbox(ctx)
+	if entries := outboxEntries(t); len(entries) != 0 {
+		t.Errorf("outbox not empty after a rejected replay: %+v", entries)
+	}
+}
+
+func TestOutboxInventoryReport(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+
+	srv := agentendpointtest.NewServer()
+	defer srv.Close()
+	opts, err := srv.ClientOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A failed inventory report queues its checksum.
+	srv.QueueErrors(agentendpointtest.ReportInventory, status.Error(codes.Unavailable, "down"))
+	client.report(ctx, &inventory.InstanceInventory{Hostname: "old"})
+	entries := outboxEntries(t)
+	if len(entries) != 1 || entries[0].Kind != outboxInventory {
+		t.Fatalf("unexpected outbox entries: %+v", entries)
+	}
+	if err := queueReport(outboxComplete, "foo", &agentendpointpb.ReportTaskCompleteRequest{TaskId: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A successful report supersedes the queued checksum and sends the rest
+	// of the outbox.
+	calls := len(srv.InventoryReports())
+	client.report(ctx, &inventory.InstanceInventory{Hostname: "new"})
+	if entries := outboxEntries(t); len(entries) != 0 {
+		t.Errorf("outbox not empty after a successful inventory report: %+v", entries)
+	}
+	if got := len(srv.InventoryReports()) - calls; got != 1 {
+		t.Errorf("inventory reports sent: got(%d) != want(1), the stale checksum should not be replayed", got)
+	}
+	reports := srv.CompleteReports()
+	if len(reports) != 1 || reports[0].GetTaskId() != "foo" {
+		t.Errorf("queued ReportTaskComplete not replayed: %+v", reports)
+	}
+}
+
+func TestUpdateOutbox(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+
+	if err := queueReport(outboxComplete, "foo", &agentendpointpb.ReportTaskCompleteRequest{TaskId: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueReport(outboxProgress, "bar", &agentendpointpb.ReportTaskProgressRequest{TaskId: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	sent := outboxEntries(t)
+
+	// Reports queued while the old ones were being sent are kept.
+	if err := queueReport(outboxProgress, "bar", &agentendpointpb.ReportTaskProgressRequest{TaskId: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueReport(outboxComplete, "baz", &agentendpointpb.ReportTaskCompleteRequest{TaskId: "baz"}); err != nil {
+		t.Fatal(err)
+	}
+	sent[1].Attempts = 1
+	if err := updateOutbox(sent[:1], sent[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := outboxEntries(t)
+	if len(entries) != 2 {
+		t.Fatalf("unexpected outbox entries: %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Key == "foo" {
+			t.Errorf("sent report for foo still queued")
+		}
+		if e.Attempts != 0 {
+			t.Errorf("%s for %s: replaced entry got the failed attempt of the old one", e.Kind, e.Key)
+		}
+	}
+}
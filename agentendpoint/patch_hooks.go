@@ -0,0 +1,102 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+)
+
+// Patch hooks are executables in the pre and post directories under
+// agentconfig.PatchHooksDir. Pre hooks run before a patch task makes any
+// change and a non-zero exit fails the task, post hooks run once patching,
+// and any reboot, is done. Hooks run one at a time in name order.
+const (
+	preHooks  = "pre"
+	postHooks = "post"
+)
+
+// patchHooksDir is replaced in tests.
+var patchHooksDir = agentconfig.PatchHooksDir
+
+// hookCommand returns the command to run a hook, or nil if the file is not
+// one.
+func hookCommand(path string, fi os.FileInfo) *execCommand {
+	if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+		return nil
+	}
+	if goos != "windows" {
+		if fi.Mode()&0111 == 0 {
+			return nil
+		}
+		return &execCommand{path: path}
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".exe":
+		return &execCommand{path: path}
+	case ".cmd", ".bat":
+		return &execCommand{path: winCmd, args: []string{"/c", path}}
+	case ".ps1":
+		return &execCommand{path: winPowershell, args: append(winPowershellArgs, "-File", path)}
+	}
+	return nil
+}
+
+// runHooks runs the hooks in the kind directory, stopping at the first one
+// to fail.
+func (r *patchTask) runHooks(ctx context.Context, kind string) error {
+	dir := filepath.Join(patchHooksDir(), kind)
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading hook directory: %v", err)
+	}
+
+	env := []string{
+		"OSCONFIG_TASK_ID=" + r.TaskID,
+		"OSCONFIG_DRY_RUN=" + strconv.FormatBool(r.Task.GetDryRun()),
+		"OSCONFIG_PATCH_STEP=" + string(r.PatchStep),
+	}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		c := hookCommand(path, fi)
+		if c == nil {
+			clog.Debugf(ctx, "Skipping %s, it is not a hook.", path)
+			continue
+		}
+		c.env = env
+
+		clog.Infof(ctx, "Running %s patch hook %s", kind, path)
+		out := newOutputBuffer(execOutputTail)
+		exitCode, err := executeCommand(ctx, c, out)
+		if err != nil {
+			return fmt.Errorf("%s patch hook %s: %v", kind, path, err)
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("%s patch hook %s exited with %d, output:\n%s", kind, path, exitCode, out.Bytes())
+		}
+	}
+	return nil
+}
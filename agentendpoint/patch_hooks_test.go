@@ -0,0 +1,99 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts in this test are shell scripts")
+	}
+	ctx := context.Background()
+	goos = runtime.GOOS
+	run = func(ctx context.Context, cmd *exec.Cmd) error {
+		return cmd.Run()
+	}
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	patchHooksDir = func() string { return td }
+	defer func() { patchHooksDir = agentconfig.PatchHooksDir }()
+
+	envFile := filepath.Join(td, "env")
+	pre := filepath.Join(td, preHooks)
+	if err := os.MkdirAll(pre, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hooks := map[string]string{
+		"10-env":    "#!/bin/sh\nenv > " + envFile + "\n",
+		"20-fail":   "#!/bin/sh\necho draining failed\nexit 3\n",
+		"30-never":  "#!/bin/sh\ntouch " + filepath.Join(td, "ran") + "\n",
+		"README.md": "not a hook, it is not executable",
+	}
+	for name, content := range hooks {
+		mode := os.FileMode(0755)
+		if name == "README.md" {
+			mode = 0644
+		}
+		if err := ioutil.WriteFile(filepath.Join(pre, name), []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &patchTask{
+		TaskID:    "foo",
+		PatchStep: prePatch,
+		Task:      &applyPatchesTask{&agentendpointpb.ApplyPatchesTask{DryRun: true}},
+	}
+
+	// A missing directory means no hooks.
+	if err := r.runHooks(ctx, postHooks); err != nil {
+		t.Errorf("runHooks with no hooks: unexpected error: %v", err)
+	}
+
+	err = r.runHooks(ctx, preHooks)
+	if err == nil || !strings.Contains(err.Error(), "20-fail exited with 3") || !strings.Contains(err.Error(), "draining failed") {
+		t.Errorf("runHooks: got err %v, want failure from 20-fail with its output", err)
+	}
+	if _, err := os.Stat(filepath.Join(td, "ran")); err == nil {
+		t.Error("expected hooks after a failed hook to not run")
+	}
+
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"OSCONFIG_TASK_ID=foo", "OSCONFIG_DRY_RUN=true", "OSCONFIG_PATCH_STEP=PrePatch"} {
+		if !strings.Contains(string(env), want+"\n") {
+			t.Errorf("hook environment missing %q, got:\n%s", want, env)
+		}
+	}
+}
@@ -33,6 +33,9 @@ func (r *patchTask) runUpdates(ctx context.Context) error {
 	const retryPeriod = 3 * time.Minute
 	// Check for both apt-get and dpkg-query to give us a clean signal.
 	if packages.AptExists && packages.DpkgQueryExists {
+		if err := r.checkCanceled(ctx); err != nil {
+			return err
+		}
 		opts := []ospatch.AptGetUpgradeOption{
 			ospatch.AptGetDryRun(r.Task.GetDryRun()),
 			ospatch.AptGetExcludes(r.Task.GetPatchConfig().GetApt().GetExcludes()),
@@ -43,11 +46,20 @@ func (r *patchTask) runUpdates(ctx context.Context) error {
 			opts = append(opts, ospatch.AptGetUpgradeType(packages.AptGetDistUpgrade))
 		}
 		clog.Debugf(ctx, "Installing APT package updates.")
-		if err := retryutil.RetryFunc(ctx, retryPeriod, "installing APT package updates", func() error { return ospatch.RunAptGetUpgrade(ctx, opts...) }); err != nil {
+		var results []ospatch.PackageResult
+		err := retryutil.RetryFunc(ctx, retryPeriod, "installing APT package updates", func() (err error) {
+			results, err = ospatch.RunAptGetUpgrade(ctx, opts...)
+			return err
+		})
+		r.addResults(ctx, results)
+		if err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
 	if packages.YumExists && packages.RPMQueryExists {
+		if err := r.checkCanceled(ctx); err != nil {
+			return err
+		}
 		opts := []ospatch.YumUpdateOption{
 			ospatch.YumUpdateSecurity(r.Task.GetPatchConfig().GetYum().GetSecurity()),
 			ospatch.YumUpdateMinimal(r.Task.GetPatchConfig().GetYum().GetMinimal()),
@@ -56,11 +68,20 @@ func (r *patchTask) runUpdates(ctx context.Context) error {
 			ospatch.YumDryRun(r.Task.GetDryRun()),
 		}
 		clog.Debugf(ctx, "Installing YUM package updates.")
-		if err := retryutil.RetryFunc(ctx, retryPeriod, "installing YUM package updates", func() error { return ospatch.RunYumUpdate(ctx, opts...) }); err != nil {
+		var results []ospatch.PackageResult
+		err := retryutil.RetryFunc(ctx, retryPeriod, "installing YUM package updates", func() (err error) {
+			results, err = ospatch.RunYumUpdate(ctx, opts...)
+			return err
+		})
+		r.addResults(ctx, results)
+		if err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
 	if packages.ZypperExists && packages.RPMQueryExists {
+		if err := r.checkCanceled(ctx); err != nil {
+			return err
+		}
 		opts := []ospatch.ZypperPatchOption{
 			ospatch.ZypperPatchCategories(r.Task.GetPatchConfig().GetZypper().GetCategories()),
 			ospatch.ZypperPatchSeverities(r.Task.GetPatchConfig().GetZypper().GetSeverities()),
@@ -71,7 +92,13 @@ func (r *patchTask) runUpdates(ctx context.Context) error {
 			ospatch.ZypperUpdateDryrun(r.Task.GetDryRun()),
 		}
 		clog.Debugf(ctx, "Installing Zypper updates.")
-		if err := retryutil.RetryFunc(ctx, retryPeriod, "installing Zypper updates", func() error { return ospatch.RunZypperPatch(ctx, opts...) }); err != nil {
+		var results []ospatch.PackageResult
+		err := retryutil.RetryFunc(ctx, retryPeriod, "installing Zypper updates", func() (err error) {
+			results, err = ospatch.RunZypperPatch(ctx, opts...)
+			return err
+		})
+		r.addResults(ctx, results)
+		if err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
@@ -0,0 +1,99 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/ospatch"
+)
+
+// patchResultsDir overrides agentconfig.PatchResultsDir when set.
+var patchResultsDir string
+
+func resultsDir() string {
+	if patchResultsDir != "" {
+		return patchResultsDir
+	}
+	return agentconfig.PatchResultsDir()
+}
+
+// patchResultsFile is where the results of the task are saved.
+func patchResultsFile(taskID string) string {
+	return filepath.Join(resultsDir(), taskFileName(taskID, ".json"))
+}
+
+// outcomeCanceled is the outcome of a task stopped by the service. The API
+// has no canceled state for patch tasks so the service is told the task
+// FAILED, the results file tells the two apart.
+const outcomeCanceled = "CANCELED"
+
+// patchResults is the content of the results file.
+type patchResults struct {
+	TaskID string
+	// Outcome is the final state of the task, set once it completes.
+	Outcome string `json:",omitempty"`
+	// Step is the step the task completed in.
+	Step  patchStep `json:",omitempty"`
+	Error string    `json:",omitempty"`
+	// Attempts is the number of failed attempts to apply patches and
+	// LastError why the last one failed.
+	Attempts  int                     `json:",omitempty"`
+	LastError string                  `json:",omitempty"`
+	Packages  []ospatch.PackageResult `json:",omitempty"`
+}
+
+// writeResults saves the package results so far and the outcome, empty while
+// the task is running, to the results file.
+func (r *patchTask) writeResults(ctx context.Context, outcome, errMsg string) {
+	res := &patchResults{
+		TaskID:    r.TaskID,
+		Outcome:   outcome,
+		Step:      r.PatchStep,
+		Error:     errMsg,
+		Attempts:  r.Attempts,
+		LastError: r.LastError,
+		Packages:  r.PackageResults,
+	}
+	d, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		clog.Errorf(ctx, "Error marshaling patch results: %v", err)
+		return
+	}
+	if err := saveTaskFile(ctx, resultsDir(), patchResultsFile(r.TaskID), d); err != nil {
+		clog.Errorf(ctx, "Error saving patch results: %v", err)
+	}
+}
+
+// addResults records the results of a package manager run in the task state
+// and the task's results file, and logs them.
+func (r *patchTask) addResults(ctx context.Context, results []ospatch.PackageResult) {
+	if len(results) == 0 {
+		return
+	}
+	for _, res := range results {
+		clog.Infof(ctx, "Package %s %s: %q -> %q %s", res.Name, res.Arch, res.OldVersion, res.NewVersion, res.State)
+	}
+	r.PackageResults = append(r.PackageResults, results...)
+
+	if err := r.saveState(); err != nil {
+		clog.Errorf(ctx, "Error saving state: %v", err)
+	}
+	r.writeResults(ctx, "", "")
+}
@@ -0,0 +1,133 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/osconfig/ospatch"
+	"github.com/google/go-cmp/cmp"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+func TestAddResults(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+	patchResultsDir = filepath.Join(td, "results")
+	defer func() { patchResultsDir = "" }()
+
+	r := &patchTask{TaskID: "foo", task: &Task{id: "foo"}}
+	apt := []ospatch.PackageResult{{Name: "foo", OldVersion: "1", TargetVersion: "2", NewVersion: "2", State: ospatch.PackageUpdated}}
+	zypper := []ospatch.PackageResult{{Name: "SUSE-1", Patch: true, State: ospatch.PackageFailed, Error: "broken"}}
+	r.addResults(ctx, apt)
+	r.addResults(ctx, nil)
+	r.addResults(ctx, zypper)
+	want := append(apt, zypper...)
+
+	// Results are saved in the task state...
+	st, err := loadState(taskStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved patchTask
+	if err := json.Unmarshal(st.Task.State, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, saved.PackageResults); diff != "" {
+		t.Errorf("saved PackageResults mismatch (-want +got):\n%s", diff)
+	}
+
+	// ...and in the results file.
+	d, err := ioutil.ReadFile(patchResultsFile("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got patchResults
+	if err := json.Unmarshal(d, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&patchResults{TaskID: "foo", Packages: want}, &got); diff != "" {
+		t.Errorf("results file mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPatchTaskCanceled(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+	patchResultsDir = filepath.Join(td, "results")
+	defer func() { patchResultsDir = "" }()
+
+	tests := []struct {
+		name        string
+		directive   agentendpointpb.TaskDirective
+		wantErr     error
+		wantOutcome string
+	}{
+		{"Continue", agentendpointpb.TaskDirective_CONTINUE, nil, "FAILED"},
+		{"Stop", agentendpointpb.TaskDirective_STOP, errServerCancel, outcomeCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &agentEndpointServiceExecTestServer{progressDirective: tt.directive}
+			tc, err := newTestClient(ctx, srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tc.close()
+
+			r := &patchTask{TaskID: tt.name, PatchStep: patching, task: tc.client.newTask(agentendpointpb.TaskType_APPLY_PATCHES, tt.name, nil)}
+			err = r.checkCanceled(ctx)
+			if err != tt.wantErr {
+				t.Fatalf("checkCanceled: got %v, want %v", err, tt.wantErr)
+			}
+			if err := r.handleErrorState(ctx, "apt failed", err); err != nil {
+				t.Fatal(err)
+			}
+
+			// The service only knows FAILED, the results file tells a
+			// cancel from a failure.
+			if got := srv.lastReportTaskCompleteRequest.GetApplyPatchesTaskOutput().GetState(); got != agentendpointpb.ApplyPatchesTaskOutput_FAILED {
+				t.Errorf("reported state: got %s, want %s", got, agentendpointpb.ApplyPatchesTaskOutput_FAILED)
+			}
+			d, err := ioutil.ReadFile(patchResultsFile(tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got patchResults
+			if err := json.Unmarshal(d, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Outcome != tt.wantOutcome || got.Step != patching {
+				t.Errorf("results file: got Outcome %q Step %q, want %q %q", got.Outcome, got.Step, tt.wantOutcome, patching)
+			}
+		})
+	}
+}
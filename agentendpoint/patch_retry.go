@@ -0,0 +1,120 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+)
+
+// patchRetries, patchRetryBackoff and patchRetryCheckInterval are replaced
+// in tests.
+var (
+	patchRetries      = agentconfig.PatchRetries
+	patchRetryBackoff = agentconfig.PatchRetryBackoff
+	// patchRetryCheckInterval is how often progress is reported, and a STOP
+	// from the service looked for, while waiting to retry.
+	patchRetryCheckInterval = 30 * time.Second
+)
+
+// patchRetryMaxBackoff caps the doubling of patchRetryBackoff.
+const patchRetryMaxBackoff = time.Hour
+
+// retryDelay is the wait before retry number attempt, starting at 1. It
+// doubles from patchRetryBackoff up to patchRetryMaxBackoff with up to 10%
+// jitter added so tasks on many instances don't retry in step.
+func retryDelay(attempt int) time.Duration {
+	base := patchRetryBackoff()
+	d := base
+	for i := 1; i < attempt && d < patchRetryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > patchRetryMaxBackoff && base < patchRetryMaxBackoff {
+		d = patchRetryMaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return d + time.Duration(rnd.Int63n(int64(d)/10+1))
+}
+
+// scheduleRetry records a failed attempt to apply patches and when to try
+// again in the task state, so the schedule survives an agent restart. It
+// returns false once the task is out of retries.
+func (r *patchTask) scheduleRetry(ctx context.Context, err error) bool {
+	if r.Attempts >= patchRetries() {
+		return false
+	}
+	r.Attempts++
+	r.NextAttempt = time.Now().Add(retryDelay(r.Attempts))
+	r.LastError = err.Error()
+	clog.Warningf(ctx, "Failed to apply patches, retry %d of %d at %s: %v", r.Attempts, patchRetries(), r.NextAttempt.Format(time.RFC3339), err)
+	if err := r.saveState(); err != nil {
+		clog.Errorf(ctx, "Error saving state: %v", err)
+	}
+	r.writeResults(ctx, "", "")
+	return true
+}
+
+// waitForRetry waits until the next attempt scheduled by scheduleRetry, if
+// any. After a restart this is the time left from before the restart. The
+// wait is broken up so that progress is still reported, errServerCancel is
+// returned if the service asks for the task to be stopped.
+func (r *patchTask) waitForRetry(ctx context.Context) error {
+	d := time.Until(r.NextAttempt)
+	if d <= 0 {
+		return nil
+	}
+	clog.Infof(ctx, "Waiting %s before retrying to apply patches.", d.Round(time.Second))
+	for {
+		if err := r.checkCanceled(ctx); err != nil {
+			return err
+		}
+		d := time.Until(r.NextAttempt)
+		if d <= 0 {
+			return nil
+		}
+		if d > patchRetryCheckInterval {
+			d = patchRetryCheckInterval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+}
+
+// startRetry drops the results of the failed attempt once a scheduled retry
+// is due, so only the last attempt of a retried run is kept. Results only
+// come from the patching step so all of them belong to the failed attempt.
+// NextAttempt is cleared so resuming the retry after a reboot keeps its
+// results.
+func (r *patchTask) startRetry(ctx context.Context) {
+	if r.NextAttempt.IsZero() {
+		return
+	}
+	r.NextAttempt = time.Time{}
+	r.PackageResults = nil
+	if err := r.saveState(); err != nil {
+		clog.Errorf(ctx, "Error saving state: %v", err)
+	}
+	r.writeResults(ctx, "", "")
+}
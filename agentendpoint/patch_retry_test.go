@@ -0,0 +1,207 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/ospatch"
+	"github.com/google/go-cmp/cmp"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+func TestRetryDelay(t *testing.T) {
+	patchRetryBackoff = func() time.Duration { return 10 * time.Minute }
+	defer func() { patchRetryBackoff = agentconfig.PatchRetryBackoff }()
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Minute},
+		{2, 20 * time.Minute},
+		{3, 40 * time.Minute},
+		{4, patchRetryMaxBackoff},
+		{10, patchRetryMaxBackoff},
+	}
+	for _, tt := range tests {
+		got := retryDelay(tt.attempt)
+		if got < tt.want || got > tt.want+tt.want/10 {
+			t.Errorf("retryDelay(%d) = %s, want between %s and %s", tt.attempt, got, tt.want, tt.want+tt.want/10)
+		}
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+	patchResultsDir = filepath.Join(td, "results")
+	defer func() { patchResultsDir = "" }()
+	patchRetries = func() int { return 2 }
+	patchRetryBackoff = func() time.Duration { return time.Hour }
+	defer func() {
+		patchRetries = agentconfig.PatchRetries
+		patchRetryBackoff = agentconfig.PatchRetryBackoff
+	}()
+
+	r := &patchTask{TaskID: "foo", task: &Task{id: "foo"}}
+	for i := 1; i <= 2; i++ {
+		if !r.scheduleRetry(ctx, errors.New("apt is locked")) {
+			t.Fatalf("scheduleRetry %d: got false, want a retry", i)
+		}
+	}
+	if r.scheduleRetry(ctx, errors.New("apt is locked")) {
+		t.Error("scheduleRetry: got true, want no retries left")
+	}
+
+	// The schedule is in the task state so it is kept across a restart.
+	st, err := loadState(taskStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved patchTask
+	if err := json.Unmarshal(st.Task.State, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Attempts != 2 || saved.LastError != "apt is locked" {
+		t.Errorf("saved Attempts = %d, LastError = %q, want 2 and %q", saved.Attempts, saved.LastError, "apt is locked")
+	}
+	if !saved.NextAttempt.Equal(r.NextAttempt) || time.Until(saved.NextAttempt) < time.Hour {
+		t.Errorf("saved NextAttempt = %s, want %s, at least an hour away", saved.NextAttempt, r.NextAttempt)
+	}
+
+	// So are the attempts in the results file.
+	d, err := ioutil.ReadFile(patchResultsFile("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res patchResults
+	if err := json.Unmarshal(d, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Attempts != 2 || res.LastError != "apt is locked" {
+		t.Errorf("results file Attempts = %d, LastError = %q, want 2 and %q", res.Attempts, res.LastError, "apt is locked")
+	}
+}
+
+func TestWaitForRetry(t *testing.T) {
+	ctx := context.Background()
+	patchRetryCheckInterval = time.Millisecond
+	defer func() { patchRetryCheckInterval = 30 * time.Second }()
+
+	// Nothing is reported if the retry is already due.
+	if err := (&patchTask{NextAttempt: time.Now().Add(-time.Minute)}).waitForRetry(ctx); err != nil {
+		t.Errorf("waitForRetry with a past NextAttempt: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		directive   agentendpointpb.TaskDirective
+		nextAttempt time.Duration
+		timeout     time.Duration
+		wantErr     error
+	}{
+		// A resumed task waits for the time left.
+		{"Waits", agentendpointpb.TaskDirective_CONTINUE, time.Hour, 10 * time.Millisecond, context.DeadlineExceeded},
+		{"Done", agentendpointpb.TaskDirective_CONTINUE, 20 * time.Millisecond, time.Hour, nil},
+		// The service can stop the task while it waits.
+		{"Stop", agentendpointpb.TaskDirective_STOP, time.Hour, time.Hour, errServerCancel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &agentEndpointServiceExecTestServer{progressDirective: tt.directive}
+			tc, err := newTestClient(ctx, srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tc.close()
+
+			r := &patchTask{TaskID: tt.name, PatchStep: patching, NextAttempt: time.Now().Add(tt.nextAttempt), task: tc.client.newTask(agentendpointpb.TaskType_APPLY_PATCHES, tt.name, nil)}
+			cctx, cancel := context.WithTimeout(ctx, tt.timeout)
+			defer cancel()
+			if err := r.waitForRetry(cctx); err != tt.wantErr {
+				t.Errorf("waitForRetry: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStartRetry(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+	patchResultsDir = filepath.Join(td, "results")
+	defer func() { patchResultsDir = "" }()
+	patchRetries = func() int { return 2 }
+	patchRetryBackoff = func() time.Duration { return 0 }
+	defer func() {
+		patchRetries = agentconfig.PatchRetries
+		patchRetryBackoff = agentconfig.PatchRetryBackoff
+	}()
+
+	foo := ospatch.PackageResult{Name: "foo", OldVersion: "1", TargetVersion: "2", State: ospatch.PackageFailed, Error: "locked"}
+	fooUpdated := ospatch.PackageResult{Name: "foo", OldVersion: "1", TargetVersion: "2", NewVersion: "2", State: ospatch.PackageUpdated}
+	bar := ospatch.PackageResult{Name: "bar", OldVersion: "1", TargetVersion: "2", NewVersion: "2", State: ospatch.PackageUpdated}
+
+	r := &patchTask{TaskID: "foo", PatchStep: patching, task: &Task{id: "foo"}}
+	r.addResults(ctx, []ospatch.PackageResult{foo})
+	if !r.scheduleRetry(ctx, errors.New("apt is locked")) {
+		t.Fatal("scheduleRetry: got false, want a retry")
+	}
+
+	// The retry replaces the results of the failed attempt.
+	r.startRetry(ctx)
+	r.addResults(ctx, []ospatch.PackageResult{fooUpdated})
+	// Resuming after a reboot during the retry keeps what it did so far.
+	r.startRetry(ctx)
+	r.addResults(ctx, []ospatch.PackageResult{bar})
+
+	want := []ospatch.PackageResult{fooUpdated, bar}
+	if diff := cmp.Diff(want, r.PackageResults); diff != "" {
+		t.Errorf("PackageResults mismatch (-want +got):\n%s", diff)
+	}
+	d, err := ioutil.ReadFile(patchResultsFile("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res patchResults
+	if err := json.Unmarshal(d, &res); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, res.Packages); diff != "" {
+		t.Errorf("results file Packages mismatch (-want +got):\n%s", diff)
+	}
+	if res.Attempts != 1 || res.LastError != "apt is locked" {
+		t.Errorf("results file Attempts = %d, LastError = %q, want 1 and %q", res.Attempts, res.LastError, "apt is locked")
+	}
+}
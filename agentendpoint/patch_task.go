@@ -16,6 +16,7 @@ package agentendpoint
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -40,26 +41,34 @@ const (
 )
 
 type patchTask struct {
-	client *Client
+	task *Task
 
 	lastProgressState map[agentendpointpb.ApplyPatchesTaskProgress_State]time.Time
+	// canceled is set when the service told us to stop.
+	canceled bool
 
 	TaskID      string
 	Task        *applyPatchesTask
 	StartedAt   time.Time `json:",omitempty"`
 	PatchStep   patchStep `json:",omitempty"`
 	RebootCount int
-	// TODO add Attempts and track number of retries with backoff, jitter, etc.
+	// RebootDeferred is set when a reboot was skipped because we are outside
+	// of a maintenance window, it is saved so the task still reports that a
+	// reboot is required if the agent restarts before it completes.
+	RebootDeferred bool `json:",omitempty"`
+	// PackageResults are the results of each package manager run so far,
+	// only the last attempt of a retried run is kept.
+	PackageResults []ospatch.PackageResult `json:",omitempty"`
+	// Attempts is the number of failed attempts to apply patches,
+	// NextAttempt is when to try again, zero once the retry has started, and
+	// LastError why the last one failed.
+	Attempts    int       `json:",omitempty"`
+	NextAttempt time.Time `json:",omitempty"`
+	LastError   string    `json:",omitempty"`
 }
 
 func (r *patchTask) saveState() error {
-	return (&taskState{PatchTask: r}).save(taskStateFile)
-}
-
-func (r *patchTask) complete(ctx context.Context) {
-	if err := (&taskState{}).save(taskStateFile); err != nil {
-		clog.Errorf(ctx, "Error saving state: %v", err)
-	}
+	return r.task.SaveState(r)
 }
 
 type applyPatchesTask struct {
@@ -102,21 +111,42 @@ func (r *patchTask) reportFailed(ctx context.Context, msg string) error {
 }
 
 func (r *patchTask) reportCanceled(ctx context.Context) error {
-	clog.Infof(ctx, "Canceling patch execution")
+	clog.Infof(ctx, "Canceling patch execution, the service sent a stop directive during step %q", r.PatchStep)
+	r.canceled = true
+	// There is no canceled state, the results file records the task as
+	// canceled rather than failed.
 	return r.reportCompletedState(ctx, errServerCancel.Error(), &agentendpointpb.ReportTaskCompleteRequest_ApplyPatchesTaskOutput{
-		// Is this right? Maybe there should be a canceled state instead.
 		ApplyPatchesTaskOutput: &agentendpointpb.ApplyPatchesTaskOutput{State: agentendpointpb.ApplyPatchesTaskOutput_FAILED},
 	})
 }
 
+// checkCanceled reports progress between package manager runs and
+// returns errServerCancel if the service told us to stop. Other errors are
+// only logged, a missed progress report should not fail updates that are
+// under way.
+func (r *patchTask) checkCanceled(ctx context.Context) error {
+	err := r.reportContinuingState(ctx, agentendpointpb.ApplyPatchesTaskProgress_APPLYING_PATCHES)
+	if err == errServerCancel {
+		return err
+	}
+	if err != nil {
+		clog.Warningf(ctx, "%v", err)
+	}
+	return nil
+}
+
 func (r *patchTask) reportCompletedState(ctx context.Context, errMsg string, output *agentendpointpb.ReportTaskCompleteRequest_ApplyPatchesTaskOutput) error {
+	outcome := output.ApplyPatchesTaskOutput.GetState().String()
+	if r.canceled {
+		outcome = outcomeCanceled
+	}
+	r.writeResults(ctx, outcome, errMsg)
+
 	req := &agentendpointpb.ReportTaskCompleteRequest{
-		TaskId:       r.TaskID,
-		TaskType:     agentendpointpb.TaskType_APPLY_PATCHES,
 		ErrorMessage: errMsg,
 		Output:       output,
 	}
-	if err := r.client.reportTaskComplete(ctx, req); err != nil {
+	if err := r.task.ReportComplete(ctx, req); err != nil {
 		return fmt.Errorf("error reporting completed state: %v", err)
 	}
 	return nil
@@ -130,13 +160,16 @@ func (r *patchTask) reportContinuingState(ctx context.Context, patchState agente
 	}
 
 	req := &agentendpointpb.ReportTaskProgressRequest{
-		TaskId:   r.TaskID,
-		TaskType: agentendpointpb.TaskType_APPLY_PATCHES,
 		Progress: &agentendpointpb.ReportTaskProgressRequest_ApplyPatchesTaskProgress{
 			ApplyPatchesTaskProgress: &agentendpointpb.ApplyPatchesTaskProgress{State: patchState},
 		},
 	}
-	res, err := r.client.reportTaskProgress(ctx, req)
+	res, err := r.task.ReportProgress(ctx, req)
+	if err != nil && patchState == agentendpointpb.ApplyPatchesTaskProgress_REBOOTING {
+		// This is the last report before the reboot, don't let a network
+		// outage stop the task from carrying on after it.
+		err = queueFailedReport(ctx, outboxProgress, r.task.ID(), req, err)
+	}
 	if err != nil {
 		return fmt.Errorf("error reporting state %s: %v", patchState, err)
 	}
@@ -151,7 +184,37 @@ func (r *patchTask) reportContinuingState(ctx context.Context, patchState agente
 	return r.saveState()
 }
 
-// TODO: Add MaxRebootCount so we don't loop endlessly.
+// patchMaxReboots and patchMinRebootInterval are replaced in tests.
+var (
+	patchMaxReboots        = agentconfig.PatchMaxReboots
+	patchMinRebootInterval = agentconfig.PatchMinRebootInterval
+)
+
+// checkRebootLimits stops a task that keeps finding a reboot is required
+// from rebooting the system endlessly.
+func (r *patchTask) checkRebootLimits() error {
+	if max := patchMaxReboots(); max > 0 && r.RebootCount >= max {
+		return fmt.Errorf("not rebooting, the task has already rebooted the system %d times which is the most allowed", r.RebootCount)
+	}
+	return checkRebootInterval()
+}
+
+// checkRebootInterval returns an error if the agent last rebooted the system
+// less than patchMinRebootInterval ago.
+func checkRebootInterval() error {
+	interval := patchMinRebootInterval()
+	if interval <= 0 {
+		return nil
+	}
+	st, err := loadRebootState()
+	if err != nil {
+		return fmt.Errorf("error reading reboot state: %v", err)
+	}
+	if since := time.Since(st.LastReboot); since < interval {
+		return fmt.Errorf("not rebooting, the agent last rebooted the system %s ago and the minimum interval between reboots is %s", since.Round(time.Second), interval)
+	}
+	return nil
+}
 
 func (r *patchTask) prePatchReboot(ctx context.Context) error {
 	return r.rebootIfNeeded(ctx, true)
@@ -188,6 +251,21 @@ func (r *patchTask) rebootIfNeeded(ctx context.Context, prePatch bool) error {
 		return nil
 	}
 
+	if err := agentconfig.CheckMaintenanceWindow(); err != nil {
+		clog.Warningf(ctx, "Skipping reboot: %v", err)
+		r.RebootDeferred = true
+		if err := r.saveState(); err != nil {
+			return fmt.Errorf("error saving state: %v", err)
+		}
+		return nil
+	}
+
+	if !r.Task.GetDryRun() {
+		if err := r.checkRebootLimits(); err != nil {
+			return err
+		}
+	}
+
 	if err := r.reportContinuingState(ctx, agentendpointpb.ApplyPatchesTaskProgress_REBOOTING); err != nil {
 		return err
 	}
@@ -201,11 +279,20 @@ func (r *patchTask) rebootIfNeeded(ctx context.Context, prePatch bool) error {
 	if err := r.saveState(); err != nil {
 		return fmt.Errorf("error saving state: %v", err)
 	}
+	if err := recordReboot(time.Now()); err != nil {
+		return fmt.Errorf("error saving reboot state: %v", err)
+	}
 	if err := rebootSystem(); err != nil {
 		return fmt.Errorf("failed to reboot system: %v", err)
 	}
 
-	// Reboot can take a bit, pause here so other activities don't start.
+	waitForReboot(ctx)
+	return nil
+}
+
+// waitForReboot never returns, a reboot can take a bit so pause here so
+// other activities don't start.
+func waitForReboot(ctx context.Context) {
 	for {
 		clog.Debugf(ctx, "Waiting for system reboot.")
 		time.Sleep(1 * time.Minute)
@@ -222,9 +309,8 @@ func (r *patchTask) run(ctx context.Context) (err error) {
 			r.reportFailed(ctx, err.Error())
 			return
 		}
-		r.complete(ctx)
 		if agentconfig.OSInventoryEnabled() {
-			go r.client.ReportInventory(ctx)
+			go r.task.client.ReportInventory(ctx)
 		}
 	}()
 
@@ -234,7 +320,15 @@ func (r *patchTask) run(ctx context.Context) (err error) {
 		default:
 			return r.reportFailed(ctx, fmt.Sprintf("unknown step: %q", r.PatchStep))
 		case prePatch:
+			// Patch tasks are not held until the next maintenance window, the
+			// task is failed and has to be run again inside a window.
+			if err := agentconfig.CheckMaintenanceWindow(); err != nil {
+				return r.reportFailed(ctx, fmt.Sprintf("Patch task rejected: %v", err))
+			}
 			r.StartedAt = time.Now()
+			if err := r.runHooks(ctx, preHooks); err != nil {
+				return r.reportFailed(ctx, fmt.Sprintf("Patch task aborted by pre-patch hook: %v", err))
+			}
 			if err := r.setStep(patching); err != nil {
 				return r.reportFailed(ctx, fmt.Sprintf("Error saving agent step: %v", err))
 			}
@@ -246,10 +340,28 @@ func (r *patchTask) run(ctx context.Context) (err error) {
 				return r.handleErrorState(ctx, fmt.Sprintf("Error running prePatchReboot: %v", err), err)
 			}
 		case patching:
+			if err := r.waitForRetry(ctx); err != nil {
+				return r.handleErrorState(ctx, fmt.Sprintf("Patch task interrupted waiting to retry: %v", err), err)
+			}
+			r.startRetry(ctx)
+			if r.Attempts > 0 {
+				clog.Infof(ctx, "Applying patches, attempt %d of %d.", r.Attempts+1, patchRetries()+1)
+			}
 			if err := r.reportContinuingState(ctx, agentendpointpb.ApplyPatchesTaskProgress_APPLYING_PATCHES); err != nil {
 				return r.handleErrorState(ctx, err.Error(), err)
 			}
+			// We may be resuming after a reboot, the window may have closed
+			// since. As above the task is failed rather than held.
+			if err := agentconfig.CheckMaintenanceWindow(); err != nil {
+				return r.reportFailed(ctx, fmt.Sprintf("Patch task stopped before applying patches: %v", err))
+			}
 			if err := r.runUpdates(ctx); err != nil {
+				if err != errServerCancel && r.scheduleRetry(ctx, err) {
+					continue
+				}
+				if r.Attempts > 0 {
+					return r.handleErrorState(ctx, fmt.Sprintf("Failed to apply patches after %d attempts: %v", r.Attempts+1, err), err)
+				}
 				return r.handleErrorState(ctx, fmt.Sprintf("Failed to apply patches: %v", err), err)
 			}
 			if err := r.postPatchReboot(ctx); err != nil {
@@ -260,13 +372,16 @@ func (r *patchTask) run(ctx context.Context) (err error) {
 				return r.reportFailed(ctx, fmt.Sprintf("Error saving agent step: %v", err))
 			}
 		case postPatch:
+			if err := r.runHooks(ctx, postHooks); err != nil {
+				return r.reportFailed(ctx, fmt.Sprintf("Patches applied but a post-patch hook failed: %v", err))
+			}
 			isRebootRequired, err := systemRebootRequired(ctx)
 			if err != nil {
 				return r.reportFailed(ctx, fmt.Sprintf("Error checking if system reboot is required: %v", err))
 			}
 
 			finalState := agentendpointpb.ApplyPatchesTaskOutput_SUCCEEDED
-			if isRebootRequired {
+			if isRebootRequired || r.RebootDeferred {
 				finalState = agentendpointpb.ApplyPatchesTaskOutput_SUCCEEDED_REBOOT_REQUIRED
 			}
 
@@ -281,15 +396,32 @@ func (r *patchTask) run(ctx context.Context) (err error) {
 	}
 }
 
-// RunApplyPatches runs a apply patches task.
-func (c *Client) RunApplyPatches(ctx context.Context, task *agentendpointpb.Task) error {
-	ctx = clog.WithLabels(ctx, task.GetServiceLabels())
+// patchTaskHandler is the TaskHandler for TaskType_APPLY_PATCHES.
+type patchTaskHandler struct{}
+
+func (patchTaskHandler) Start(ctx context.Context, t *Task) error {
 	r := &patchTask{
-		TaskID: task.GetTaskId(),
-		client: c,
-		Task:   &applyPatchesTask{task.GetApplyPatchesTask()},
+		TaskID: t.ID(),
+		task:   t,
+		Task:   &applyPatchesTask{t.Proto().GetApplyPatchesTask()},
 	}
 	r.setStep(prePatch)
 
 	return r.run(ctx)
 }
+
+func (patchTaskHandler) Resume(ctx context.Context, t *Task, state []byte) error {
+	r := &patchTask{task: t}
+	if err := json.Unmarshal(state, r); err != nil {
+		return r.reportFailed(ctx, fmt.Sprintf("Error loading saved patch task: %v", err))
+	}
+	if r.RebootDeferred {
+		clog.Infof(ctx, "A reboot was deferred to the next maintenance window before the agent restarted.")
+	}
+	return r.run(ctx)
+}
+
+// RunApplyPatches runs a apply patches task.
+func (c *Client) RunApplyPatches(ctx context.Context, task *agentendpointpb.Task) error {
+	return c.startTask(ctx, agentendpointpb.TaskType_APPLY_PATCHES, task)
+}
@@ -116,6 +116,9 @@ func (r *patchTask) wuaUpdates(ctx context.Context) error {
 			return err
 		}
 		count, err := r.installWUAUpdates(ctx, cf)
+		if err == errServerCancel {
+			return err
+		}
 		if err != nil {
 			clog.Errorf(ctx, "Error installing Windows updates (attempt %d): %v", i, err)
 		}
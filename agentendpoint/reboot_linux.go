@@ -15,8 +15,13 @@
 package agentendpoint
 
 import (
+	"errors"
+	"io/ioutil"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/GoogleCloudPlatform/osconfig/util"
 )
@@ -43,3 +48,23 @@ func rebootSystem() error {
 	syscall.Sync()
 	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
 }
+
+// bootTime is when the system booted, from the btime line of /proc/stat.
+func bootTime() (time.Time, error) {
+	d, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(d), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 || f[0] != "btime" {
+			continue
+		}
+		secs, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+}
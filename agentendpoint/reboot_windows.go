@@ -20,6 +20,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32           = windows.NewLazySystemDLL("kernel32.dll")
+	procGetTickCount64 = kernel32.NewProc("GetTickCount64")
 )
 
 func rebootSystem() error {
@@ -29,3 +37,13 @@ func rebootSystem() error {
 	}
 	return exec.Command(filepath.Join(root, `System32\shutdown.exe`), "/r", "/t", "00", "/f", "/d", "p:2:3").Run()
 }
+
+// bootTime is when the system booted, worked out from the milliseconds since
+// boot.
+func bootTime() (time.Time, error) {
+	if err := procGetTickCount64.Find(); err != nil {
+		return time.Time{}, err
+	}
+	ms, _, _ := procGetTickCount64.Call()
+	return time.Now().Add(-time.Duration(ms) * time.Millisecond), nil
+}
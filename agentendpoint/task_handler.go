@@ -0,0 +1,184 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+// TaskHandler runs the tasks of one task type, see RegisterTaskHandler.
+//
+// The Client owns the task lifecycle. It calls Start for a task returned by
+// StartNextTask, or Resume for a task found in the saved task state when the
+// agent starts, and clears the saved state once either returns. A handler
+// reports progress and completion through the Task it is given and must
+// report completion before returning.
+type TaskHandler interface {
+	// Start runs a new task, t.Proto() holds the task details.
+	Start(ctx context.Context, t *Task) error
+	// Resume continues a task from the state it last saved with
+	// Task.SaveState.
+	Resume(ctx context.Context, t *Task, state []byte) error
+}
+
+var (
+	taskHandlersMx sync.RWMutex
+	taskHandlers   = map[agentendpointpb.TaskType]TaskHandler{}
+)
+
+func init() {
+	RegisterTaskHandler(agentendpointpb.TaskType_APPLY_PATCHES, patchTaskHandler{})
+	RegisterTaskHandler(agentendpointpb.TaskType_EXEC_STEP_TASK, execTaskHandler{})
+}
+
+// RegisterTaskHandler registers h to run tasks of type typ, replacing any
+// handler already registered for it. Tasks of a type with no handler are
+// reported as failed.
+func RegisterTaskHandler(typ agentendpointpb.TaskType, h TaskHandler) {
+	taskHandlersMx.Lock()
+	defer taskHandlersMx.Unlock()
+	taskHandlers[typ] = h
+}
+
+func taskHandler(typ agentendpointpb.TaskType) (TaskHandler, bool) {
+	taskHandlersMx.RLock()
+	defer taskHandlersMx.RUnlock()
+	h, ok := taskHandlers[typ]
+	return h, ok
+}
+
+// Task is a single task being run by a TaskHandler.
+type Task struct {
+	client *Client
+	id     string
+	typ    agentendpointpb.TaskType
+	task   *agentendpointpb.Task
+	// saved is set once there is state on disk to clear.
+	saved bool
+}
+
+func (c *Client) newTask(typ agentendpointpb.TaskType, id string, task *agentendpointpb.Task) *Task {
+	return &Task{client: c, id: id, typ: typ, task: task}
+}
+
+// ID is the task ID.
+func (t *Task) ID() string {
+	return t.id
+}
+
+// Type is the task type.
+func (t *Task) Type() agentendpointpb.TaskType {
+	return t.typ
+}
+
+// Proto is the task as returned by StartNextTask, it is nil for a resumed
+// task.
+func (t *Task) Proto() *agentendpointpb.Task {
+	return t.task
+}
+
+// ReportProgress calls ReportTaskProgress, the task ID and type are filled
+// in from t.
+func (t *Task) ReportProgress(ctx context.Context, req *agentendpointpb.ReportTaskProgressRequest) (*agentendpointpb.ReportTaskProgressResponse, error) {
+	req.TaskId = t.id
+	req.TaskType = t.typ
+	return t.client.reportTaskProgress(ctx, req)
+}
+
+// ReportComplete calls ReportTaskComplete, the task ID and type are filled
+// in from t.
+func (t *Task) ReportComplete(ctx context.Context, req *agentendpointpb.ReportTaskCompleteRequest) error {
+	req.TaskId = t.id
+	req.TaskType = t.typ
+	return t.client.reportTaskComplete(ctx, req)
+}
+
+// SaveState saves v as JSON so the task can be resumed if the agent
+// restarts, for example after a reboot.
+func (t *Task) SaveState(v interface{}) error {
+	state, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := (&taskState{Task: &savedTask{TaskID: t.id, TaskType: t.typ, State: state}}).save(stateFile()); err != nil {
+		return err
+	}
+	t.saved = true
+	return nil
+}
+
+func (t *Task) clearState() error {
+	if !t.saved {
+		return nil
+	}
+	return (&taskState{}).save(stateFile())
+}
+
+// startTask runs a task returned by StartNextTask with the handler
+// registered for typ.
+func (c *Client) startTask(ctx context.Context, typ agentendpointpb.TaskType, task *agentendpointpb.Task) error {
+	ctx = clog.WithLabels(ctx, task.GetServiceLabels())
+	t := c.newTask(typ, task.GetTaskId(), task)
+	return c.handleTask(ctx, t, func(h TaskHandler) error {
+		return h.Start(ctx, t)
+	})
+}
+
+// resumeTask resumes a task from saved state.
+func (c *Client) resumeTask(ctx context.Context, st *savedTask) error {
+	t := c.newTask(st.TaskType, st.TaskID, nil)
+	t.saved = true
+	return c.handleTask(ctx, t, func(h TaskHandler) error {
+		return h.Resume(ctx, t, st.State)
+	})
+}
+
+// handleTask runs the shared part of the task lifecycle around run, it
+// rejects unknown task types and clears any saved state when done.
+func (c *Client) handleTask(ctx context.Context, t *Task, run func(TaskHandler) error) (err error) {
+	defer func() {
+		if err := t.clearState(); err != nil {
+			clog.Errorf(ctx, "Error saving state: %v", err)
+		}
+	}()
+
+	h, ok := taskHandler(t.typ)
+	if !ok {
+		err := fmt.Errorf("unknown task type: %v", t.typ)
+		if rErr := t.ReportComplete(ctx, &agentendpointpb.ReportTaskCompleteRequest{ErrorMessage: err.Error()}); rErr != nil {
+			return fmt.Errorf("%v, error reporting completed state: %v", err, rErr)
+		}
+		return err
+	}
+
+	defer func() {
+		// A misbehaving handler should fail its task rather than crash the
+		// agent.
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("recovered from panic: %v", rec)
+			if rErr := t.ReportComplete(ctx, &agentendpointpb.ReportTaskCompleteRequest{ErrorMessage: err.Error()}); rErr != nil {
+				err = fmt.Errorf("%v, error reporting completed state: %v", err, rErr)
+			}
+		}
+	}()
+	return run(h)
+}
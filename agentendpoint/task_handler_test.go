@@ -0,0 +1,116 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
+)
+
+const testTaskType = agentendpointpb.TaskType(1000)
+
+type testTaskHandler struct {
+	resumedState string
+}
+
+func (h *testTaskHandler) Start(ctx context.Context, t *Task) error {
+	// Save state as if about to reboot, then finish.
+	if err := t.SaveState("step1"); err != nil {
+		return err
+	}
+	return t.ReportComplete(ctx, &agentendpointpb.ReportTaskCompleteRequest{})
+}
+
+func (h *testTaskHandler) Resume(ctx context.Context, t *Task, state []byte) error {
+	if err := json.Unmarshal(state, &h.resumedState); err != nil {
+		return err
+	}
+	return t.ReportComplete(ctx, &agentendpointpb.ReportTaskCompleteRequest{})
+}
+
+func TestTaskHandlers(t *testing.T) {
+	ctx := context.Background()
+	srv := &agentEndpointServiceExecTestServer{}
+	tc, err := newTestClient(ctx, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.close()
+
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+
+	// Unknown task types are reported as complete with an error.
+	if err := tc.client.startTask(ctx, testTaskType, &agentendpointpb.Task{TaskId: "unknown"}); err == nil {
+		t.Error("expected error from startTask for an unknown task type")
+	}
+	want := &agentendpointpb.ReportTaskCompleteRequest{
+		TaskId:          "unknown",
+		TaskType:        testTaskType,
+		ErrorMessage:    "unknown task type: 1000",
+		InstanceIdToken: testIDToken,
+	}
+	if diff := cmp.Diff(want, srv.lastReportTaskCompleteRequest, protocmp.Transform()); diff != "" {
+		t.Errorf("ReportTaskCompleteRequest mismatch (-want +got):\n%s", diff)
+	}
+
+	h := &testTaskHandler{}
+	RegisterTaskHandler(testTaskType, h)
+	defer func() {
+		taskHandlersMx.Lock()
+		delete(taskHandlers, testTaskType)
+		taskHandlersMx.Unlock()
+	}()
+
+	if err := tc.client.startTask(ctx, testTaskType, &agentendpointpb.Task{TaskId: "foo"}); err != nil {
+		t.Fatalf("startTask: unexpected error: %v", err)
+	}
+	if srv.lastReportTaskCompleteRequest.GetTaskId() != "foo" || srv.lastReportTaskCompleteRequest.GetErrorMessage() != "" {
+		t.Errorf("unexpected ReportTaskCompleteRequest: %v", srv.lastReportTaskCompleteRequest)
+	}
+	// State is cleared once the handler returns.
+	st, err := loadState(taskStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Task != nil {
+		t.Errorf("expected saved task to be cleared, got: %+v", st.Task)
+	}
+
+	// Resume from saved state.
+	saved := &savedTask{TaskID: "foo", TaskType: testTaskType, State: []byte(`"step1"`)}
+	if err := (&taskState{Task: saved}).save(taskStateFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.client.resumeTask(ctx, saved); err != nil {
+		t.Fatalf("resumeTask: unexpected error: %v", err)
+	}
+	if h.resumedState != "step1" {
+		t.Errorf("resumed state: got(%q) != want(%q)", h.resumedState, "step1")
+	}
+}
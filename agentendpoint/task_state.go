@@ -19,11 +19,88 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+
+	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1"
 )
 
 type taskState struct {
+	// PatchTask and ExecTask are only read, they hold state saved by older
+	// agents.
 	PatchTask *patchTask `json:",omitempty"`
 	ExecTask  *execTask  `json:",omitempty"`
+	Task      *savedTask `json:",omitempty"`
+}
+
+// savedTask is the state of a task saved by its TaskHandler.
+type savedTask struct {
+	TaskID   string
+	TaskType agentendpointpb.TaskType
+	State    json.RawMessage
+}
+
+// savedTask returns the saved task, converting state saved by older agents.
+func (s *taskState) savedTask() (*savedTask, error) {
+	switch {
+	case s.PatchTask != nil:
+		state, err := json.Marshal(s.PatchTask)
+		if err != nil {
+			return nil, err
+		}
+		return &savedTask{TaskID: s.PatchTask.TaskID, TaskType: agentendpointpb.TaskType_APPLY_PATCHES, State: state}, nil
+	case s.ExecTask != nil:
+		state, err := json.Marshal(s.ExecTask)
+		if err != nil {
+			return nil, err
+		}
+		return &savedTask{TaskID: s.ExecTask.TaskID, TaskType: agentendpointpb.TaskType_EXEC_STEP_TASK, State: state}, nil
+	}
+	return s.Task, nil
+}
+
+// stateFile is where task state is saved.
+func stateFile() string {
+	if taskStateFile != "" {
+		return taskStateFile
+	}
+	return agentconfig.TaskStateFile()
+}
+
+// rebootState records reboots made by the agent, it is kept apart from the
+// task state as it outlives tasks.
+type rebootState struct {
+	LastReboot time.Time `json:",omitempty"`
+}
+
+// rebootStateFile is next to the task state file.
+func rebootStateFile() string {
+	return filepath.Join(filepath.Dir(stateFile()), "osconfig_reboot.state")
+}
+
+func loadRebootState() (*rebootState, error) {
+	var st rebootState
+	d, err := ioutil.ReadFile(rebootStateFile())
+	if os.IsNotExist(err) {
+		return &st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, json.Unmarshal(d, &st)
+}
+
+// recordReboot saves that the agent is about to reboot the system.
+func recordReboot(t time.Time) error {
+	d, err := json.Marshal(&rebootState{LastReboot: t})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rebootStateFile()), 0755); err != nil {
+		return err
+	}
+	return writeFile(rebootStateFile(), d)
 }
 
 func (s *taskState) save(path string) error {
@@ -15,11 +15,15 @@
 package agentendpoint
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -28,7 +32,7 @@ import (
 )
 
 var (
-	testPatchTaskStateString = "{\"PatchTask\":{\"TaskID\":\"foo\",\"Task\":{\"patchConfig\":{\"apt\":{\"type\":\"DIST\",\"excludes\":[\"foo\",\"bar\"],\"exclusivePackages\":[\"foo\",\"bar\"]},\"windowsUpdate\":{\"classifications\":[\"CRITICAL\",\"SECURITY\"],\"excludes\":[\"foo\",\"bar\"],\"exclusivePatches\":[\"foo\",\"bar\"]}}},\"StartedAt\":\"0001-01-01T00:00:00Z\",\"RebootCount\":0}}"
+	testPatchTaskStateString = "{\"PatchTask\":{\"TaskID\":\"foo\",\"Task\":{\"patchConfig\":{\"apt\":{\"type\":\"DIST\",\"excludes\":[\"foo\",\"bar\"],\"exclusivePackages\":[\"foo\",\"bar\"]},\"windowsUpdate\":{\"classifications\":[\"CRITICAL\",\"SECURITY\"],\"excludes\":[\"foo\",\"bar\"],\"exclusivePatches\":[\"foo\",\"bar\"]}}},\"StartedAt\":\"0001-01-01T00:00:00Z\",\"RebootCount\":0,\"NextAttempt\":\"0001-01-01T00:00:00Z\"}}"
 	testPatchTaskState       = &taskState{PatchTask: &patchTask{TaskID: "foo", Task: &applyPatchesTask{
 		// This is not exhaustive but it's a good test for having multiple settings.
 		&agentendpointpb.ApplyPatchesTask{PatchConfig: &agentendpointpb.PatchConfig{
@@ -133,7 +137,7 @@ func TestStateSave(t *testing.T) {
 		{
 			"ExecTask",
 			&taskState{ExecTask: &execTask{TaskID: "foo"}},
-			"{\"ExecTask\":{\"TaskID\":\"foo\",\"Task\":null,\"StartedAt\":\"0001-01-01T00:00:00Z\"}}",
+			"{\"ExecTask\":{\"TaskID\":\"foo\",\"Task\":null,\"StartedAt\":\"0001-01-01T00:00:00Z\",\"BootTime\":\"0001-01-01T00:00:00Z\"}}",
 		},
 	}
 	for _, tt := range tests {
@@ -154,3 +158,85 @@ func TestStateSave(t *testing.T) {
 		}
 	}
 }
+
+func TestRebootLimits(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+	defer func() {
+		patchMaxReboots = agentconfig.PatchMaxReboots
+		patchMinRebootInterval = agentconfig.PatchMinRebootInterval
+	}()
+	patchMaxReboots = func() int { return 2 }
+	patchMinRebootInterval = func() time.Duration { return time.Hour }
+
+	// No reboot recorded yet.
+	r := &patchTask{RebootCount: 1}
+	if err := r.checkRebootLimits(); err != nil {
+		t.Errorf("checkRebootLimits: unexpected error: %v", err)
+	}
+
+	r.RebootCount = 2
+	if err := r.checkRebootLimits(); err == nil {
+		t.Error("checkRebootLimits: expected error after the most reboots allowed")
+	}
+
+	r.RebootCount = 0
+	if err := recordReboot(time.Now().Add(-2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkRebootLimits(); err != nil {
+		t.Errorf("checkRebootLimits: unexpected error for a reboot outside the interval: %v", err)
+	}
+	if err := recordReboot(time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkRebootLimits(); err == nil {
+		t.Error("checkRebootLimits: expected error for a reboot inside the interval")
+	}
+
+	// 0 disables both limits.
+	patchMaxReboots = func() int { return 0 }
+	patchMinRebootInterval = func() time.Duration { return 0 }
+	r.RebootCount = 100
+	if err := r.checkRebootLimits(); err != nil {
+		t.Errorf("checkRebootLimits with no limits: unexpected error: %v", err)
+	}
+}
+
+func TestPatchTaskResumeRebootDeferred(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	taskStateFile = filepath.Join(td, "testState")
+	patchResultsDir = filepath.Join(td, "results")
+	defer func() { patchResultsDir = "" }()
+
+	srv := &agentEndpointServiceExecTestServer{}
+	tc, err := newTestClient(ctx, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.close()
+
+	// A reboot was deferred before the agent restarted.
+	r := &patchTask{TaskID: "foo", Task: &applyPatchesTask{&agentendpointpb.ApplyPatchesTask{}}, PatchStep: postPatch, RebootDeferred: true}
+	state, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (patchTaskHandler{}).Resume(ctx, tc.client.newTask(agentendpointpb.TaskType_APPLY_PATCHES, "foo", nil), state); err != nil {
+		t.Fatal(err)
+	}
+
+	want := agentendpointpb.ApplyPatchesTaskOutput_SUCCEEDED_REBOOT_REQUIRED
+	if got := srv.lastReportTaskCompleteRequest.GetApplyPatchesTaskOutput().GetState(); got != want {
+		t.Errorf("reported state: got %s, want %s", got, want)
+	}
+}
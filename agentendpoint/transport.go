@@ -0,0 +1,97 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/external"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// transportCredentials returns TLS credentials that trust the configured CA
+// bundle and present the configured client certificate, or no transport
+// security at all if the endpoint is configured as plaintext.
+func transportCredentials(ctx context.Context) (grpc.DialOption, error) {
+	if agentconfig.EndpointPlaintext() {
+		if agentconfig.ClientCertFile() != "" {
+			return nil, errors.New("a client certificate can not be used with a plaintext endpoint")
+		}
+		clog.Warningf(ctx, "Connecting to %s without TLS, this is only meant for local development endpoints.", agentconfig.SvcEndpoint())
+		return grpc.WithInsecure(), nil
+	}
+
+	tlsConfig, err := external.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err = withClientCert(tlsConfig, agentconfig.ClientCertFile(), agentconfig.ClientKeyFile())
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+// withClientCert adds the client certificate in certFile and keyFile to
+// tlsConfig, which may be nil. tlsConfig is returned as is if neither file
+// is set.
+func withClientCert(tlsConfig *tls.Config, certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return tlsConfig, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a client certificate needs both a certificate and a key file")
+	}
+	// Fail now rather than on every handshake if the files are no good.
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, fmt.Errorf("error loading client certificate: %v", err)
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	// The files are read for each handshake so a renewed certificate is used
+	// without restarting the agent.
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		return &cert, nil
+	}
+	return tlsConfig, nil
+}
+
+// keepaliveParams returns the configured keepalive parameters, ok is false
+// when keepalive pings are not configured.
+func keepaliveParams() (ka keepalive.ClientParameters, ok bool) {
+	t := agentconfig.EndpointKeepaliveTime()
+	if t <= 0 {
+		return ka, false
+	}
+	// A zero Timeout uses the gRPC default, and gRPC raises Time to at
+	// least 10s.
+	return keepalive.ClientParameters{
+		Time:    t,
+		Timeout: agentconfig.EndpointKeepaliveTimeout(),
+	}, true
+}
@@ -0,0 +1,113 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package agentendpoint
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir and
+// returns the certificate's DER bytes.
+func writeTestCert(t *testing.T, dir string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestWithClientCert(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	certFile := filepath.Join(td, "client.pem")
+	keyFile := filepath.Join(td, "client.key")
+
+	// No client certificate leaves the config alone, including nil.
+	if got, err := withClientCert(nil, "", ""); err != nil || got != nil {
+		t.Errorf("withClientCert with no files: got %v %v, want nil config", got, err)
+	}
+
+	if _, err := withClientCert(nil, certFile, ""); err == nil {
+		t.Error("withClientCert with no key file: expected error")
+	}
+	if _, err := withClientCert(nil, certFile, keyFile); err == nil {
+		t.Error("withClientCert with missing files: expected error")
+	}
+
+	der := writeTestCert(t, td)
+	base := &tls.Config{ServerName: "example.com"}
+	got, err := withClientCert(base, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("withClientCert: %v", err)
+	}
+	if got.ServerName != "example.com" {
+		t.Errorf("withClientCert dropped the base config: %+v", got)
+	}
+	cert, err := got.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatalf("GetClientCertificate: %v", err)
+	}
+	if len(cert.Certificate) != 1 || !bytes.Equal(cert.Certificate[0], der) {
+		t.Error("GetClientCertificate did not return the certificate from the file")
+	}
+
+	// A renewed certificate is picked up on the next handshake.
+	renewed := writeTestCert(t, td)
+	cert, err = got.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatalf("GetClientCertificate: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], renewed) {
+		t.Error("GetClientCertificate did not return the renewed certificate")
+	}
+}
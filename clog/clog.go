@@ -18,7 +18,10 @@ package clog
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
@@ -35,29 +38,157 @@ type log struct {
 }
 
 func (l *log) log(msg string, sev logger.Severity) {
-	// Set CallDepth 3, one for logger.Log, one for this function, and one for
-	// the calling clog function.
-	logger.Log(logger.LogEntry{Message: msg, Severity: sev, CallDepth: 3, Labels: l.labels})
+	// Set CallDepth 4, one for logger.Log, one for this function, one for
+	// logf and one for the calling clog function.
+	logger.Log(logger.LogEntry{Message: msg, Severity: sev, CallDepth: 4, Labels: l.labels})
+}
+
+// Level is a log level, messages below the effective level are dropped.
+type Level int32
+
+// Log levels in increasing severity, the zero value is LevelInfo.
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+}
+
+func (l Level) String() string {
+	if n, ok := levelNames[l]; ok {
+		return n
+	}
+	return fmt.Sprintf("Level(%d)", l)
+}
+
+// ParseLevel parses one of "debug", "info", "warning" or "error", case
+// insensitively.
+func ParseLevel(s string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+var (
+	// level is accessed atomically, it is the level for messages not
+	// matched by a component override.
+	level int32
+
+	componentsMx sync.RWMutex
+	// components maps a component to its level. A component is either a
+	// label, as "key=value", or the name of the Go package that logged the
+	// message, such as "packages".
+	components map[string]Level
+)
+
+// SetLevel sets the level for messages not matched by a component override.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// SetComponentLevels replaces the per-component level overrides, see
+// enabled for how components are matched.
+func SetComponentLevels(levels map[string]Level) {
+	c := make(map[string]Level, len(levels))
+	for k, v := range levels {
+		c[k] = v
+	}
+	componentsMx.Lock()
+	defer componentsMx.Unlock()
+	components = c
+}
+
+// enabled reports whether a message of severity sev should be logged. Any
+// component override matching a label or the calling package replaces the
+// global level, if more than one matches the most verbose one is used.
+func (l *log) enabled(sev Level) bool {
+	componentsMx.RLock()
+	defer componentsMx.RUnlock()
+
+	lvl := Level(atomic.LoadInt32(&level))
+	if len(components) == 0 {
+		return sev >= lvl
+	}
+
+	matched := false
+	match := func(c string) {
+		cl, ok := components[c]
+		if !ok {
+			return
+		}
+		if !matched || cl < lvl {
+			lvl = cl
+		}
+		matched = true
+	}
+	l.Lock()
+	for k, v := range l.labels {
+		match(k + "=" + v)
+	}
+	l.Unlock()
+	// Skip callerPackage, enabled, logf and the calling clog function.
+	match(callerPackage(4))
+	return sev >= lvl
+}
+
+// callerPackage returns the last element of the package path of the
+// function skip frames up the stack.
+func callerPackage(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return ""
+	}
+	// The name is of the form "path/to/pkg.Func" or "path/to/pkg.(*T).Method".
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func logf(ctx context.Context, lvl Level, sev logger.Severity, format string, args []interface{}) {
+	l := fromContext(ctx)
+	if !l.enabled(lvl) {
+		return
+	}
+	l.log(fmt.Sprintf(format, args...), sev)
 }
 
 // Debugf simulates logger.Debugf and adds context labels.
 func Debugf(ctx context.Context, format string, args ...interface{}) {
-	fromContext(ctx).log(fmt.Sprintf(format, args...), logger.Debug)
+	logf(ctx, LevelDebug, logger.Debug, format, args)
 }
 
 // Infof simulates logger.Infof and adds context labels.
 func Infof(ctx context.Context, format string, args ...interface{}) {
-	fromContext(ctx).log(fmt.Sprintf(format, args...), logger.Info)
+	logf(ctx, LevelInfo, logger.Info, format, args)
 }
 
 // Warningf simulates logger.Warningf and context labels.
 func Warningf(ctx context.Context, format string, args ...interface{}) {
-	fromContext(ctx).log(fmt.Sprintf(format, args...), logger.Warning)
+	logf(ctx, LevelWarning, logger.Warning, format, args)
 }
 
 // Errorf simulates logger.Errorf and adds context labels.
 func Errorf(ctx context.Context, format string, args ...interface{}) {
-	fromContext(ctx).log(fmt.Sprintf(format, args...), logger.Error)
+	logf(ctx, LevelError, logger.Error, format, args)
 }
 
 func (l *log) clone() *log {
@@ -16,6 +16,7 @@ package clog
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -44,3 +45,56 @@ func TestWithLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarning, LevelError} {
+		got, err := ParseLevel(strings.ToUpper(l.String()))
+		if err != nil {
+			t.Fatalf("ParseLevel(%q): unexpected error: %v", l, err)
+		}
+		if got != l {
+			t.Errorf("ParseLevel(%q): got(%s) != want(%s)", l, got, l)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(\"verbose\"): expected error")
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	defer SetLevel(LevelInfo)
+	defer SetComponentLevels(nil)
+
+	task := fromContext(WithLabels(context.Background(), map[string]string{"task_id": "foo"}))
+	other := fromContext(context.Background())
+
+	tests := []struct {
+		name       string
+		level      Level
+		components map[string]Level
+		l          *log
+		sev        Level
+		want       bool
+	}{
+		{"InfoDropsDebug", LevelInfo, nil, other, LevelDebug, false},
+		{"InfoLogsInfo", LevelInfo, nil, other, LevelInfo, true},
+		{"ErrorDropsWarning", LevelError, nil, other, LevelWarning, false},
+		{"LabelOverride", LevelInfo, map[string]Level{"task_id=foo": LevelDebug}, task, LevelDebug, true},
+		{"LabelOverrideNoMatch", LevelInfo, map[string]Level{"task_id=foo": LevelDebug}, other, LevelDebug, false},
+		// Tests are logged from package clog.
+		{"PackageOverride", LevelInfo, map[string]Level{"clog": LevelDebug}, other, LevelDebug, true},
+		{"QuieterOverride", LevelInfo, map[string]Level{"clog": LevelError}, other, LevelWarning, false},
+		{"MostVerboseMatchWins", LevelInfo, map[string]Level{"clog": LevelError, "task_id=foo": LevelDebug}, task, LevelDebug, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetLevel(tt.level)
+			SetComponentLevels(tt.components)
+			// enabled looks up the calling package two frames above itself,
+			// where logf and the clog function would be.
+			if got := func() bool { return func() bool { return tt.l.enabled(tt.sev) }() }(); got != tt.want {
+				t.Errorf("enabled(%s): got(%t) != want(%t)", tt.sev, got, tt.want)
+			}
+		})
+	}
+}
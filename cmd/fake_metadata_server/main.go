@@ -0,0 +1,150 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// fake_metadata_server serves a fake GCE metadata server so the agent can
+// be run locally, for example:
+//
+//	fake_metadata_server -instance_attr enable-osconfig=true &
+//	GCE_METADATA_HOST=localhost:8099 osconfig_agent -stdout -debug
+//
+// Attributes can be changed while it runs, which wakes the agent's hanging
+// GET:
+//
+//	curl -X PUT -H Metadata-Flavor:Google -d 60 \
+//	  localhost:8099/computeMetadata/v1/instance/attributes/osconfig-poll-interval
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/osconfig/metadatatest"
+)
+
+var (
+	addr          = flag.String("addr", "localhost:8099", "address to serve on, GCE_METADATA_HOST should be set to this")
+	configFile    = flag.String("config", "", "JSON file of metadata in the form the metadata server returns for ?recursive=true, project and instance attributes and instance details are used")
+	instanceAttrs attrFlag
+	projectAttrs  attrFlag
+)
+
+func init() {
+	flag.Var(&instanceAttrs, "instance_attr", "instance attribute as key=value, may be repeated")
+	flag.Var(&projectAttrs, "project_attr", "project attribute as key=value, may be repeated")
+}
+
+// attrFlag collects repeated key=value flags.
+type attrFlag map[string]string
+
+func (a *attrFlag) String() string {
+	return fmt.Sprint(map[string]string(*a))
+}
+
+func (a *attrFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return fmt.Errorf("%q is not key=value", s)
+	}
+	if *a == nil {
+		*a = attrFlag{}
+	}
+	(*a)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// metadataConfig is the part of the recursive metadata JSON read from
+// -config.
+type metadataConfig struct {
+	Instance struct {
+		Attributes map[string]string
+		Zone       string
+		Name       string
+		ID         json.Number
+	}
+	Project struct {
+		Attributes       map[string]string
+		ProjectID        string
+		NumericProjectID int64
+	}
+}
+
+func loadConfig(srv *metadatatest.Server, path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var mc metadataConfig
+	if err := json.Unmarshal(d, &mc); err != nil {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	inst := metadatatest.DefaultInstance
+	if mc.Instance.Zone != "" {
+		inst.Zone = mc.Instance.Zone
+	}
+	if mc.Instance.Name != "" {
+		inst.Name = mc.Instance.Name
+	}
+	if id, err := mc.Instance.ID.Int64(); err == nil && id != 0 {
+		inst.ID = id
+	}
+	if mc.Project.ProjectID != "" {
+		inst.ProjectID = mc.Project.ProjectID
+	}
+	if mc.Project.NumericProjectID != 0 {
+		inst.NumericProjectID = mc.Project.NumericProjectID
+	}
+	srv.SetInstance(inst)
+	for k, v := range mc.Instance.Attributes {
+		srv.SetAttribute(metadatatest.Instance, k, v)
+	}
+	for k, v := range mc.Project.Attributes {
+		srv.SetAttribute(metadatatest.Project, k, v)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	srv, err := metadatatest.NewServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *configFile != "" {
+		if err := loadConfig(srv, *configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Flags override the config file.
+	for k, v := range instanceAttrs {
+		srv.SetAttribute(metadatatest.Instance, k, v)
+	}
+	for k, v := range projectAttrs {
+		srv.SetAttribute(metadatatest.Project, k, v)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL)
+		srv.ServeHTTP(w, r)
+	})
+	fmt.Fprintf(os.Stderr, "Serving fake metadata, run the agent with:\n  GCE_METADATA_HOST=%s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
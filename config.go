@@ -0,0 +1,88 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+)
+
+// runConfig prints the effective agent config and where each setting came
+// from. It is run outside of run as it does not need the agent lock, logger
+// or any of the background loops.
+//
+// Usage: osconfig_agent [flags] config [-json]
+func runConfig(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the config as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	e, err := agentconfig.Explain()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting agent config: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		err = printConfigJSON(os.Stdout, e)
+	} else {
+		err = printConfigText(os.Stdout, e)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing agent config: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printConfigJSON(w io.Writer, e *agentconfig.Explanation) error {
+	d, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", d)
+	return err
+}
+
+func printConfigText(w io.Writer, e *agentconfig.Explanation) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE\tKEY")
+	for _, s := range e.Settings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.Value, s.Source, s.Key)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(e.Ignored) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(w, "\nIgnored keys:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tKEY\tVALUE\tREASON")
+	for _, i := range e.Ignored {
+		fmt.Fprintf(tw, "%s\t%s\t%q\t%s\n", i.Source, i.Key, i.Value, i.Reason)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,293 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package external
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// metadataNoProxy is always added to the no proxy list given to child
+// processes, the metadata server must never be reached through a proxy.
+const metadataNoProxy = "169.254.169.254,metadata.google.internal"
+
+// Proxy returns the proxy to use for req. The proxy from the agent config is
+// used when set, otherwise the standard proxy environment variables are.
+func Proxy(req *http.Request) (*url.URL, error) {
+	proxy := agentconfig.Proxy()
+	if proxy == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+	if !useProxy(req.URL.Hostname(), agentconfig.NoProxy()) {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	return u, nil
+}
+
+// useProxy reports whether host should be reached through the proxy given a
+// comma separated list of hosts, domains, IPs and CIDRs to exclude.
+func useProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	for _, e := range strings.Split(noProxy, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "":
+			continue
+		case e == "*":
+			return false
+		}
+		if _, cidr, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if eIP := net.ParseIP(e); eIP != nil {
+			if ip != nil && eIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		// "example.com", ".example.com" and "*.example.com" all match
+		// example.com and its subdomains.
+		e = strings.TrimPrefix(strings.TrimPrefix(e, "*"), ".")
+		if host == e || strings.HasSuffix(host, "."+e) {
+			return false
+		}
+	}
+	return true
+}
+
+// TLSConfig returns the TLS config for outbound connections, it trusts the
+// system roots and any extra CA bundle from the agent config. A nil config,
+// meaning the defaults, is returned when no CA bundle is configured.
+func TLSConfig() (*tls.Config, error) {
+	bundle := agentconfig.CABundleFile()
+	if bundle == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// The system pool is not available on all platforms, in that
+		// case only the bundle is trusted.
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %q", bundle)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Transport returns an http.Transport using the configured proxy and CA
+// bundle.
+func Transport() (*http.Transport, error) {
+	tlsConfig, err := TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = Proxy
+	tr.TLSClientConfig = tlsConfig
+	return tr, nil
+}
+
+// NewHTTPClient returns an http.Client using the configured proxy and CA
+// bundle.
+func NewHTTPClient() (*http.Client, error) {
+	tr, err := Transport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// NewGCSClient returns an authenticated GCS client using the configured proxy
+// and CA bundle.
+func NewGCSClient(ctx context.Context) (*storage.Client, error) {
+	tr, err := Transport()
+	if err != nil {
+		return nil, err
+	}
+	rt, err := htransport.NewTransport(ctx, tr, option.WithScopes(storage.ScopeReadOnly))
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: rt}))
+}
+
+// DialContext dials addr, tunneling through the configured proxy with HTTP
+// CONNECT when needed. It is meant for gRPC clients which do not use an
+// http.Transport.
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	proxy, err := Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	if proxy == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing proxy %q: %v", proxyAddr, err)
+	}
+	if proxy.Scheme == "https" {
+		tlsConfig, err := TLSConfig()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.ServerName = proxy.Hostname()
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	if err := connect(ctx, conn, proxy, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect sends an HTTP CONNECT request for addr over conn.
+func connect(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("error sending CONNECT to proxy: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("error reading CONNECT response from proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused CONNECT to %q: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+var (
+	proxyEnvMx   sync.Mutex
+	proxyEnvKeys = []string{"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+	// proxyEnvOrig holds the environment from before SetProxyEnv changed it,
+	// it is nil when the environment has not been changed.
+	proxyEnvOrig map[string]*string
+)
+
+// SetProxyEnv exports the configured proxy to the environment so child
+// processes such as package managers use it when downloading from repos.
+// When no proxy is configured the original environment is restored.
+func SetProxyEnv() {
+	proxyEnvMx.Lock()
+	defer proxyEnvMx.Unlock()
+
+	proxy := agentconfig.Proxy()
+	if proxy == "" {
+		for k, v := range proxyEnvOrig {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+		proxyEnvOrig = nil
+		return
+	}
+
+	if proxyEnvOrig == nil {
+		proxyEnvOrig = map[string]*string{}
+		for _, k := range proxyEnvKeys {
+			if v, ok := os.LookupEnv(k); ok {
+				proxyEnvOrig[k] = &v
+			} else {
+				proxyEnvOrig[k] = nil
+			}
+		}
+	}
+
+	noProxy := metadataNoProxy
+	if np := agentconfig.NoProxy(); np != "" {
+		noProxy = np + "," + noProxy
+	}
+	// Package managers differ in which case they read.
+	for _, k := range proxyEnvKeys {
+		if strings.EqualFold(k, "no_proxy") {
+			os.Setenv(k, noProxy)
+		} else {
+			os.Setenv(k, proxy)
+		}
+	}
+}
@@ -20,10 +20,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"syscall"
 	"time"
@@ -32,6 +34,7 @@ import (
 	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/GoogleCloudPlatform/osconfig/agentendpoint"
 	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/external"
 	"github.com/GoogleCloudPlatform/osconfig/policies"
 	"github.com/GoogleCloudPlatform/osconfig/tasker"
 	"github.com/tarm/serial"
@@ -52,8 +55,10 @@ func init() {
 	}
 	// We do this here so the -X value doesn't need the full path.
 	agentconfig.SetVersion(version)
+	// Seed for the splay added to periodic runs, otherwise every instance
+	// would pick the same delays.
+	rand.Seed(time.Now().UnixNano())
 
-	os.MkdirAll(filepath.Dir(agentconfig.RestartFile()), 0755)
 }
 
 type serialPort struct {
@@ -88,8 +93,17 @@ func run(ctx context.Context) {
 		logger.Init(ctx, opts)
 		logger.Fatalf(err.Error())
 	}
-	opts.Debug = agentconfig.Debug()
-	opts.ProjectName = agentconfig.ProjectID()
+	// Child processes such as package managers need the configured proxy.
+	external.SetProxyEnv()
+	// Log levels are applied by clog so they can follow config changes.
+	opts.Debug = true
+	clog.SetLevel(agentconfig.LogLevel())
+	clog.SetComponentLevels(agentconfig.ComponentLogLevels())
+	// Cloud Logging needs metadata for credentials, so only log locally
+	// when metadata is disabled.
+	if !agentconfig.MetadataDisabled() {
+		opts.ProjectName = agentconfig.ProjectID()
+	}
 
 	if err := logger.Init(ctx, opts); err != nil {
 		fmt.Printf("Error initializing logger: %v", err)
@@ -97,12 +111,15 @@ func run(ctx context.Context) {
 	}
 	ctx = clog.WithLabels(ctx, map[string]string{"instance_name": agentconfig.Name()})
 
+	// The restart file location depends on config so this can not happen
+	// any earlier.
+	os.MkdirAll(filepath.Dir(agentconfig.RestartFile()), 0755)
 	// Remove any existing restart file.
 	if err := os.Remove(agentconfig.RestartFile()); err != nil && !os.IsNotExist(err) {
 		clog.Errorf(ctx, "Error removing restart signal file: %v", err)
 	}
 
-	deferredFuncs = append(deferredFuncs, logger.Close, func() { clog.Infof(ctx, "OSConfig Agent (version %s) shutting down.", agentconfig.Version()) })
+	deferredFuncs = append(deferredFuncs, agentendpoint.CloseConnections, logger.Close, func() { clog.Infof(ctx, "OSConfig Agent (version %s) shutting down.", agentconfig.Version()) })
 
 	obtainLock()
 
@@ -111,19 +128,8 @@ func run(ctx context.Context) {
 
 	clog.Infof(ctx, "OSConfig Agent (version %s) started.", agentconfig.Version())
 
-	// Call RegisterAgent on start then at least once every day.
-	go func() {
-		for {
-			if agentconfig.TaskNotificationEnabled() || agentconfig.GuestPoliciesEnabled() {
-				if client, err := agentendpoint.NewClient(ctx); err != nil {
-					logger.Errorf(err.Error())
-				} else if err := client.RegisterAgent(ctx); err != nil {
-					logger.Errorf(err.Error())
-				}
-			}
-			time.Sleep(24 * time.Hour)
-		}
-	}()
+	// Call RegisterAgent on start then every RegisterAgentInterval.
+	go runRegisterLoop(ctx)
 
 	switch action := flag.Arg(0); action {
 	case "", "run", "noservice":
@@ -137,6 +143,7 @@ func run(ctx context.Context) {
 			client.ReportInventory(ctx)
 		})
 		tasker.Close()
+		client.Close()
 		return
 	case "gp", "policies", "guestpolicies", "ospackage":
 		policies.Run(ctx)
@@ -156,9 +163,97 @@ func run(ctx context.Context) {
 	}
 }
 
+// watchConfig keeps agentconfig up to date, changes are acted on by
+// agentconfig subscribers.
+func watchConfig(ctx context.Context) {
+	for {
+		if err := agentconfig.WatchConfig(ctx); err != nil {
+			clog.Errorf(ctx, err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// runLogLevelLoop updates the log levels on config changes.
+func runLogLevelLoop(ctx context.Context, changes <-chan agentconfig.ConfigChange) {
+	for change := range changes {
+		if change.Old.LogLevel() != change.New.LogLevel() {
+			clog.SetLevel(change.New.LogLevel())
+			clog.Infof(ctx, "Log level set to %s.", change.New.LogLevel())
+		}
+		if !reflect.DeepEqual(change.Old.ComponentLogLevels(), change.New.ComponentLogLevels()) {
+			clog.SetComponentLevels(change.New.ComponentLogLevels())
+			clog.Infof(ctx, "Component log levels set to %v.", change.New.ComponentLogLevels())
+		}
+	}
+}
+
+// runProxyEnvLoop keeps the proxy environment used by child processes up to
+// date on config changes.
+func runProxyEnvLoop(ctx context.Context, changes <-chan agentconfig.ConfigChange) {
+	for change := range changes {
+		if change.Old.Proxy() != change.New.Proxy() || change.Old.NoProxy() != change.New.NoProxy() {
+			external.SetProxyEnv()
+			clog.Infof(ctx, "Proxy settings changed.")
+		}
+	}
+}
+
+// connHealthLogInterval is how often the health of the connection to the
+// agentendpoint service is logged.
+const connHealthLogInterval = 10 * time.Minute
+
+// runConnHealthLoop logs how calls to the agentendpoint service have been
+// going at debug level, failures are also logged as they start.
+func runConnHealthLoop(ctx context.Context) {
+	ticker := time.NewTicker(connHealthLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			clog.Debugf(ctx, "Connection health: %s", agentendpoint.ConnectionHealth())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// taskRetryMinDelay and taskRetryMaxDelay bound the backoff between checks
+// on a task notification client that has stopped.
+const (
+	taskRetryMinDelay = time.Minute
+	taskRetryMaxDelay = time.Hour
+)
+
+// taskRetryDelay is the poll interval doubled for each check in a row that
+// found the task notification client stopped, between taskRetryMinDelay and
+// taskRetryMaxDelay.
+func taskRetryDelay(failures int) time.Duration {
+	base := agentconfig.SvcPollInterval()
+	if base < taskRetryMinDelay {
+		base = taskRetryMinDelay
+	}
+	d := base
+	for i := 0; i < failures && d < taskRetryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > taskRetryMaxDelay && base < taskRetryMaxDelay {
+		d = taskRetryMaxDelay
+	}
+	return d
+}
+
 func runTaskLoop(ctx context.Context, c chan struct{}) {
+	changes, unsubscribe := agentconfig.Subscribe()
+	defer unsubscribe()
+
 	var taskNotificationClient *agentendpoint.Client
 	var err error
+	failures := 0
 	for {
 		if agentconfig.TaskNotificationEnabled() && (taskNotificationClient == nil || taskNotificationClient.Closed()) {
 			// Start WaitForTaskNotification if we need to.
@@ -182,58 +277,247 @@ func runTaskLoop(ctx context.Context, c chan struct{}) {
 		default:
 		}
 
-		if err := agentconfig.WatchConfig(ctx); err != nil {
-			clog.Errorf(ctx, err.Error())
+		// WaitForTaskNotification gives up for good on some errors, such as the
+		// service not being enabled, and creating the client can fail, so
+		// check back periodically rather than only on config changes.
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if agentconfig.TaskNotificationEnabled() {
+			timer = time.NewTimer(taskRetryDelay(failures))
+			retry = timer.C
 		}
+
 		select {
 		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
 			return
-		default:
-			continue
+		case <-retry:
+			if taskNotificationClient == nil || taskNotificationClient.Closed() {
+				failures++
+				clog.Debugf(ctx, "Task notification client is not running, starting it again.")
+			} else {
+				failures = 0
+			}
+		case change := <-changes:
+			if timer != nil {
+				timer.Stop()
+			}
+			if change.Old.SvcEndpoint() != change.New.SvcEndpoint() && taskNotificationClient != nil && !taskNotificationClient.Closed() {
+				// The client is bound to the old endpoint, close it so it is
+				// recreated above, this will block if there is an existing
+				// current task running.
+				clog.Infof(ctx, "OSConfig endpoint changed to %q, reconnecting task notification client.", change.New.SvcEndpoint())
+				if err := taskNotificationClient.Close(); err != nil {
+					clog.Errorf(ctx, err.Error())
+				}
+			}
 		}
 	}
 }
 
+// periodic is a feature that runs on its own interval, each run is delayed
+// by a random splay so that many instances do not run at the same time.
+type periodic struct {
+	name     string
+	enabled  func(agentconfig.Config) bool
+	interval func(agentconfig.Config) time.Duration
+	splay    func(agentconfig.Config) time.Duration
+	run      func(context.Context)
+	next     time.Time
+}
+
+func randSplay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (p *periodic) schedule(ctx context.Context, cfg agentconfig.Config, now time.Time) {
+	p.next = now.Add(p.interval(cfg) + randSplay(p.splay(cfg)))
+	clog.Debugf(ctx, "Next %s run at %s.", p.name, p.next.Format(time.RFC3339))
+}
+
+// capabilitiesCheckInterval is how often the host is checked for changed
+// capabilities, a change triggers RegisterAgent.
+const capabilitiesCheckInterval = 10 * time.Minute
+
+// runRegisterLoop calls RegisterAgent on start then every
+// RegisterAgentInterval, or sooner if the agent capabilities change.
+func runRegisterLoop(ctx context.Context) {
+	changes, unsubscribe := agentconfig.Subscribe()
+	defer unsubscribe()
+
+	for {
+		if !agentconfig.MetadataDisabled() && (agentconfig.TaskNotificationEnabled() || agentconfig.GuestPoliciesEnabled()) {
+			if client, err := agentendpoint.NewClient(ctx); err != nil {
+				logger.Errorf(err.Error())
+			} else {
+				if err := client.RegisterAgent(ctx); err != nil {
+					logger.Errorf(err.Error())
+				}
+				client.Close()
+			}
+		}
+
+		timer := time.NewTimer(agentconfig.RegisterAgentInterval() + randSplay(agentconfig.RegisterAgentSplay()))
+		capsTicker := time.NewTicker(capabilitiesCheckInterval)
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case <-capsTicker.C:
+				if agentendpoint.CapabilitiesChanged(ctx) {
+					clog.Infof(ctx, "Agent capabilities changed, registering again.")
+					timer.Stop()
+					break wait
+				}
+			case change := <-changes:
+				if change.Old.RegisterAgentInterval() != change.New.RegisterAgentInterval() || change.Old.RegisterAgentSplay() != change.New.RegisterAgentSplay() {
+					timer.Stop()
+					timer = time.NewTimer(change.New.RegisterAgentInterval() + randSplay(change.New.RegisterAgentSplay()))
+				}
+			case <-ctx.Done():
+				timer.Stop()
+				capsTicker.Stop()
+				return
+			}
+		}
+		capsTicker.Stop()
+	}
+}
+
+// restartCheckInterval is how often the restart marker file is checked for.
+const restartCheckInterval = time.Minute
+
+// checkRestart stops the agent, once running tasks complete, if a restart
+// has been requested with the restart marker file.
+func checkRestart(ctx context.Context) {
+	if _, err := os.Stat(agentconfig.RestartFile()); err != nil {
+		return
+	}
+	clog.Infof(ctx, "Restart required marker file exists, beginning agent shutdown, waiting for tasks to complete.")
+	tasker.Close()
+	clog.Infof(ctx, "All tasks completed, stopping agent.")
+	for _, f := range deferredFuncs {
+		f()
+	}
+	os.Exit(2)
+}
+
 func runServiceLoop(ctx context.Context) {
+	changes, unsubscribe := agentconfig.Subscribe()
+	defer unsubscribe()
+	logLevelChanges, logLevelUnsubscribe := agentconfig.Subscribe()
+	defer logLevelUnsubscribe()
+	go runLogLevelLoop(ctx, logLevelChanges)
+	proxyChanges, proxyUnsubscribe := agentconfig.Subscribe()
+	defer proxyUnsubscribe()
+	go runProxyEnvLoop(ctx, proxyChanges)
+	go runConnHealthLoop(ctx)
+
 	// This is just to ensure WaitForTaskNotification runs before any periodocs.
 	c := make(chan struct{})
-	// Configures WaitForTaskNotification, waits for config changes with WatchConfig.
+	// Configures WaitForTaskNotification, reacting to config changes.
 	go runTaskLoop(ctx, c)
 	<-c
+	// Waits for config changes with WatchConfig, this starts after
+	// runTaskLoop has subscribed so no change is missed.
+	go watchConfig(ctx)
+
+	// Runs functions that need to run on a set interval. When more than one
+	// is due they run in this order, inventory should always run after
+	// guest policies.
+	periodics := []*periodic{
+		{
+			name:     "GuestPolicies",
+			enabled:  agentconfig.Config.GuestPoliciesEnabled,
+			interval: agentconfig.Config.GuestPoliciesInterval,
+			splay:    agentconfig.Config.GuestPoliciesSplay,
+			run:      policies.Run,
+		},
+		{
+			name:     "OSInventory",
+			enabled:  agentconfig.Config.OSInventoryEnabled,
+			interval: agentconfig.Config.InventoryInterval,
+			splay:    agentconfig.Config.InventorySplay,
+			run: func(ctx context.Context) {
+				tasker.Enqueue(ctx, "Report OSInventory", func() {
+					client, err := agentendpoint.NewClient(ctx)
+					if err != nil {
+						logger.Errorf(err.Error())
+						return
+					}
+					defer client.Close()
+					client.ReportInventory(ctx)
+				})
+			},
+		},
+	}
+	// The first run is only delayed by the splay.
+	cfg := agentconfig.Current()
+	now := time.Now()
+	for _, p := range periodics {
+		p.next = now.Add(randSplay(p.splay(cfg)))
+	}
+
+	// The restart marker is checked on its own ticker, the periodics can be
+	// hours apart.
+	restartTicker := time.NewTicker(restartCheckInterval)
+	defer restartTicker.Stop()
 
-	// Runs functions that need to run on a set interval.
-	ticker := time.NewTicker(agentconfig.SvcPollInterval())
 	for {
-		if _, err := os.Stat(agentconfig.RestartFile()); err == nil {
-			clog.Infof(ctx, "Restart required marker file exists, beginning agent shutdown, waiting for tasks to complete.")
-			tasker.Close()
-			clog.Infof(ctx, "All tasks completed, stopping agent.")
-			for _, f := range deferredFuncs {
-				f()
+		checkRestart(ctx)
+
+		cfg := agentconfig.Current()
+		now := time.Now()
+		var next time.Time
+		for _, p := range periodics {
+			if !now.Before(p.next) {
+				if p.enabled(cfg) {
+					p.run(ctx)
+				}
+				p.schedule(ctx, cfg, now)
+			}
+			if next.IsZero() || p.next.Before(next) {
+				next = p.next
 			}
-			os.Exit(2)
-		}
-
-		if agentconfig.GuestPoliciesEnabled() {
-			policies.Run(ctx)
 		}
 
-		if agentconfig.OSInventoryEnabled() {
-			// This should always run after ospackage.SetConfig.
-			tasker.Enqueue(ctx, "Report OSInventory", func() {
-				client, err := agentendpoint.NewClient(ctx)
-				if err != nil {
-					logger.Errorf(err.Error())
+		timer := time.NewTimer(next.Sub(now))
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case <-restartTicker.C:
+				checkRestart(ctx)
+			case change := <-changes:
+				rescheduled := false
+				for _, p := range periodics {
+					switch {
+					case !p.enabled(change.Old) && p.enabled(change.New):
+						// Run right away if a periodic feature was just enabled.
+						p.next = time.Now()
+					case p.interval(change.Old) != p.interval(change.New) || p.splay(change.Old) != p.splay(change.New):
+						clog.Infof(ctx, "%s interval changed to %s with a splay of %s.", p.name, p.interval(change.New), p.splay(change.New))
+						p.schedule(ctx, change.New, time.Now())
+					default:
+						continue
+					}
+					rescheduled = true
 				}
-				client.ReportInventory(ctx)
-			})
-		}
-
-		select {
-		case <-ticker.C:
-			continue
-		case <-ctx.Done():
-			return
+				if rescheduled {
+					timer.Stop()
+					break wait
+				}
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
 		}
 	}
 }
@@ -260,6 +544,8 @@ func main() {
 	switch action := flag.Arg(0); action {
 	case "", "run":
 		runService(ctx)
+	case "config":
+		os.Exit(runConfig(flag.Args()[1:]))
 	default:
 		run(ctx)
 	}
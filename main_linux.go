@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 )
 
 func runService(ctx context.Context) {
@@ -29,7 +30,7 @@ func runService(ctx context.Context) {
 }
 
 func obtainLock() {
-	lockFile := "/run/lock/osconfig_agent.lock"
+	lockFile := agentconfig.LockFile()
 
 	err := os.MkdirAll(filepath.Dir(lockFile), 0755)
 	if err != nil && !os.IsExist(err) {
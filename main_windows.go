@@ -23,6 +23,7 @@ import (
 	"unsafe"
 
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 )
@@ -73,7 +74,7 @@ func unlockFileEx(hFile uintptr, nNumberOfBytesToLockLow, nNumberOfBytesToLockHi
 }
 
 func obtainLock() {
-	lockFile := `C:\Program Files\Google\OSConfig\lock`
+	lockFile := agentconfig.LockFile()
 
 	err := os.MkdirAll(filepath.Dir(lockFile), 0755)
 	if err != nil && !os.IsExist(err) {
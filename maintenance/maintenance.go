@@ -0,0 +1,202 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package maintenance parses and evaluates recurring maintenance windows,
+// disruptive work such as patching, reboots and package changes is only
+// allowed inside a window.
+package maintenance
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring maintenance window.
+//
+// A window opens at start on each of its days and stays open until end, if
+// end is not after start the window runs past midnight into the next day.
+type Window struct {
+	spec       string
+	days       [7]bool
+	start, end int // Minutes since midnight.
+	loc        *time.Location
+}
+
+// Parse parses a window spec of the form "<days> <HH:MM>-<HH:MM> [<timezone>]",
+// for example "Mon-Fri 22:00-06:00 America/New_York" or "Sat,Sun 00:00-24:00".
+// Days are a comma separated list of weekdays or weekday ranges, or "*" for
+// every day. The timezone is an IANA name and defaults to UTC.
+func Parse(spec string) (Window, error) {
+	w := Window{spec: spec, loc: time.UTC}
+	fields := strings.Fields(spec)
+	if len(fields) != 2 && len(fields) != 3 {
+		return Window{}, fmt.Errorf("maintenance window %q is not of the form \"<days> <HH:MM>-<HH:MM> [<timezone>]\"", spec)
+	}
+
+	if err := w.parseDays(fields[0]); err != nil {
+		return Window{}, fmt.Errorf("maintenance window %q: %v", spec, err)
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return Window{}, fmt.Errorf("maintenance window %q: time range %q is not of the form HH:MM-HH:MM", spec, fields[1])
+	}
+	var err error
+	if w.start, err = parseTime(times[0]); err != nil || w.start == 24*60 {
+		return Window{}, fmt.Errorf("maintenance window %q: invalid start time %q", spec, times[0])
+	}
+	if w.end, err = parseTime(times[1]); err != nil {
+		return Window{}, fmt.Errorf("maintenance window %q: invalid end time %q", spec, times[1])
+	}
+
+	if len(fields) == 3 {
+		if w.loc, err = time.LoadLocation(fields[2]); err != nil {
+			return Window{}, fmt.Errorf("maintenance window %q: %v", spec, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *Window) parseDays(s string) error {
+	if s == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.Split(r, "-")
+		if len(parts) > 2 {
+			return fmt.Errorf("invalid day range %q", r)
+		}
+		from, ok := weekdays[strings.ToLower(parts[0])]
+		if !ok {
+			return fmt.Errorf("unknown day %q", parts[0])
+		}
+		to := from
+		if len(parts) == 2 {
+			if to, ok = weekdays[strings.ToLower(parts[1])]; !ok {
+				return fmt.Errorf("unknown day %q", parts[1])
+			}
+		}
+		// Ranges may wrap around the end of the week, e.g. Fri-Mon.
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTime parses HH:MM into minutes since midnight, 24:00 is allowed so a
+// window can run to the end of the day.
+func parseTime(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("time %q is not of the form HH:MM", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("time %q out of range", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w Window) String() string {
+	return w.spec
+}
+
+// Contains reports whether t is inside the window.
+func (w Window) Contains(t time.Time) bool {
+	lt := t.In(w.loc)
+	m := lt.Hour()*60 + lt.Minute()
+	if w.start < w.end {
+		return w.days[lt.Weekday()] && m >= w.start && m < w.end
+	}
+	// The window runs past midnight, it is either in the part that opened
+	// today or the part that opened yesterday.
+	if w.days[lt.Weekday()] && m >= w.start {
+		return true
+	}
+	return w.days[(lt.Weekday()+6)%7] && m < w.end
+}
+
+// nextStart returns the first time after t the window opens.
+func (w Window) nextStart(t time.Time) time.Time {
+	lt := t.In(w.loc)
+	for d := 0; d <= 7; d++ {
+		day := lt.AddDate(0, 0, d)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, w.loc)
+		if start.After(t) {
+			return start
+		}
+	}
+	// Not reached for a window with at least one day.
+	return time.Time{}
+}
+
+// OutsideWindowError is returned by Check when disruptive work is not
+// allowed.
+type OutsideWindowError struct {
+	// Next is when the next window opens.
+	Next time.Time
+}
+
+func (e *OutsideWindowError) Error() string {
+	return fmt.Sprintf("outside of a maintenance window, the next window opens at %s", e.Next.Format(time.RFC3339))
+}
+
+// Check returns an *OutsideWindowError if windows are configured and t is not
+// inside any of them, no windows means disruptive work is always allowed.
+func Check(windows []Window, t time.Time) error {
+	if len(windows) == 0 {
+		return nil
+	}
+
+	var next time.Time
+	for _, w := range windows {
+		if w.Contains(t) {
+			return nil
+		}
+		if n := w.nextStart(t); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return &OutsideWindowError{Next: next}
+}
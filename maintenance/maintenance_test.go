@@ -0,0 +1,111 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package maintenance
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"Mon",
+		"Mon 09:00",
+		"Mon 09:00-17:00 UTC extra",
+		"Funday 09:00-17:00",
+		"Mon-Tue-Wed 09:00-17:00",
+		"Mon 9-17",
+		"Mon 24:00-17:00",
+		"Mon 09:60-17:00",
+		"Mon 09:00-24:30",
+		"Mon 09:00-17:00 Not/AZone",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q): expected error", spec)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	// 2020-06-01 is a Monday.
+	monday := func(hour, min int) time.Time {
+		return time.Date(2020, 6, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"Mon-Fri 09:00-17:00", monday(9, 0), true},
+		{"Mon-Fri 09:00-17:00", monday(16, 59), true},
+		{"Mon-Fri 09:00-17:00", monday(17, 0), false},
+		{"Mon-Fri 09:00-17:00", monday(8, 59), false},
+		{"Tue-Fri 09:00-17:00", monday(12, 0), false},
+		{"Fri-Mon 09:00-17:00", monday(12, 0), true},
+		{"Sat,Sun 00:00-24:00", monday(0, 0), false},
+		{"Sat,Sun 00:00-24:00", monday(-1, 0), true},
+		{"* 00:00-24:00", monday(12, 0), true},
+		// Past midnight, the part opened on Sunday and the part opened
+		// on Monday.
+		{"Sun-Mon 22:00-06:00", monday(5, 59), true},
+		{"Sun-Mon 22:00-06:00", monday(22, 0), true},
+		{"Mon 22:00-06:00", monday(5, 59), false},
+		{"Mon 22:00-06:00", monday(6, 0), false},
+		// 09:00 in New York is 13:00 UTC in June.
+		{"Mon 09:00-10:00 America/New_York", monday(13, 30), true},
+		{"Mon 09:00-10:00 America/New_York", monday(9, 30), false},
+	}
+	for _, tt := range tests {
+		w, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): unexpected error: %v", tt.spec, err)
+		}
+		if got := w.Contains(tt.t); got != tt.want {
+			t.Errorf("%q.Contains(%s): got(%t) != want(%t)", tt.spec, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check(nil, time.Now()); err != nil {
+		t.Errorf("Check with no windows: unexpected error: %v", err)
+	}
+
+	var windows []Window
+	for _, spec := range []string{"Tue 22:00-02:00", "Sat 01:00-03:00"} {
+		w, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): unexpected error: %v", spec, err)
+		}
+		windows = append(windows, w)
+	}
+
+	// Monday 2020-06-01, the next window opens Tuesday at 22:00.
+	err := Check(windows, time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	owErr, ok := err.(*OutsideWindowError)
+	if !ok {
+		t.Fatalf("Check: got(%v) want an *OutsideWindowError", err)
+	}
+	if want := time.Date(2020, 6, 2, 22, 0, 0, 0, time.UTC); !owErr.Next.Equal(want) {
+		t.Errorf("Next: got(%s) != want(%s)", owErr.Next, want)
+	}
+
+	// Wednesday 01:00 is inside the window opened on Tuesday.
+	if err := Check(windows, time.Date(2020, 6, 3, 1, 0, 0, 0, time.UTC)); err != nil {
+		t.Errorf("Check: unexpected error: %v", err)
+	}
+}
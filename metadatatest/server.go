@@ -0,0 +1,459 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package metadatatest provides a fake GCE metadata server for development
+// and tests.
+//
+// It serves project and instance attributes, recursive JSON and etag based
+// hanging GETs (wait_for_change), a writable guest attributes store and
+// signed instance identity tokens. Point the agent at it with the
+// GCE_METADATA_HOST environment variable:
+//
+//	srv, err := metadatatest.NewServer()
+//	...
+//	ts := httptest.NewServer(srv)
+//	defer ts.Close()
+//	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(ts.URL, "http://"))
+//
+// Unlike the real server there is a single etag for all of the metadata, a
+// hanging GET on any path returns when anything changes. Attributes can
+// also be set with PUT and removed with DELETE so a developer can trigger
+// changes with curl.
+package metadatatest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/jws"
+)
+
+const (
+	pathPrefix      = "/computeMetadata/v1/"
+	guestAttributes = "instance/guest-attributes/"
+	identityPath    = "instance/service-accounts/default/identity"
+	// maxWait bounds hanging GETs without a timeout_sec.
+	maxWait = 5 * time.Minute
+)
+
+// Scope is where an attribute is set.
+type Scope string
+
+// Attribute scopes.
+const (
+	Project  Scope = "project"
+	Instance Scope = "instance"
+)
+
+// InstanceInfo describes the instance the Server pretends to be.
+type InstanceInfo struct {
+	ProjectID        string
+	NumericProjectID int64
+	// Zone is in the form projects/<number>/zones/<zone>.
+	Zone string
+	Name string
+	ID   int64
+}
+
+// DefaultInstance is the instance a new Server describes.
+var DefaultInstance = InstanceInfo{
+	ProjectID:        "test-project",
+	NumericProjectID: 123456,
+	Zone:             "projects/123456/zones/us-west1-b",
+	Name:             "test-instance",
+	ID:               1234567890,
+}
+
+// Server is a fake metadata server, it is an http.Handler. It is safe for
+// concurrent use.
+type Server struct {
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	instance InstanceInfo
+	attrs    map[Scope]map[string]string
+	guest    map[string]string
+	version  int
+	// changed is closed, and replaced, when the metadata changes.
+	changed chan struct{}
+}
+
+// NewServer returns a Server with no attributes describing DefaultInstance.
+func NewServer() (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generating token signing key: %v", err)
+	}
+	return &Server{
+		key:      key,
+		instance: DefaultInstance,
+		attrs:    map[Scope]map[string]string{Project: {}, Instance: {}},
+		guest:    map[string]string{},
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// PublicKey is the key that verifies identity tokens from the Server.
+func (s *Server) PublicKey() *rsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+// SetInstance changes the instance the Server describes.
+func (s *Server) SetInstance(i InstanceInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instance = i
+	s.changeLocked()
+}
+
+// SetAttribute sets a project or instance attribute.
+func (s *Server) SetAttribute(scope Scope, key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[scope][key] = value
+	s.changeLocked()
+}
+
+// DeleteAttribute removes a project or instance attribute.
+func (s *Server) DeleteAttribute(scope Scope, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attrs[scope], key)
+	s.changeLocked()
+}
+
+// GuestAttribute returns a guest attribute written to the Server, path is
+// <namespace>/<key>.
+func (s *Server) GuestAttribute(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.guest[path]
+	return v, ok
+}
+
+// GuestAttributes returns all the guest attributes written to the Server
+// keyed by <namespace>/<key>.
+func (s *Server) GuestAttributes() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ga := map[string]string{}
+	for k, v := range s.guest {
+		ga[k] = v
+	}
+	return ga
+}
+
+// changeLocked moves to a new etag and wakes hanging GETs, s.mu must be
+// held.
+func (s *Server) changeLocked() {
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) etagLocked() string {
+	return fmt.Sprintf("%016x", s.version)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "Missing Metadata-Flavor:Google header.", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Metadata-Flavor", "Google")
+	var path string
+	switch {
+	case r.URL.Path+"/" == pathPrefix:
+	case strings.HasPrefix(r.URL.Path, pathPrefix):
+		path = strings.TrimPrefix(r.URL.Path, pathPrefix)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.get(w, r, path)
+	case http.MethodPut:
+		s.put(w, r, path)
+	case http.MethodDelete:
+		s.delete(w, r, path)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, path string) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(path, guestAttributes) {
+		key := strings.TrimPrefix(path, guestAttributes)
+		if strings.Count(key, "/") != 1 || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+			http.Error(w, "Guest attributes are <namespace>/<key>.", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.guest[key] = string(b)
+		s.mu.Unlock()
+		return
+	}
+	scope, key, ok := attributePath(path)
+	if !ok {
+		http.Error(w, "Only attributes and guest attributes can be written.", http.StatusMethodNotAllowed)
+		return
+	}
+	s.SetAttribute(scope, key, string(b))
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, path string) {
+	if strings.HasPrefix(path, guestAttributes) {
+		s.mu.Lock()
+		delete(s.guest, strings.TrimPrefix(path, guestAttributes))
+		s.mu.Unlock()
+		return
+	}
+	scope, key, ok := attributePath(path)
+	if !ok {
+		http.Error(w, "Only attributes and guest attributes can be deleted.", http.StatusMethodNotAllowed)
+		return
+	}
+	s.DeleteAttribute(scope, key)
+}
+
+// attributePath splits project/attributes/<key> and
+// instance/attributes/<key>.
+func attributePath(path string) (Scope, string, bool) {
+	for _, scope := range []Scope{Project, Instance} {
+		prefix := string(scope) + "/attributes/"
+		if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+			return scope, strings.TrimPrefix(path, prefix), true
+		}
+	}
+	return "", "", false
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, path string) {
+	q := r.URL.Query()
+	if path == identityPath {
+		s.identity(w, q.Get("audience"), q.Get("format") == "full")
+		return
+	}
+
+	if q.Get("wait_for_change") == "true" {
+		if err := s.wait(r, q.Get("last_etag"), q.Get("timeout_sec")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	tree := s.treeLocked()
+	etag := s.etagLocked()
+	s.mu.Unlock()
+
+	node, ok := lookup(tree, path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Etag", etag)
+
+	dir, isDir := node.(map[string]interface{})
+	switch {
+	case q.Get("recursive") == "true" || q.Get("alt") == "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jsonNode(node, strings.HasSuffix(strings.TrimSuffix(path, "/"), "attributes")))
+	case isDir:
+		w.Header().Set("Content-Type", "text/plain")
+		var keys []string
+		for k, v := range dir {
+			if _, ok := v.(map[string]interface{}); ok {
+				k += "/"
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, strings.Join(keys, "\n"))
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, node)
+	}
+}
+
+// wait blocks a hanging GET until the metadata no longer has lastEtag, or
+// changes if there is none, or the timeout passes.
+func (s *Server) wait(r *http.Request, lastEtag, timeoutSec string) error {
+	timeout := maxWait
+	if timeoutSec != "" {
+		sec, err := strconv.Atoi(timeoutSec)
+		if err != nil || sec <= 0 {
+			return fmt.Errorf("invalid timeout_sec %q", timeoutSec)
+		}
+		timeout = time.Duration(sec) * time.Second
+	}
+
+	s.mu.Lock()
+	if lastEtag != "" && lastEtag != s.etagLocked() {
+		s.mu.Unlock()
+		return nil
+	}
+	changed := s.changed
+	s.mu.Unlock()
+
+	select {
+	case <-changed:
+	case <-time.After(timeout):
+	case <-r.Context().Done():
+	}
+	return nil
+}
+
+// treeLocked returns the metadata as nested maps with the names used in
+// paths, s.mu must be held.
+func (s *Server) treeLocked() map[string]interface{} {
+	attrs := func(scope Scope) map[string]interface{} {
+		m := map[string]interface{}{}
+		for k, v := range s.attrs[scope] {
+			m[k] = v
+		}
+		return m
+	}
+	guest := map[string]interface{}{}
+	for k, v := range s.guest {
+		i := strings.Index(k, "/")
+		ns, ok := guest[k[:i]].(map[string]interface{})
+		if !ok {
+			ns = map[string]interface{}{}
+			guest[k[:i]] = ns
+		}
+		ns[k[i+1:]] = v
+	}
+	return map[string]interface{}{
+		"instance": map[string]interface{}{
+			"attributes":       attrs(Instance),
+			"guest-attributes": guest,
+			"id":               json.Number(strconv.FormatInt(s.instance.ID, 10)),
+			"name":             s.instance.Name,
+			"zone":             s.instance.Zone,
+			"hostname":         s.instance.Name,
+		},
+		"project": map[string]interface{}{
+			"attributes":         attrs(Project),
+			"project-id":         s.instance.ProjectID,
+			"numeric-project-id": json.Number(strconv.FormatInt(s.instance.NumericProjectID, 10)),
+		},
+	}
+}
+
+func lookup(tree map[string]interface{}, path string) (interface{}, bool) {
+	var node interface{} = tree
+	for _, p := range strings.Split(strings.Trim(path, "/"), "/") {
+		if p == "" {
+			continue
+		}
+		dir, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = dir[p]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// jsonNode converts the names in node to the camel case the metadata server
+// uses in JSON, except for attribute names which are kept as is.
+func jsonNode(node interface{}, attributes bool) interface{} {
+	dir, ok := node.(map[string]interface{})
+	if !ok {
+		return node
+	}
+	out := map[string]interface{}{}
+	for k, v := range dir {
+		name := k
+		if !attributes {
+			name = camelCase(k)
+		}
+		out[name] = jsonNode(v, !attributes && k == "attributes")
+	}
+	return out
+}
+
+func camelCase(s string) string {
+	parts := strings.Split(s, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// identity writes an instance identity token for audience signed with the
+// Server's key.
+func (s *Server) identity(w http.ResponseWriter, audience string, full bool) {
+	if audience == "" {
+		http.Error(w, "audience is required.", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	inst := s.instance
+	s.mu.Unlock()
+
+	now := time.Now()
+	cs := &jws.ClaimSet{
+		Iss: "https://accounts.google.com",
+		Aud: audience,
+		Sub: strconv.FormatInt(inst.ID, 10),
+		Iat: now.Unix(),
+		Exp: now.Add(time.Hour).Unix(),
+	}
+	if full {
+		cs.PrivateClaims = map[string]interface{}{
+			"google": map[string]interface{}{
+				"compute_engine": map[string]interface{}{
+					"project_id":     inst.ProjectID,
+					"project_number": inst.NumericProjectID,
+					"zone":           zoneName(inst.Zone),
+					"instance_id":    strconv.FormatInt(inst.ID, 10),
+					"instance_name":  inst.Name,
+				},
+			},
+		}
+	}
+	token, err := jws.Encode(&jws.Header{Algorithm: "RS256", Typ: "JWT"}, cs, s.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, token)
+}
+
+func zoneName(zone string) string {
+	return zone[strings.LastIndex(zone, "/")+1:]
+}
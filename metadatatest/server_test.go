@@ -0,0 +1,162 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package metadatatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/jws"
+)
+
+func do(method, url, body string) (string, http.Header, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%s %s: got status %s: %s", method, url, resp.Status, b)
+	}
+	return string(b), resp.Header, nil
+}
+
+func request(t *testing.T, method, url, body string) (string, http.Header) {
+	t.Helper()
+	b, h, err := do(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, h
+}
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	base := ts.URL + "/computeMetadata/v1/"
+
+	srv.SetAttribute(Project, "enable-osconfig", "true")
+	srv.SetAttribute(Instance, "osconfig-poll-interval", "5")
+
+	if got, _ := request(t, "GET", base+"instance/attributes/osconfig-poll-interval", ""); got != "5" {
+		t.Errorf("instance attribute: got %q, want %q", got, "5")
+	}
+
+	// The recursive JSON has the shape the agent reads.
+	body, h := request(t, "GET", base+"?recursive=true&alt=json", "")
+	var md struct {
+		Instance struct {
+			Attributes map[string]string
+			Zone       string
+			ID         json.Number
+		}
+		Project struct {
+			Attributes       map[string]string
+			ProjectID        string
+			NumericProjectID int64
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &md); err != nil {
+		t.Fatalf("error parsing %s: %v", body, err)
+	}
+	if md.Project.Attributes["enable-osconfig"] != "true" || md.Instance.Attributes["osconfig-poll-interval"] != "5" ||
+		md.Project.ProjectID != DefaultInstance.ProjectID || md.Project.NumericProjectID != DefaultInstance.NumericProjectID ||
+		md.Instance.Zone != DefaultInstance.Zone || md.Instance.ID.String() != "1234567890" {
+		t.Errorf("unexpected recursive metadata: %s", body)
+	}
+
+	// A hanging GET returns at once for a stale etag and otherwise when the
+	// metadata changes.
+	etag := h.Get("Etag")
+	if _, h := request(t, "GET", base+"?recursive=true&alt=json&wait_for_change=true&last_etag=stale", ""); h.Get("Etag") != etag {
+		t.Errorf("hanging GET with a stale etag: got etag %q, want %q", h.Get("Etag"), etag)
+	}
+	done := make(chan string)
+	go func() {
+		body, _, err := do("GET", base+"instance/attributes/osconfig-poll-interval?wait_for_change=true&last_etag="+etag, "")
+		if err != nil {
+			body = err.Error()
+		}
+		done <- body
+	}()
+	select {
+	case <-done:
+		t.Fatal("hanging GET returned before the metadata changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	request(t, "PUT", base+"instance/attributes/osconfig-poll-interval", "10")
+	if got := <-done; got != "10" {
+		t.Errorf("hanging GET: got %q, want %q", got, "10")
+	}
+
+	// Guest attributes are writable.
+	request(t, "PUT", base+"instance/guest-attributes/guestInventory/Hostname", "test-host")
+	if got, ok := srv.GuestAttribute("guestInventory/Hostname"); !ok || got != "test-host" {
+		t.Errorf("GuestAttribute: got %q %t, want %q", got, ok, "test-host")
+	}
+	if got, _ := request(t, "GET", base+"instance/guest-attributes/guestInventory/Hostname", ""); got != "test-host" {
+		t.Errorf("guest attribute: got %q, want %q", got, "test-host")
+	}
+
+	// Identity tokens are signed by the server's key.
+	token, _ := request(t, "GET", base+"instance/service-accounts/default/identity?audience=osconfig.googleapis.com&format=full", "")
+	if err := jws.Verify(token, srv.PublicKey()); err != nil {
+		t.Errorf("identity token does not verify: %v", err)
+	}
+	cs, err := jws.Decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Aud != "osconfig.googleapis.com" || time.Unix(cs.Exp, 0).Before(time.Now()) {
+		t.Errorf("unexpected identity token claims: %+v", cs)
+	}
+}
+
+func TestServerRequiresMetadataFlavor(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/computeMetadata/v1/instance/zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %s, want %d", resp.Status, http.StatusForbidden)
+	}
+}
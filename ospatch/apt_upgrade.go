@@ -60,8 +60,9 @@ func AptGetDryRun(dryrun bool) AptGetUpgradeOption {
 	}
 }
 
-// RunAptGetUpgrade runs apt-get upgrade.
-func RunAptGetUpgrade(ctx context.Context, opts ...AptGetUpgradeOption) error {
+// RunAptGetUpgrade runs apt-get upgrade and returns the result for each
+// package it updated or tried to update.
+func RunAptGetUpgrade(ctx context.Context, opts ...AptGetUpgradeOption) ([]PackageResult, error) {
 	aptOpts := &aptGetUpgradeOpts{
 		upgradeType:       packages.AptGetUpgrade,
 		excludes:          nil,
@@ -75,16 +76,16 @@ func RunAptGetUpgrade(ctx context.Context, opts ...AptGetUpgradeOption) error {
 
 	pkgs, err := packages.AptUpdates(ctx, packages.AptGetUpgradeType(aptOpts.upgradeType), packages.AptGetUpgradeShowNew(true))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	fPkgs, err := filterPackages(pkgs, aptOpts.exclusivePackages, aptOpts.excludes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(fPkgs) == 0 {
 		clog.Infof(ctx, "No packages to update.")
-		return nil
+		return nil, nil
 	}
 
 	var pkgNames []string
@@ -92,12 +93,14 @@ func RunAptGetUpgrade(ctx context.Context, opts ...AptGetUpgradeOption) error {
 		pkgNames = append(pkgNames, pkg.Name)
 	}
 
+	before := queryInstalled(ctx, installedDebPackages)
 	msg := fmt.Sprintf("%d packages: %s", len(pkgNames), fPkgs)
 	if aptOpts.dryrun {
 		clog.Infof(ctx, "Running in dryrun mode, not updating %s", msg)
-		return nil
+		return packageResults(fPkgs, before, nil, nil), nil
 	}
 	clog.Infof(ctx, "Updating %s", msg)
 
-	return packages.InstallAptPackages(ctx, pkgNames)
+	err = packages.InstallAptPackages(ctx, pkgNames)
+	return packageResults(fPkgs, before, queryInstalled(ctx, installedDebPackages), err), err
 }
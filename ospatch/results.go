@@ -0,0 +1,139 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ospatch
+
+import (
+	"context"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/packages"
+)
+
+// PackageState is the outcome for a single package or patch.
+type PackageState string
+
+const (
+	// PackageUpdated means a new version of the package is installed.
+	PackageUpdated PackageState = "UPDATED"
+	// PackageFailed means the package manager ran but the package did not
+	// change.
+	PackageFailed PackageState = "FAILED"
+	// PackageDryRun means the package would have been updated.
+	PackageDryRun PackageState = "DRY_RUN"
+)
+
+// PackageResult is the result of updating a single package or patch.
+type PackageResult struct {
+	Name string
+	Arch string `json:",omitempty"`
+	// Patch is set for Zypper patches, which have no versions.
+	Patch bool `json:",omitempty"`
+	// OldVersion is the version installed before the update, a comma
+	// separated list if several are, empty for a new package.
+	OldVersion string `json:",omitempty"`
+	// TargetVersion is the version the package manager offered.
+	TargetVersion string `json:",omitempty"`
+	// NewVersion is the version installed by the update.
+	NewVersion string `json:",omitempty"`
+	State      PackageState
+	// Error is the package manager error for a failed package.
+	Error string `json:",omitempty"`
+}
+
+// installedVersions maps package names to their installed versions, there
+// can be several, for example for kernels.
+type installedVersions map[string][]string
+
+// installedDebPackages and installedRPMPackages are replaced in tests.
+var (
+	installedDebPackages = packages.InstalledDebPackages
+	installedRPMPackages = packages.InstalledRPMPackages
+)
+
+// queryInstalled returns the installed versions from query. Results are
+// best effort, an error is logged and gives no versions rather than failing
+// the update.
+func queryInstalled(ctx context.Context, query func(context.Context) ([]packages.PkgInfo, error)) installedVersions {
+	pkgs, err := query(ctx)
+	if err != nil {
+		clog.Warningf(ctx, "Error listing installed packages, package results will not include versions: %v", err)
+		return nil
+	}
+	iv := installedVersions{}
+	for _, pkg := range pkgs {
+		iv[pkg.Name] = append(iv[pkg.Name], pkg.Version)
+	}
+	return iv
+}
+
+// packageResults compares the installed versions before and after an update
+// of pkgs, installErr is the error from the package manager if any. A nil
+// after means this was a dry run.
+func packageResults(pkgs []packages.PkgInfo, before, after installedVersions, installErr error) []PackageResult {
+	var results []PackageResult
+	for _, pkg := range pkgs {
+		r := PackageResult{
+			Name:          pkg.Name,
+			Arch:          pkg.Arch,
+			OldVersion:    strings.Join(before[pkg.Name], ","),
+			TargetVersion: pkg.Version,
+		}
+		switch {
+		case after == nil:
+			r.State = PackageDryRun
+		default:
+			r.NewVersion = newVersion(before[pkg.Name], after[pkg.Name])
+			if r.NewVersion != "" {
+				r.State = PackageUpdated
+			} else {
+				r.State = PackageFailed
+				if installErr != nil {
+					r.Error = installErr.Error()
+				}
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// newVersion returns the first version in after that is not in before.
+func newVersion(before, after []string) string {
+	for _, v := range after {
+		if !containsString(before, v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// patchResults are the results for Zypper patches, which succeed or fail as
+// a whole with the package manager.
+func patchResults(patches []packages.ZypperPatch, dryrun bool, installErr error) []PackageResult {
+	var results []PackageResult
+	for _, patch := range patches {
+		r := PackageResult{Name: patch.Name, Patch: true, State: PackageUpdated}
+		switch {
+		case dryrun:
+			r.State = PackageDryRun
+		case installErr != nil:
+			r.State = PackageFailed
+			r.Error = installErr.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,57 @@
+//  Copyright 2020 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ospatch
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/osconfig/packages"
+)
+
+func TestPackageResults(t *testing.T) {
+	pkgs := []packages.PkgInfo{
+		{Name: "foo", Arch: "x86_64", Version: "2.0"},
+		{Name: "kernel", Arch: "x86_64", Version: "5.0"},
+		{Name: "bar", Arch: "all", Version: "3.0"},
+	}
+	before := installedVersions{"foo": {"1.0"}, "kernel": {"4.0"}, "bar": {"2.0"}}
+	// A new kernel is installed alongside the old one and bar failed.
+	after := installedVersions{"foo": {"2.0"}, "kernel": {"4.0", "5.0"}, "bar": {"2.0"}}
+	installErr := errors.New("bar is broken")
+
+	got := packageResults(pkgs, before, after, installErr)
+	want := []PackageResult{
+		{Name: "foo", Arch: "x86_64", OldVersion: "1.0", TargetVersion: "2.0", NewVersion: "2.0", State: PackageUpdated},
+		{Name: "kernel", Arch: "x86_64", OldVersion: "4.0", TargetVersion: "5.0", NewVersion: "5.0", State: PackageUpdated},
+		{Name: "bar", Arch: "all", OldVersion: "2.0", TargetVersion: "3.0", State: PackageFailed, Error: "bar is broken"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("packageResults: got %+v, want %+v", got, want)
+	}
+
+	got = packageResults(pkgs[:1], before, nil, nil)
+	want = []PackageResult{{Name: "foo", Arch: "x86_64", OldVersion: "1.0", TargetVersion: "2.0", State: PackageDryRun}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("packageResults for a dry run: got %+v, want %+v", got, want)
+	}
+
+	got = patchResults([]packages.ZypperPatch{{Name: "SUSE-1"}}, false, installErr)
+	want = []PackageResult{{Name: "SUSE-1", Patch: true, State: PackageFailed, Error: "bar is broken"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("patchResults: got %+v, want %+v", got, want)
+	}
+}
@@ -78,8 +78,9 @@ func YumDryRun(dryrun bool) YumUpdateOption {
 	}
 }
 
-// RunYumUpdate runs yum update.
-func RunYumUpdate(ctx context.Context, opts ...YumUpdateOption) error {
+// RunYumUpdate runs yum update and returns the result for each package it
+// updated or tried to update.
+func RunYumUpdate(ctx context.Context, opts ...YumUpdateOption) ([]PackageResult, error) {
 	yumOpts := &yumUpdateOpts{
 		security: false,
 		minimal:  false,
@@ -92,18 +93,18 @@ func RunYumUpdate(ctx context.Context, opts ...YumUpdateOption) error {
 
 	pkgs, err := packages.YumUpdates(ctx, packages.YumUpdateMinimal(yumOpts.minimal), packages.YumUpdateSecurity(yumOpts.security), packages.YumExcludes(yumOpts.excludes))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Yum excludes are already excluded while listing yumUpdates, so we send
 	// and empty list.
 	fPkgs, err := filterPackages(pkgs, yumOpts.exclusivePackages, []string{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(fPkgs) == 0 {
 		clog.Infof(ctx, "No packages to update.")
-		return nil
+		return nil, nil
 	}
 
 	var pkgNames []string
@@ -111,12 +112,14 @@ func RunYumUpdate(ctx context.Context, opts ...YumUpdateOption) error {
 		pkgNames = append(pkgNames, pkg.Name)
 	}
 
+	before := queryInstalled(ctx, installedRPMPackages)
 	msg := fmt.Sprintf("%d packages: %s", len(pkgNames), fPkgs)
 	if yumOpts.dryrun {
 		clog.Infof(ctx, "Running in dryrun mode, not updating %s", msg)
-		return nil
+		return packageResults(fPkgs, before, nil, nil), nil
 	}
 	clog.Infof(ctx, "Updating %s", msg)
 
-	return packages.InstallYumPackages(ctx, pkgNames)
+	err = packages.InstallYumPackages(ctx, pkgNames)
+	return packageResults(fPkgs, before, queryInstalled(ctx, installedRPMPackages), err), err
 }
@@ -18,6 +18,7 @@ import (
 	"context"
 	"os"
 	"os/exec"
+	"reflect"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/osconfig/packages"
@@ -56,10 +57,26 @@ func TestRunYumUpdateWithSecurity(t *testing.T) {
 	packages.SetPtyCommandRunner(mockCommandRunner)
 	mockCommandRunner.EXPECT().Run(ctx, exec.Command("/usr/bin/yum", []string{"update", "--assumeno", "--cacheonly", "--security"}...)).Return(data, []byte("stderr"), nil).Times(1)
 
-	err = RunYumUpdate(ctx, YumUpdateMinimal(false), YumUpdateSecurity(true))
+	// foo is at 1.0.0-1 before the update and 2.0.0-1 after.
+	installed := [][]packages.PkgInfo{
+		{{Name: "foo", Arch: "all", Version: "1.0.0-1"}},
+		{{Name: "foo", Arch: "all", Version: "2.0.0-1"}},
+	}
+	installedRPMPackages = func(context.Context) ([]packages.PkgInfo, error) {
+		pkgs := installed[0]
+		installed = installed[1:]
+		return pkgs, nil
+	}
+	defer func() { installedRPMPackages = packages.InstalledRPMPackages }()
+
+	results, err := RunYumUpdate(ctx, YumUpdateMinimal(false), YumUpdateSecurity(true))
 	if err != nil {
 		t.Errorf("did not expect error: %+v", err)
 	}
+	want := []PackageResult{{Name: "foo", Arch: "all", OldVersion: "1.0.0-1", TargetVersion: "2.0.0-1", NewVersion: "2.0.0-1", State: PackageUpdated}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("RunYumUpdate results: got %+v, want %+v", results, want)
+	}
 }
 
 func TestRunYumUpdateWithSecurityWithExclusives(t *testing.T) {
@@ -98,7 +115,10 @@ func TestRunYumUpdateWithSecurityWithExclusives(t *testing.T) {
 	packages.SetPtyCommandRunner(mockCommandRunner)
 	mockCommandRunner.EXPECT().Run(ctx, exec.Command("/usr/bin/yum", []string{"update", "--assumeno", "--cacheonly", "--security"}...)).Return(data, []byte("stderr"), nil).Times(1)
 
-	err = RunYumUpdate(ctx, YumUpdateMinimal(false), YumUpdateSecurity(true), YumExclusivePackages(exclusivePackages))
+	installedRPMPackages = func(context.Context) ([]packages.PkgInfo, error) { return nil, nil }
+	defer func() { installedRPMPackages = packages.InstalledRPMPackages }()
+
+	_, err = RunYumUpdate(ctx, YumUpdateMinimal(false), YumUpdateSecurity(true), YumExclusivePackages(exclusivePackages))
 	if err != nil {
 		t.Errorf("did not expect error: %+v", err)
 	}
@@ -96,8 +96,9 @@ func ZypperUpdateDryrun(dryrun bool) ZypperPatchOption {
 	}
 }
 
-// RunZypperPatch runs zypper patch.
-func RunZypperPatch(ctx context.Context, opts ...ZypperPatchOption) error {
+// RunZypperPatch runs zypper patch and returns the result for each patch and
+// package it installed or tried to install.
+func RunZypperPatch(ctx context.Context, opts ...ZypperPatchOption) ([]PackageResult, error) {
 	zOpts := &zypperPatchOpts{
 		excludes:         nil,
 		exclusivePatches: nil,
@@ -120,7 +121,7 @@ func RunZypperPatch(ctx context.Context, opts ...ZypperPatchOption) error {
 	}
 	patches, err := packages.ZypperPatches(ctx, zListOpts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// if user specifies, --with-update get the necessary patch/package
@@ -130,11 +131,11 @@ func RunZypperPatch(ctx context.Context, opts ...ZypperPatchOption) error {
 	if zOpts.withUpdate {
 		pkgUpdates, err = packages.ZypperUpdates(ctx)
 		if err != nil {
-			return nil
+			return nil, nil
 		}
 		pkgToPatchesMap, err = packages.ZypperPackagesInPatch(ctx, patches)
 		if err != nil {
-			return nil
+			return nil, nil
 		}
 	}
 
@@ -142,7 +143,7 @@ func RunZypperPatch(ctx context.Context, opts ...ZypperPatchOption) error {
 
 	if len(fPatches) == 0 && len(fpkgs) == 0 {
 		clog.Infof(ctx, "No updates required.")
-		return nil
+		return nil, nil
 	}
 
 	if len(fPatches) == 0 {
@@ -167,11 +168,13 @@ func RunZypperPatch(ctx context.Context, opts ...ZypperPatchOption) error {
 		}
 	}
 
+	before := queryInstalled(ctx, installedRPMPackages)
 	if zOpts.dryrun {
-		return nil
+		return append(patchResults(fPatches, true, nil), packageResults(fpkgs, before, nil, nil)...), nil
 	}
 
-	return packages.ZypperInstall(ctx, fPatches, fpkgs)
+	err = packages.ZypperInstall(ctx, fPatches, fpkgs)
+	return append(patchResults(fPatches, false, err), packageResults(fpkgs, before, queryInstalled(ctx, installedRPMPackages), err)...), err
 }
 
 func runFilter(patches []packages.ZypperPatch, exclusivePatches, excludes []string, pkgUpdates []packages.PkgInfo, pkgToPatchesMap map[string][]string, withUpdate bool) ([]packages.ZypperPatch, []packages.PkgInfo, error) {
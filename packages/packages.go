@@ -130,3 +130,22 @@ func SetCommandRunner(commandRunner util.CommandRunner) {
 func SetPtyCommandRunner(commandRunner util.CommandRunner) {
 	ptyrunner = commandRunner
 }
+
+// PackageManagers returns the names of the package managers that can be used
+// to patch this system. Unlike the *Exists flags, which are set once at
+// startup, the binaries are looked for on each call so package managers
+// installed or removed since are picked up.
+func PackageManagers() []string {
+	var pms []string
+	for _, pm := range []struct{ name, path string }{
+		{"apt", aptGet},
+		{"yum", yum},
+		{"zypper", zypper},
+		{"googet", googet},
+	} {
+		if util.Exists(pm.path) {
+			pms = append(pms, pm.name)
+		}
+	}
+	return pms
+}
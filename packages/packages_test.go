@@ -17,8 +17,11 @@ package packages
 import (
 	"context"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"testing"
 )
 
 var pkgs = []string{"pkg1", "pkg2"}
@@ -39,3 +42,32 @@ func helperLoadBytes(name string) ([]byte, error) {
 	}
 	return bytes, nil
 }
+
+func TestPackageManagers(t *testing.T) {
+	td, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	oldAptGet, oldYum, oldZypper, oldGooGet := aptGet, yum, zypper, googet
+	defer func() { aptGet, yum, zypper, googet = oldAptGet, oldYum, oldZypper, oldGooGet }()
+	aptGet = filepath.Join(td, "apt-get")
+	yum = filepath.Join(td, "yum")
+	zypper = ""
+	googet = filepath.Join(td, "googet.exe")
+
+	if got := PackageManagers(); len(got) != 0 {
+		t.Errorf("PackageManagers with nothing installed: got(%q) != want([])", got)
+	}
+
+	// Package managers installed after startup are found.
+	for _, f := range []string{aptGet, googet} {
+		if err := ioutil.WriteFile(f, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := PackageManagers(), []string{"apt", "googet"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PackageManagers: got(%q) != want(%q)", got, want)
+	}
+}
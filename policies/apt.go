@@ -20,11 +20,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"sort"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/osconfig/clog"
+	"github.com/GoogleCloudPlatform/osconfig/external"
 	"github.com/GoogleCloudPlatform/osconfig/packages"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
@@ -41,7 +41,11 @@ var debArchiveTypeMap = map[agentendpointpb.AptRepository_ArchiveType]string{
 const aptGPGFile = "/etc/apt/trusted.gpg.d/osconfig_agent_managed.gpg"
 
 func getAptGPGKey(key string) (*openpgp.Entity, error) {
-	resp, err := http.Get(key)
+	cl, err := external.NewHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cl.Get(key)
 	if err != nil {
 		return nil, err
 	}
@@ -18,8 +18,11 @@ package policies
 import (
 	"context"
 	"encoding/json"
+	"io/ioutil"
+	"os"
 
 	"cloud.google.com/go/compute/metadata"
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/GoogleCloudPlatform/osconfig/clog"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
@@ -65,14 +68,28 @@ func (r *softwareRecipe) UnmarshalJSON(b []byte) error {
 }
 
 func readLocalConfig(ctx context.Context) (*localConfig, error) {
-	s, err := metadata.Get("/instance/attributes/gce-software-declaration")
-	if err != nil {
-		clog.Debugf(ctx, "No local config: %v", err)
-		return nil, nil
+	var s []byte
+	if agentconfig.MetadataDisabled() {
+		var err error
+		s, err = ioutil.ReadFile(agentconfig.SoftwareDeclarationFile())
+		if os.IsNotExist(err) {
+			clog.Debugf(ctx, "No local config: %v", err)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		md, err := metadata.Get("/instance/attributes/gce-software-declaration")
+		if err != nil {
+			clog.Debugf(ctx, "No local config: %v", err)
+			return nil, nil
+		}
+		s = []byte(md)
 	}
 
 	var lc localConfig
-	return &lc, json.Unmarshal([]byte(s), &lc)
+	return &lc, json.Unmarshal(s, &lc)
 }
 
 // GetId returns a repository Id that is used to group repositories for
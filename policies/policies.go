@@ -38,8 +38,11 @@ import (
 func run(ctx context.Context) {
 	var resp *agentendpointpb.EffectiveGuestPolicy
 
-	client, err := agentendpoint.NewBetaClient(ctx)
-	if err != nil {
+	// Without metadata there is no instance identity so only local guest
+	// policies are applied.
+	if agentconfig.MetadataDisabled() {
+		clog.Debugf(ctx, "Metadata is disabled, skipping LookupEffectiveGuestPolicies.")
+	} else if client, err := agentendpoint.NewBetaClient(ctx); err != nil {
 		clog.Errorf(ctx, "agentendpoint.NewBetaClient Error: %v", err)
 	} else {
 		defer client.Close()
@@ -165,14 +168,24 @@ func setConfig(ctx context.Context, egp *agentendpointpb.EffectiveGuestPolicy) {
 		}
 	}
 
+	// Repo files are always kept up to date, package changes only happen
+	// inside a maintenance window.
+	changePackages := true
+	if err := agentconfig.CheckMaintenanceWindow(); err != nil {
+		clog.Infof(ctx, "Deferring guest policy package changes: %v", err)
+		changePackages = false
+	}
+
 	if packages.GooGetExists {
 		if err := googetRepositories(ctx, gooRepos, agentconfig.GooGetRepoFilePath()); err != nil {
 			clog.Errorf(ctx, "Error writing googet repo file: %v", err)
 		}
-		if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying googet changes", func() error {
-			return googetChanges(ctx, gooInstallPkgs, gooRemovePkgs, gooUpdatePkgs)
-		}); err != nil {
-			clog.Errorf(ctx, "Error performing googet changes: %v", err)
+		if changePackages {
+			if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying googet changes", func() error {
+				return googetChanges(ctx, gooInstallPkgs, gooRemovePkgs, gooUpdatePkgs)
+			}); err != nil {
+				clog.Errorf(ctx, "Error performing googet changes: %v", err)
+			}
 		}
 	}
 
@@ -180,10 +193,12 @@ func setConfig(ctx context.Context, egp *agentendpointpb.EffectiveGuestPolicy) {
 		if err := aptRepositories(ctx, aptRepos, agentconfig.AptRepoFilePath()); err != nil {
 			clog.Errorf(ctx, "Error writing apt repo file: %v", err)
 		}
-		if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying apt changes", func() error {
-			return aptChanges(ctx, aptInstallPkgs, aptRemovePkgs, aptUpdatePkgs)
-		}); err != nil {
-			clog.Errorf(ctx, "Error performing apt changes: %v", err)
+		if changePackages {
+			if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying apt changes", func() error {
+				return aptChanges(ctx, aptInstallPkgs, aptRemovePkgs, aptUpdatePkgs)
+			}); err != nil {
+				clog.Errorf(ctx, "Error performing apt changes: %v", err)
+			}
 		}
 	}
 
@@ -191,10 +206,12 @@ func setConfig(ctx context.Context, egp *agentendpointpb.EffectiveGuestPolicy) {
 		if err := yumRepositories(ctx, yumRepos, agentconfig.YumRepoFilePath()); err != nil {
 			clog.Errorf(ctx, "Error writing yum repo file: %v", err)
 		}
-		if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying yum changes", func() error {
-			return yumChanges(ctx, yumInstallPkgs, yumRemovePkgs, yumUpdatePkgs)
-		}); err != nil {
-			clog.Errorf(ctx, "Error performing yum changes: %v", err)
+		if changePackages {
+			if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying yum changes", func() error {
+				return yumChanges(ctx, yumInstallPkgs, yumRemovePkgs, yumUpdatePkgs)
+			}); err != nil {
+				clog.Errorf(ctx, "Error performing yum changes: %v", err)
+			}
 		}
 	}
 
@@ -202,10 +219,12 @@ func setConfig(ctx context.Context, egp *agentendpointpb.EffectiveGuestPolicy) {
 		if err := zypperRepositories(ctx, zypperRepos, agentconfig.ZypperRepoFilePath()); err != nil {
 			clog.Errorf(ctx, "Error writing zypper repo file: %v", err)
 		}
-		if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying zypper changes.", func() error {
-			return zypperChanges(ctx, zypperInstallPkgs, zypperRemovePkgs, zypperUpdatePkgs)
-		}); err != nil {
-			clog.Errorf(ctx, "Error performing zypper changes: %v", err)
+		if changePackages {
+			if err := retryutil.RetryFunc(ctx, 1*time.Minute, "Applying zypper changes.", func() error {
+				return zypperChanges(ctx, zypperInstallPkgs, zypperRemovePkgs, zypperUpdatePkgs)
+			}); err != nil {
+				clog.Errorf(ctx, "Error performing zypper changes: %v", err)
+			}
 		}
 	}
 }
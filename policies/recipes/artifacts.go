@@ -55,7 +55,7 @@ func fetchArtifact(ctx context.Context, artifact *agentendpointpb.SoftwareRecipe
 		gcs := artifact.GetGcs()
 		extension = path.Ext(gcs.Object)
 
-		cl, err := storage.NewClient(ctx)
+		cl, err := external.NewGCSClient(ctx)
 		if err != nil {
 			return "", fmt.Errorf("error creating gcs client: %v", err)
 		}
@@ -72,7 +72,10 @@ func fetchArtifact(ctx context.Context, artifact *agentendpointpb.SoftwareRecipe
 		}
 		extension = path.Ext(uri.Path)
 		checksum = remote.Checksum
-		cl := &http.Client{}
+		cl, err := external.NewHTTPClient()
+		if err != nil {
+			return "", fmt.Errorf("error creating http client: %v", err)
+		}
 		reader, err = getHTTPArtifact(cl, *uri)
 		if err != nil {
 			return "", fmt.Errorf("error fetching artifact %q: %v", artifact.Id, err)
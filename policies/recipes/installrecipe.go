@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 	"github.com/GoogleCloudPlatform/osconfig/clog"
 
 	agentendpointpb "google.golang.org/genproto/googleapis/cloud/osconfig/agentendpoint/v1beta"
@@ -49,6 +50,10 @@ func InstallRecipe(ctx context.Context, recipe *agentendpointpb.SoftwareRecipe)
 		clog.Infof(ctx, "Installing software recipe %s.", recipe.GetName())
 	}
 
+	if err := agentconfig.CheckMaintenanceWindow(); err != nil {
+		return fmt.Errorf("deferring software recipe %s: %v", recipe.GetName(), err)
+	}
+
 	clog.Debugf(ctx, "Creating working directory for recipe %s.", recipe.GetName())
 	runID := fmt.Sprintf("run_%d", time.Now().UnixNano())
 	runDir, err := createBaseDir(recipe, runID)
@@ -19,14 +19,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime"
 	"time"
+
+	"github.com/GoogleCloudPlatform/osconfig/agentconfig"
 )
 
 var (
-	dbDirWindows = "C:\\ProgramData\\Google"
-	dbDirUnix    = "/var/lib/google"
-	dbFileName   = "osconfig_recipedb"
+	dbFileName = "osconfig_recipedb"
 )
 
 // RecipeDB represents local state of installed recipes.
@@ -102,8 +101,5 @@ func (db RecipeDB) addRecipe(name, version string, success bool) error {
 }
 
 func getDbDir() string {
-	if runtime.GOOS == "windows" {
-		return dbDirWindows
-	}
-	return dbDirUnix
+	return agentconfig.RecipeDBDir()
 }
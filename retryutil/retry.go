@@ -95,7 +95,17 @@ func RetryAPICall(ctx context.Context, maxRetryTime time.Duration, name string,
 			return err
 		}
 
+		// Callers such as heartbeats cancel ctx when they are done, there is
+		// no point in waiting to retry a call that can not succeed.
+		if ctx.Err() != nil {
+			return err
+		}
+
 		clog.Warningf(ctx, "Error calling %s, attempt %d, retrying in %s: %v", name, i, ns, err)
-		time.Sleep(ns)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(ns):
+		}
 	}
 }